@@ -0,0 +1,110 @@
+package goforit
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// adminFlag is how AdminHandler describes a flag
+type adminFlag struct {
+	Name     string `json:"name"`
+	Enabled  bool   `json:"enabled"`
+	Override *bool  `json:"override,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// adminOverride is the body of a request to override a flag
+type adminOverride struct {
+	Value *bool `json:"value"`
+}
+
+type adminHandler struct {
+	g *goforit
+}
+
+// AdminHandler returns a handler for viewing flags and setting global
+// overrides. It should be mounted with http.StripPrefix, behind whatever
+// authentication the service uses. It serves:
+//
+//	GET /flags: all flags, checked with the query parameters as properties
+//	POST /flags/{name}/override: override a flag, with a body like {"value": true}
+//	DELETE /flags/{name}/override: remove a flag's override
+//
+// A flag can be named by an alias, or with any case if names are case
+// insensitive.
+//
+// Responses are JSON.
+func (g *goforit) AdminHandler() http.Handler {
+	return adminHandler{g}
+}
+
+func (h adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+	if path == "/flags" {
+		if r.Method != "GET" {
+			h.error(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		properties := make(map[string]string)
+		for k, v := range r.URL.Query() {
+			properties[k] = v[len(v)-1]
+		}
+		flags := []adminFlag{}
+		for _, name := range h.g.Flags(nil) {
+			flags = append(flags, h.describe(name, properties))
+		}
+		h.write(w, http.StatusOK, map[string]interface{}{"flags": flags})
+		return
+	}
+
+	if !strings.HasPrefix(path, "/flags/") || !strings.HasSuffix(path, "/override") {
+		h.error(w, http.StatusNotFound, "Not found")
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(path, "/flags/"), "/override")
+	if name == "" {
+		h.error(w, http.StatusNotFound, "Not found")
+		return
+	}
+	// Use the real name, like checks do
+	name = h.g.resolveAlias(name)
+	switch r.Method {
+	case "POST":
+		var body adminOverride
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+			h.error(w, http.StatusBadRequest, `Body should be like {"value": true}`)
+			return
+		}
+		h.g.SetGlobalOverride(name, *body.Value)
+	case "DELETE":
+		h.g.ClearGlobalOverride(name)
+	default:
+		h.error(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	h.write(w, http.StatusOK, h.describe(name, nil))
+}
+
+// describe checks a flag, without side effects
+func (h adminHandler) describe(name string, properties map[string]string) adminFlag {
+	enabled, _, _, errs := h.g.check(nil, name, properties, nil, true)
+	f := adminFlag{Name: name, Enabled: enabled}
+	if value, ok := h.g.loadGlobalOverrides()[name]; ok {
+		f.Override = &value
+	}
+	if len(errs) > 0 {
+		f.Error = errs[0].Error()
+	}
+	return f
+}
+
+func (h adminHandler) error(w http.ResponseWriter, status int, msg string) {
+	h.write(w, status, map[string]string{"error": msg})
+}
+
+func (h adminHandler) write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
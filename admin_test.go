@@ -0,0 +1,87 @@
+package goforit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminHandler(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	handler := http.StripPrefix("/admin", g.AdminHandler())
+	serve := func(method, path, body string) (int, string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		return w.Code, w.Body.String()
+	}
+
+	code, body := serve("GET", "/admin/flags?user=alice", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"flags": [
+		{"name": "go.on", "enabled": true},
+		{"name": "go.users", "enabled": true}
+	]}`, body)
+	_, body = serve("GET", "/admin/flags", "")
+	assert.Contains(t, body, "No property user")
+
+	// Overrides apply to every check
+	code, body = serve("POST", "/admin/flags/go.on/override", `{"value": false}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"name": "go.on", "enabled": false, "override": false}`, body)
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	assert.True(t, g.Enabled(Override(context.Background(), "go.on", true), "go.on", nil))
+
+	// Changing the overrides we get back doesn't change the real ones
+	overrides := g.GlobalOverrides()
+	assert.Equal(t, map[string]bool{"go.on": false}, overrides)
+	overrides["go.on"] = true
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+
+	code, body = serve("DELETE", "/admin/flags/go.on/override", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"name": "go.on", "enabled": true}`, body)
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+
+	// Aliases override the real flag
+	g.SetAliases(map[string]string{"go.old": "go.on"})
+	code, body = serve("POST", "/admin/flags/go.old/override", `{"value": false}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"name": "go.on", "enabled": false, "override": false}`, body)
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	assert.Equal(t, map[string]bool{"go.on": false}, g.GlobalOverrides())
+	code, body = serve("DELETE", "/admin/flags/go.old/override", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"name": "go.on", "enabled": true}`, body)
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+
+	code, _ = serve("POST", "/admin/flags/go.on/override", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = serve("PUT", "/admin/flags", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, code)
+	code, _ = serve("GET", "/admin/other", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func TestAdminHandlerNoFlags(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	w := httptest.NewRecorder()
+	g.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/flags", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"flags": []}`, w.Body.String())
+}
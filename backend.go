@@ -1,13 +1,23 @@
 package goforit
 
 import (
+	"context"
 	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
 )
 
 type Backend interface {
@@ -16,6 +26,31 @@ type Backend interface {
 	Refresh() ([]Flag, time.Time, error)
 }
 
+// A ContextBackend is a Backend that can give up on a refresh when its context
+// is done, eg: when the refresh timeout passes
+type ContextBackend interface {
+	Backend
+	RefreshContext(ctx context.Context) ([]Flag, time.Time, error)
+}
+
+// RefreshErrors may be returned by a Backend that loaded some flags, but had to
+// skip others. The flags that were loaded are still used, and each error is logged.
+type RefreshErrors []error
+
+func (e RefreshErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Unwrap returns each error. Is and As also look at each of them, for
+// versions of Go before errors.Is and errors.As used this.
+func (e RefreshErrors) Unwrap() []error {
+	return e
+}
+
 type csvFileBackend struct {
 	filename string
 }
@@ -24,11 +59,60 @@ type jsonFileBackend struct {
 	filename string
 }
 
+type yamlFileBackend struct {
+	filename string
+}
+
+type tomlFileBackend struct {
+	filename string
+}
+
+type chainBackend struct {
+	backends []Backend
+}
+
+type filesBackend struct {
+	filenames []string
+}
+
+type failoverBackend struct {
+	primary   Backend
+	secondary Backend
+	after     time.Duration
+	now       func() time.Time
+
+	mtx sync.Mutex
+	// When the primary started failing, or zero if it's working
+	failingSince time.Time
+	// Whether we last used the secondary
+	failedOver bool
+}
+
+type envBackend struct {
+	prefix string
+}
+
+type httpBackend struct {
+	url    string
+	client *http.Client
+
+	// The last response, so we can make conditional requests
+	mtx          sync.Mutex
+	lastModified string
+	flags        []Flag
+	updated      time.Time
+}
+
 type flagJson struct {
-	Name   string
-	Active bool
-	Rate   float64
-	Rules  []RuleInfo
+	Name              string
+	Active            bool
+	Rate              float64
+	Rules             []RuleInfo
+	Variants          []VariantInfo
+	VariantProperties []string `json:"variant_properties"`
+	Metadata          map[string]string
+	Value             string           `json:"value,omitempty"`
+	OnMissingTag      MissingTagPolicy `json:"on_missing_tag,omitempty"`
 }
 
 type ruleInfoJson struct {
@@ -42,8 +126,40 @@ type JSONFormat struct {
 	UpdatedTime float64 `json:"updated"`
 }
 
+type flagYAML struct {
+	Name   string  `yaml:"name"`
+	Active bool    `yaml:"active"`
+	Rate   float64 `yaml:"rate"`
+}
+
+type flagTOML struct {
+	Name   string `toml:"name"`
+	Active bool   `toml:"active"`
+	// A rate may be written as an integer or a float
+	Rate interface{} `toml:"rate"`
+}
+
+// tomlFormatRaw lets us parse each flag separately, like jsonFormatRaw
+type tomlFormatRaw struct {
+	Flags       []toml.Primitive `toml:"flags"`
+	UpdatedTime float64          `toml:"updated"`
+}
+
+// yamlFormatRaw lets us parse each flag separately, like jsonFormatRaw
+type yamlFormatRaw struct {
+	Flags       []interface{} `yaml:"flags"`
+	UpdatedTime float64       `yaml:"updated"`
+}
+
+// jsonFormatRaw lets us parse each flag separately, so one bad flag doesn't
+// prevent the rest from loading
+type jsonFormatRaw struct {
+	Flags       []json.RawMessage `json:"flags"`
+	UpdatedTime float64           `json:"updated"`
+}
+
 // While the goforit client allows for complex feature flag functionality, it is possible to have
-//simple flags that specify only Name and Rate (at least for the time being).Instead of using
+// simple flags that specify only Name and Rate (at least for the time being).Instead of using
 // versions to formalize this, we will write some simple logic in a custom Unmarshaler to handle
 // both cases
 func (ri *Flag) UnmarshalJSON(buf []byte) error {
@@ -52,22 +168,88 @@ func (ri *Flag) UnmarshalJSON(buf []byte) error {
 	if err != nil {
 		return err
 	}
+	if !validMissingTagPolicies[raw.OnMissingTag] {
+		return fmt.Errorf("Bad on_missing_tag policy %q", raw.OnMissingTag)
+	}
 	if len(raw.Rules) == 0 {
-		// if no rules are specified, we create a RateRule if a non-zero rate was specified, and ensure
-		// the flag is active. if no rate was specified, active should be default to false
-		if raw.Rate > 0 {
-			raw.Active = true
-			raw.Rules = []RuleInfo{
-				{&RateRule{Rate: raw.Rate}, RuleOn, RuleOff},
-			}
+		*ri = simpleFlag(raw.Name, raw.Active, raw.Rate)
+	} else {
+		ri.Name = raw.Name
+		ri.Active = raw.Active
+		ri.Rules = raw.Rules
+	}
+	ri.Variants = raw.Variants
+	ri.VariantProperties = raw.VariantProperties
+	ri.Metadata = raw.Metadata
+	ri.Value = raw.Value
+	ri.OnMissingTag = raw.OnMissingTag
+
+	return nil
+}
+
+// simpleFlag builds a flag that has no rules, other than perhaps a sample rate
+func simpleFlag(name string, active bool, rate float64) Flag {
+	// we create a RateRule if a non-zero rate was specified, and ensure
+	// the flag is active. if no rate was specified, active should be default to false
+	f := Flag{Name: name, Active: active}
+	if rate > 0 {
+		f.Active = true
+		f.Rules = []RuleInfo{
+			{&RateRule{Rate: rate}, RuleOn, RuleOff},
 		}
 	}
+	return f
+}
 
-	ri.Name = raw.Name
-	ri.Active = raw.Active
-	ri.Rules = raw.Rules
+// MarshalJSON writes a flag in the same format that UnmarshalJSON reads
+func (ri Flag) MarshalJSON() ([]byte, error) {
+	return json.Marshal(flagJson{
+		Name:              ri.Name,
+		Active:            ri.Active,
+		Rules:             ri.Rules,
+		Variants:          ri.Variants,
+		VariantProperties: ri.VariantProperties,
+		Metadata:          ri.Metadata,
+		Value:             ri.Value,
+		OnMissingTag:      ri.OnMissingTag,
+	})
+}
 
-	return nil
+// MarshalJSON writes a rule in the same format that UnmarshalJSON reads. Custom
+// rules can't be written.
+func (ri RuleInfo) MarshalJSON() ([]byte, error) {
+	var typ string
+	switch ri.Rule.(type) {
+	case *MatchListRule:
+		typ = "match_list"
+	case *RateRule:
+		typ = "sample"
+	case *TimeWindowRule:
+		typ = "time_window"
+	case *ScheduleRule:
+		typ = "schedule"
+	case *RampRule:
+		typ = "ramp"
+	case *BucketRule:
+		typ = "bucket"
+	case *PrerequisiteRule:
+		typ = "prerequisites"
+	default:
+		return nil, fmt.Errorf("Can't write rule of type %T", ri.Rule)
+	}
+
+	buf, err := json.Marshal(ri.Rule)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	fields["type"] = typ
+	fields["on_match"] = ri.OnMatch
+	fields["on_miss"] = ri.OnMiss
+	return json.Marshal(fields)
 }
 
 func (ri *RuleInfo) UnmarshalJSON(buf []byte) error {
@@ -93,6 +275,16 @@ func (ri *RuleInfo) UnmarshalJSON(buf []byte) error {
 		ri.Rule = &MatchListRule{}
 	case "sample": // TODO: constant
 		ri.Rule = &RateRule{}
+	case "time_window":
+		ri.Rule = &TimeWindowRule{}
+	case "schedule":
+		ri.Rule = &ScheduleRule{}
+	case "ramp":
+		ri.Rule = &RampRule{}
+	case "bucket":
+		ri.Rule = &BucketRule{}
+	case "prerequisites":
+		ri.Rule = &PrerequisiteRule{}
 	default:
 		return errors.New("Bad type") // TODO: custom error type
 	}
@@ -100,6 +292,50 @@ func (ri *RuleInfo) UnmarshalJSON(buf []byte) error {
 	return json.Unmarshal(buf, ri.Rule)
 }
 
+type scheduleRuleJson struct {
+	Cron     string `json:"cron"`
+	Duration string `json:"duration"`
+	Location string `json:"location,omitempty"`
+}
+
+// UnmarshalJSON reads a schedule rule, with a duration like "8h" and an
+// optional location like "America/Los_Angeles". The cron expression is
+// checked here, so a bad one is an error parsing the flag.
+func (r *ScheduleRule) UnmarshalJSON(buf []byte) error {
+	var raw scheduleRuleJson
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return err
+	}
+	schedule, err := parseCron(raw.Cron)
+	if err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(raw.Duration)
+	if err != nil {
+		return err
+	}
+	if duration <= 0 {
+		return fmt.Errorf("Schedule duration %s should be positive", raw.Duration)
+	}
+	var loc *time.Location
+	if raw.Location != "" {
+		if loc, err = time.LoadLocation(raw.Location); err != nil {
+			return err
+		}
+	}
+	*r = ScheduleRule{Cron: raw.Cron, Duration: duration, Location: loc, schedule: &schedule}
+	return nil
+}
+
+// MarshalJSON writes a schedule rule in the same format that UnmarshalJSON reads
+func (r *ScheduleRule) MarshalJSON() ([]byte, error) {
+	raw := scheduleRuleJson{Cron: r.Cron, Duration: r.Duration.String()}
+	if r.Location != nil {
+		raw.Location = r.Location.String()
+	}
+	return json.Marshal(raw)
+}
+
 func readFile(file string, backend string, parse func(io.Reader) ([]Flag, time.Time, error)) ([]Flag, time.Time, error) {
 	f, err := os.Open(file)
 	if err != nil {
@@ -113,30 +349,316 @@ func (b jsonFileBackend) Refresh() ([]Flag, time.Time, error) {
 	return readFile(b.filename, "json", parseFlagsJSON)
 }
 
+func (b yamlFileBackend) Refresh() ([]Flag, time.Time, error) {
+	return readFile(b.filename, "yaml", parseFlagsYAML)
+}
+
+func (b tomlFileBackend) Refresh() ([]Flag, time.Time, error) {
+	return readFile(b.filename, "toml", parseFlagsTOML)
+}
+
 func (b csvFileBackend) Refresh() ([]Flag, time.Time, error) {
 	return readFile(b.filename, "csv", parseFlagsCSV)
 }
 
+func (b *httpBackend) Refresh() ([]Flag, time.Time, error) {
+	return b.RefreshContext(context.Background())
+}
+
+func (b *httpBackend) RefreshContext(ctx context.Context) ([]Flag, time.Time, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	req, err := http.NewRequest("GET", b.url, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	req = req.WithContext(ctx)
+	if b.lastModified != "" {
+		req.Header.Set("If-Modified-Since", b.lastModified)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		// Nothing has changed, no need to parse again
+		return b.flags, b.updated, nil
+	default:
+		return nil, time.Time{}, fmt.Errorf("Unexpected response fetching flags from %s: %s", b.url, resp.Status)
+	}
+
+	flags, _, err := parseFlagsJSON(resp.Body)
+	if _, ok := err.(RefreshErrors); err != nil && !ok {
+		return nil, time.Time{}, err
+	}
+
+	// Prefer the server's idea of when the flags changed, falling back to now
+	updated := time.Now()
+	lastModified := resp.Header.Get("Last-Modified")
+	if t, perr := http.ParseTime(lastModified); perr == nil {
+		updated = t
+	} else {
+		lastModified = ""
+	}
+
+	b.lastModified = lastModified
+	b.flags = flags
+	b.updated = updated
+	return flags, updated, err
+}
+
+// parserForFile picks how to parse a file, by its extension
+func parserForFile(filename string) func(io.Reader) ([]Flag, time.Time, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return parseFlagsJSON
+	case ".yaml", ".yml":
+		return parseFlagsYAML
+	case ".toml":
+		return parseFlagsTOML
+	default:
+		return parseFlagsCSV
+	}
+}
+
+func (b filesBackend) Refresh() ([]Flag, time.Time, error) {
+	var flags []Flag
+	var updated time.Time
+	var errs RefreshErrors
+	// Where each flag is in flags, and which file it came from
+	index := make(map[string]int)
+	from := make(map[string]string)
+	for _, filename := range b.filenames {
+		info, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, time.Time{}, err
+		}
+		fileFlags, fileUpdated, err := readFile(filename, "files", parserForFile(filename))
+		if partial, ok := err.(RefreshErrors); ok {
+			for _, e := range partial {
+				errs = append(errs, fmt.Errorf("%s: %s", filename, e))
+			}
+		} else if err != nil {
+			return nil, time.Time{}, fmt.Errorf("%s: %s", filename, err)
+		}
+
+		if fileUpdated.IsZero() {
+			fileUpdated = info.ModTime()
+		}
+		if fileUpdated.After(updated) {
+			updated = fileUpdated
+		}
+
+		// Later files take precedence
+		for _, flag := range fileFlags {
+			if i, ok := index[flag.Name]; ok {
+				if from[flag.Name] != filename {
+					errs = append(errs, fmt.Errorf("Flag %s in %s replaces the one in %s", flag.Name, filename, from[flag.Name]))
+				}
+				flags[i] = flag
+			} else {
+				index[flag.Name] = len(flags)
+				flags = append(flags, flag)
+			}
+			from[flag.Name] = filename
+		}
+	}
+	if len(errs) > 0 {
+		return flags, updated, errs
+	}
+	return flags, updated, nil
+}
+
+// refreshContext refreshes a backend, passing along the context if it's a
+// ContextBackend
+func refreshContext(ctx context.Context, backend Backend) ([]Flag, time.Time, error) {
+	if cb, ok := backend.(ContextBackend); ok {
+		return cb.RefreshContext(ctx)
+	}
+	return backend.Refresh()
+}
+
+func (b *failoverBackend) Refresh() ([]Flag, time.Time, error) {
+	return b.RefreshContext(context.Background())
+}
+
+// RefreshContext passes the context to the primary and secondary backends, so
+// wrapping them doesn't stop their refreshes from being cancelled
+func (b *failoverBackend) RefreshContext(ctx context.Context) ([]Flag, time.Time, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	flags, updated, err := refreshContext(ctx, b.primary)
+	if _, ok := err.(RefreshErrors); err == nil || ok {
+		b.failingSince = time.Time{}
+		if b.failedOver {
+			b.failedOver = false
+			errs, _ := err.(RefreshErrors)
+			return flags, updated, append(errs, errors.New("Primary backend recovered, no longer using the secondary"))
+		}
+		return flags, updated, err
+	}
+
+	now := b.now()
+	if b.failingSince.IsZero() {
+		b.failingSince = now
+	}
+	failing := now.Sub(b.failingSince)
+	if failing < b.after {
+		return nil, time.Time{}, err
+	}
+
+	secondaryFlags, secondaryUpdated, secondaryErr := refreshContext(ctx, b.secondary)
+	partial, ok := secondaryErr.(RefreshErrors)
+	if secondaryErr != nil && !ok {
+		return nil, time.Time{}, fmt.Errorf("Primary backend failing for %s: %s; secondary backend failed too: %s", failing, err, secondaryErr)
+	}
+	b.failedOver = true
+	errs := RefreshErrors{fmt.Errorf("Primary backend failing for %s, using the secondary: %s", failing, err)}
+	for _, e := range partial {
+		errs = append(errs, fmt.Errorf("Secondary backend: %s", e))
+	}
+	return secondaryFlags, secondaryUpdated, errs
+}
+
+func (b chainBackend) Refresh() ([]Flag, time.Time, error) {
+	return b.RefreshContext(context.Background())
+}
+
+// RefreshContext passes the context to each backend
+func (b chainBackend) RefreshContext(ctx context.Context) ([]Flag, time.Time, error) {
+	var flags []Flag
+	var updated time.Time
+	var errs RefreshErrors
+	seen := make(map[string]bool)
+	succeeded := false
+	for i, backend := range b.backends {
+		backendFlags, backendUpdated, err := refreshContext(ctx, backend)
+		if partial, ok := err.(RefreshErrors); ok {
+			for _, e := range partial {
+				errs = append(errs, fmt.Errorf("Backend %d: %s", i, e))
+			}
+		} else if err != nil {
+			errs = append(errs, fmt.Errorf("Backend %d: %s", i, err))
+			continue
+		}
+		succeeded = true
+
+		// Earlier backends take precedence
+		for _, flag := range backendFlags {
+			if !seen[flag.Name] {
+				seen[flag.Name] = true
+				flags = append(flags, flag)
+			}
+		}
+		if backendUpdated.After(updated) {
+			updated = backendUpdated
+		}
+	}
+
+	if !succeeded && len(errs) > 0 {
+		// Nothing worked, so don't let the caller think it was partly successful
+		return nil, time.Time{}, errors.New(errs.Error())
+	}
+	if len(errs) > 0 {
+		return flags, updated, errs
+	}
+	return flags, updated, nil
+}
+
+func (b envBackend) Refresh() ([]Flag, time.Time, error) {
+	return parseFlagsEnv(b.prefix, os.Environ())
+}
+
+func parseFlagsEnv(prefix string, environ []string) ([]Flag, time.Time, error) {
+	var flags []Flag
+	var errs RefreshErrors
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, prefix), "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		name := envFlagName(parts[0])
+
+		if active, err := strconv.ParseBool(parts[1]); err == nil {
+			flags = append(flags, Flag{Name: name, Active: active})
+			continue
+		}
+		rate, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			errs = append(errs, ErrParseFlag{Flag: name, Value: parts[1], Err: err})
+			continue
+		}
+		flags = append(flags, simpleFlag(name, false, rate))
+	}
+
+	// The environment doesn't change, so it can't be stale
+	if len(errs) > 0 {
+		return flags, time.Time{}, errs
+	}
+	return flags, time.Time{}, nil
+}
+
+// envFlagName converts an environment variable name to a flag name, eg:
+// GO_SUN__MONEY becomes go.sun_money
+func envFlagName(key string) string {
+	parts := strings.Split(strings.ToLower(key), "__")
+	for i, part := range parts {
+		parts[i] = strings.Replace(part, "_", ".", -1)
+	}
+	return strings.Join(parts, "_")
+}
+
 func parseFlagsCSV(r io.Reader) ([]Flag, time.Time, error) {
-	// every row is guaranteed to have 2 fields
-	const FieldsPerRecord = 2
+	// every row has a name and rate, and may have key=value metadata after
+	const MinFieldsPerRecord = 2
 
 	cr := csv.NewReader(r)
-	cr.FieldsPerRecord = FieldsPerRecord
+	cr.FieldsPerRecord = -1
 	cr.TrimLeadingSpace = true
 
-	rows, err := cr.ReadAll()
-	if err != nil {
-		return nil, time.Time{}, err
+	// Blank lines are skipped, so the line of each row isn't its index
+	var rows [][]string
+	var lines []int
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if perr, ok := err.(*csv.ParseError); ok {
+				return nil, time.Time{}, ErrParseFlag{Line: perr.Line, Err: perr.Err}
+			}
+			return nil, time.Time{}, err
+		}
+		line := csvLine(cr, len(rows)+1)
+		if len(row) < MinFieldsPerRecord {
+			return nil, time.Time{}, ErrParseFlag{Line: line, Value: strings.Join(row, ","), Err: csv.ErrFieldCount}
+		}
+		rows = append(rows, row)
+		lines = append(lines, line)
 	}
 
 	flags := make([]Flag, 0, len(rows))
-	for _, row := range rows {
+	seen := make(map[string]int) // flag name -> row
+	var errs RefreshErrors
+	for i, row := range rows {
 		name := row[0]
 
 		rate, err := strconv.ParseFloat(row[1], 64)
 		if err != nil {
-			// TODO also track somehow
+			// Treat it as off, but let someone know
+			errs = append(errs, ErrParseFlag{Flag: name, Line: lines[i], Value: row[1], Err: err})
 			rate = 0
 		}
 
@@ -149,19 +671,158 @@ func parseFlagsCSV(r io.Reader) ([]Flag, time.Time, error) {
 				{&RateRule{Rate: rate}, RuleOn, RuleOff},
 			}
 		}
-		flags = append(flags, f)
+		for _, field := range row[MinFieldsPerRecord:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				errs = append(errs, ErrParseFlag{Flag: name, Line: lines[i], Value: field, Err: errors.New("metadata should be key=value")})
+				continue
+			}
+			if f.Metadata == nil {
+				f.Metadata = make(map[string]string)
+			}
+			f.Metadata[kv[0]] = kv[1]
+		}
+
+		if prev, ok := seen[name]; ok {
+			errs = append(errs, ErrDuplicateFlag{Flag: name, PreviousLine: lines[prev], Line: lines[i],
+				PreviousValue: rows[prev][1], Value: row[1]})
+			for j := range flags {
+				if flags[j].Name == name {
+					flags[j] = f
+				}
+			}
+		} else {
+			flags = append(flags, f)
+		}
+		seen[name] = i
+	}
+	if len(errs) > 0 {
+		return flags, time.Time{}, errs
 	}
 	return flags, time.Time{}, nil
 }
 
 func parseFlagsJSON(r io.Reader) ([]Flag, time.Time, error) {
 	dec := json.NewDecoder(r)
-	var v JSONFormat
+	var v jsonFormatRaw
 	err := dec.Decode(&v)
 	if err != nil {
 		return nil, time.Time{}, err
 	}
-	return v.Flags, time.Unix(int64(v.UpdatedTime), 0), nil
+
+	flags := make([]Flag, 0, len(v.Flags))
+	var errs RefreshErrors
+	for i, raw := range v.Flags {
+		var flag Flag
+		err = json.Unmarshal(raw, &flag)
+		if err != nil {
+			var named struct{ Name string }
+			if json.Unmarshal(raw, &named) != nil || named.Name == "" {
+				named.Name = fmt.Sprintf("#%d", i)
+			}
+			errs = append(errs, ErrParseFlag{Flag: named.Name, Value: string(raw), Err: err})
+			continue
+		}
+		flags = append(flags, flag)
+	}
+
+	updated := time.Unix(int64(v.UpdatedTime), 0)
+	if len(errs) > 0 {
+		return flags, updated, errs
+	}
+	return flags, updated, nil
+}
+
+func parseFlagsYAML(r io.Reader) ([]Flag, time.Time, error) {
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var v yamlFormatRaw
+	err = yaml.Unmarshal(buf, &v)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	flags := make([]Flag, 0, len(v.Flags))
+	var errs RefreshErrors
+	for i, raw := range v.Flags {
+		// Round-trip each flag, so we can strictly parse it on its own
+		var f flagYAML
+		buf, err := yaml.Marshal(raw)
+		if err == nil {
+			err = yaml.UnmarshalStrict(buf, &f)
+		}
+		if err == nil && f.Name == "" {
+			err = errors.New("missing name")
+		}
+		if err != nil {
+			name := f.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			errs = append(errs, ErrParseFlag{Flag: name, Value: string(buf), Err: err})
+			continue
+		}
+		flags = append(flags, simpleFlag(f.Name, f.Active, f.Rate))
+	}
+
+	updated := time.Time{}
+	if v.UpdatedTime != 0 {
+		updated = time.Unix(int64(v.UpdatedTime), 0)
+	}
+	if len(errs) > 0 {
+		return flags, updated, errs
+	}
+	return flags, updated, nil
+}
+
+func parseFlagsTOML(r io.Reader) ([]Flag, time.Time, error) {
+	var v tomlFormatRaw
+	md, err := toml.DecodeReader(r, &v)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	flags := make([]Flag, 0, len(v.Flags))
+	var errs RefreshErrors
+	for i, raw := range v.Flags {
+		var f flagTOML
+		err := md.PrimitiveDecode(raw, &f)
+		var rate float64
+		if err == nil {
+			switch r := f.Rate.(type) {
+			case nil:
+			case int64:
+				rate = float64(r)
+			case float64:
+				rate = r
+			default:
+				err = fmt.Errorf("rate must be a number, not %v", r)
+			}
+		}
+		if err == nil && f.Name == "" {
+			err = errors.New("missing name")
+		}
+		if err != nil {
+			name := f.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			errs = append(errs, ErrParseFlag{Flag: name, Err: err})
+			continue
+		}
+		flags = append(flags, simpleFlag(f.Name, f.Active, rate))
+	}
+
+	updated := time.Time{}
+	if v.UpdatedTime != 0 {
+		updated = time.Unix(int64(v.UpdatedTime), 0)
+	}
+	if len(errs) > 0 {
+		return flags, updated, errs
+	}
+	return flags, updated, nil
 }
 
 // BackendFromFile is a helper function that creates a valid
@@ -177,3 +838,84 @@ func BackendFromFile(filename string) Backend {
 func BackendFromJSONFile(filename string) Backend {
 	return jsonFileBackend{filename}
 }
+
+// BackendFromYAMLFile creates a backend powered by a YAML file. Each flag
+// has a name, and either an active boolean or a sample rate:
+//
+//	updated: 1519247256.06
+//	flags:
+//	  - name: go.moon.mercury
+//	    active: true
+//	  - name: go.stars.money
+//	    rate: 0.5
+func BackendFromYAMLFile(filename string) Backend {
+	return yamlFileBackend{filename}
+}
+
+// BackendFromTOMLFile creates a backend powered by a TOML file, with the same
+// fields as BackendFromYAMLFile:
+//
+//	updated = 1519247256.06
+//
+//	[[flags]]
+//	name = "go.moon.mercury"
+//	active = true
+//
+//	[[flags]]
+//	name = "go.stars.money"
+//	rate = 0.5
+func BackendFromTOMLFile(filename string) Backend {
+	return tomlFileBackend{filename}
+}
+
+// httpTimeout bounds each request made by BackendFromHTTP, so a hung server
+// can't stall refreshes forever
+const httpTimeout = 30 * time.Second
+
+// BackendFromHTTP creates a backend that fetches flags from a URL, in the same
+// format as BackendFromJSONFile. The age of the flags comes from the
+// Last-Modified header, if the server provides one. Requests time out after 30
+// seconds; use BackendFromHTTPClient to change that.
+func BackendFromHTTP(url string) Backend {
+	return BackendFromHTTPClient(url, &http.Client{Timeout: httpTimeout})
+}
+
+// BackendFromHTTPClient is like BackendFromHTTP, but makes its requests with
+// the given client.
+func BackendFromHTTPClient(url string, client *http.Client) Backend {
+	return &httpBackend{url: url, client: client}
+}
+
+// BackendFromEnv creates a backend that reads flags from environment variables
+// that start with the given prefix, eg: GOFORIT_. The rest of the variable
+// name is lowercased, with a single underscore becoming a dot and a double
+// underscore becoming an underscore. So GOFORIT_GO_SUN__MONEY is the flag
+// go.sun_money. Values can be a boolean, like 1 or false, or a sample rate.
+func BackendFromEnv(prefix string) Backend {
+	return envBackend{prefix}
+}
+
+// BackendFromFiles creates a backend that combines the flags from several
+// files, eg: owned by different teams. Each file is parsed according to its
+// extension: .json, .yaml, .yml, .toml, or otherwise CSV. If a flag is in more
+// than one file, the last one wins, and that's reported. A missing file has no
+// flags. The age of the flags is that of the most recently updated file.
+func BackendFromFiles(filenames ...string) Backend {
+	return filesBackend{filenames}
+}
+
+// FailoverBackend creates a backend that uses the primary backend, unless it has
+// been failing for longer than after. Then it uses the secondary backend, eg: a
+// local snapshot, until the primary recovers. Each refresh that uses the
+// secondary reports why, as does switching back.
+func FailoverBackend(primary, secondary Backend, after time.Duration) Backend {
+	return &failoverBackend{primary: primary, secondary: secondary, after: after, now: time.Now}
+}
+
+// ChainBackends creates a backend that combines the flags from several
+// backends. If a flag is in more than one backend, the first one wins. The
+// age of the flags is that of the most recently updated backend. If some
+// backends fail, the flags from the others are still used.
+func ChainBackends(backends ...Backend) Backend {
+	return chainBackend{backends}
+}
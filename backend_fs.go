@@ -0,0 +1,41 @@
+//go:build go1.16
+// +build go1.16
+
+package goforit
+
+import (
+	"io/fs"
+	"time"
+)
+
+type fsBackend struct {
+	fsys fs.FS
+	path string
+}
+
+// BackendFromFS creates a backend that reads flags from a file in an fs.FS,
+// eg: defaults embedded in the binary with embed.FS. The file is parsed
+// according to its extension, like BackendFromFiles. The age of the flags
+// comes from the file if it has one, but embedded files don't, so they have
+// no age.
+func BackendFromFS(fsys fs.FS, path string) Backend {
+	return fsBackend{fsys, path}
+}
+
+func (b fsBackend) Refresh() ([]Flag, time.Time, error) {
+	f, err := b.fsys.Open(b.path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	flags, updated, err := parserForFile(b.path)(f)
+	if _, ok := err.(RefreshErrors); err != nil && !ok {
+		return nil, time.Time{}, err
+	}
+	if updated.IsZero() || updated.Unix() == 0 {
+		if info, serr := f.Stat(); serr == nil {
+			updated = info.ModTime()
+		}
+	}
+	return flags, updated, err
+}
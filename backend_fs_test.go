@@ -0,0 +1,47 @@
+//go:build go1.16
+// +build go1.16
+
+package goforit
+
+import (
+	"os"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendFromFS(t *testing.T) {
+	t.Parallel()
+
+	modified := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	fsys := fstest.MapFS{
+		"flags.csv":  {Data: []byte("go.sun.money,0\ngo.moon.mercury,1\n"), ModTime: modified},
+		"flags.json": {Data: []byte(`{"updated": 1519247256, "flags": [{"name": "go.sun.money", "active": true}]}`)},
+		"bad.csv":    {Data: []byte("go.sun.money\n")},
+	}
+
+	flags, updated, err := BackendFromFS(fsys, "flags.csv").Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, []Flag{
+		{Name: "go.sun.money", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0}, RuleOn, RuleOff}}},
+		{Name: "go.moon.mercury", Active: true},
+	}, flags)
+	assert.True(t, modified.Equal(updated))
+
+	flags, updated, err = BackendFromFS(fsys, "flags.json").Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, []Flag{{Name: "go.sun.money", Active: true}}, flags)
+	assert.Equal(t, int64(1519247256), updated.Unix())
+
+	_, _, err = BackendFromFS(fsys, "bad.csv").Refresh()
+	assert.Error(t, err)
+	_, _, err = BackendFromFS(fsys, "missing.csv").Refresh()
+	assert.True(t, os.IsNotExist(err))
+
+	// The same fixtures as the file backends work
+	flags, _, err = BackendFromFS(os.DirFS("fixtures"), "flags_example.csv").Refresh()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, flags)
+}
@@ -1,11 +1,21 @@
 package goforit
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/goforit/goforittest"
 )
 
 func TestParseFlagsCSV(t *testing.T) {
@@ -25,22 +35,18 @@ func TestParseFlagsCSV(t *testing.T) {
 			Filename: filepath.Join("fixtures", "flags_example.csv"),
 			Expected: []Flag{
 				{
-					"go.sun.money",
-					true,
-					[]RuleInfo{{&RateRule{Rate: 0}, RuleOn, RuleOff}},
-					nil,
+					Name:   "go.sun.money",
+					Active: true,
+					Rules:  []RuleInfo{{&RateRule{Rate: 0}, RuleOn, RuleOff}},
 				},
 				{
-					"go.moon.mercury",
-					true,
-					nil,
-					nil,
+					Name:   "go.moon.mercury",
+					Active: true,
 				},
 				{
-					"go.stars.money",
-					true,
-					[]RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}},
-					nil,
+					Name:   "go.stars.money",
+					Active: true,
+					Rules:  []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}},
 				},
 			},
 		},
@@ -59,6 +65,40 @@ func TestParseFlagsCSV(t *testing.T) {
 	}
 }
 
+func TestParseFlagsCSVErrors(t *testing.T) {
+	t.Parallel()
+
+	// A bad rate is reported, but the flag is still off
+	flags, _, err := parseFlagsCSV(strings.NewReader("go.sun.money,0.5\ngo.moon.mercury,lots\n"))
+	assert.Len(t, flags, 2)
+	assert.Equal(t, []RuleInfo{{&RateRule{Rate: 0}, RuleOn, RuleOff}}, flags[1].Rules)
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	perr, ok := errs[0].(ErrParseFlag)
+	assert.True(t, ok)
+	assert.Equal(t, "go.moon.mercury", perr.Flag)
+	assert.Equal(t, 2, perr.Line)
+	assert.Equal(t, "lots", perr.Value)
+	assert.Contains(t, perr.Error(), "go.moon.mercury on line 2")
+
+	// Extra columns are metadata
+	flags, _, err = parseFlagsCSV(strings.NewReader("go.sun.money,1,owner=payments,description=Money from the sun\ngo.moon.mercury,0,junk\n"))
+	assert.Equal(t, map[string]string{"owner": "payments", "description": "Money from the sun"}, flags[0].Metadata)
+	assert.Nil(t, flags[1].Metadata)
+	errs, ok = err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "junk", errs[0].(ErrParseFlag).Value)
+
+	// A malformed file is an error for all the flags
+	flags, _, err = parseFlagsCSV(strings.NewReader("go.sun.money,0.5\ngo.moon.mercury\n"))
+	assert.Nil(t, flags)
+	perr, ok = err.(ErrParseFlag)
+	assert.True(t, ok)
+	assert.Equal(t, 2, perr.Line)
+}
+
 func TestParseFlagsJSON(t *testing.T) {
 	t.Parallel()
 
@@ -76,22 +116,20 @@ func TestParseFlagsJSON(t *testing.T) {
 			Filename: filepath.Join("fixtures", "flags_example.json"),
 			Expected: []Flag{
 				{
-					"go.sun.moon",
-					true,
-					[]RuleInfo{
+					Name:   "go.sun.moon",
+					Active: true,
+					Rules: []RuleInfo{
 						{&MatchListRule{"host_name", []string{"apibox_123", "apibox_456"}}, RuleOff, RuleContinue},
 						{&MatchListRule{"host_name", []string{"apibox_789"}}, RuleOn, RuleContinue},
 						{&RateRule{0.01, []string{"cluster", "db"}}, RuleOn, RuleOff},
 					},
-					nil,
 				},
 				{
-					"go.sun.mercury",
-					true,
-					[]RuleInfo{
+					Name:   "go.sun.mercury",
+					Active: true,
+					Rules: []RuleInfo{
 						{&RateRule{Rate: 0.5}, RuleOn, RuleOff},
 					},
-					nil,
 				},
 			},
 		},
@@ -110,6 +148,22 @@ func TestParseFlagsJSON(t *testing.T) {
 	}
 }
 
+func TestParseVariantsJSON(t *testing.T) {
+	t.Parallel()
+
+	flags, _, err := parseFlagsJSON(strings.NewReader(`{"flags": [
+		{"name": "go.colors", "active": true, "variant_properties": ["user"],
+		 "variants": [{"name": "control", "weight": 2}, {"name": "red", "weight": 1}]}
+	]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []Flag{{
+		Name:              "go.colors",
+		Active:            true,
+		Variants:          []VariantInfo{{"control", 2}, {"red", 1}},
+		VariantProperties: []string{"user"},
+	}}, flags)
+}
+
 func TestMultipleDefinitions(t *testing.T) {
 	t.Parallel()
 
@@ -120,10 +174,545 @@ func TestMultipleDefinitions(t *testing.T) {
 	g, _ := testGoforit(0, backend, enabledTickerInterval)
 	g.RefreshFlags(backend)
 
+	flags, _, err := backend.Refresh()
+	assert.Len(t, flags, 2)
+	assert.Equal(t, RefreshErrors{ErrDuplicateFlag{Flag: repeatedFlag, PreviousLine: 1, Line: 3,
+		PreviousValue: ".5", Value: ".7"}}, err)
+
 	f, ok := g.flags.Load(repeatedFlag)
 	assert.True(t, ok)
 	flag := f.(Flag)
 	flag.enabledTicker = nil // we don't compare about comparing this
-	assert.Equal(t, flag, Flag{repeatedFlag, true, []RuleInfo{{&RateRule{Rate: lastValue}, RuleOn, RuleOff}}, nil})
+	assert.Equal(t, flag, Flag{Name: repeatedFlag, Active: true, Rules: []RuleInfo{{&RateRule{Rate: lastValue}, RuleOn, RuleOff}}})
+
+}
+
+func TestParseTimeWindowRuleJSON(t *testing.T) {
+	t.Parallel()
+
+	var ri RuleInfo
+	err := json.Unmarshal([]byte(`{
+		"type": "time_window",
+		"start": "2018-03-01T00:00:00Z",
+		"end": "2018-04-01T00:00:00-07:00",
+		"on_match": "on",
+		"on_miss": "off"
+	}`), &ri)
+	assert.NoError(t, err)
+	r, ok := ri.Rule.(*TimeWindowRule)
+	assert.True(t, ok)
+	assert.True(t, r.Start.Equal(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)))
+	assert.True(t, r.End.Equal(time.Date(2018, 4, 1, 7, 0, 0, 0, time.UTC)))
+
+	err = json.Unmarshal([]byte(`{"type": "time_window", "on_match": "on", "on_miss": "off"}`), &ri)
+	assert.NoError(t, err)
+	assert.Equal(t, &TimeWindowRule{}, ri.Rule)
+}
+
+func TestParseOnMissingTagJSON(t *testing.T) {
+	t.Parallel()
+
+	flags, _, err := parseFlagsJSON(strings.NewReader(`{"flags": [
+		{"name": "go.default", "active": true, "rate": 0.5},
+		{"name": "go.random", "active": true, "rate": 0.5, "on_missing_tag": "random"},
+		{"name": "go.bad", "active": true, "rate": 0.5, "on_missing_tag": "maybe"}
+	]}`))
+	assert.Len(t, flags, 2)
+	assert.Equal(t, MissError, flags[0].OnMissingTag)
+	assert.Equal(t, MissRandom, flags[1].OnMissingTag)
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "on_missing_tag")
+
+	buf, err := json.Marshal(flags[1])
+	assert.NoError(t, err)
+	assert.Contains(t, string(buf), `"on_missing_tag":"random"`)
+	buf, err = json.Marshal(flags[0])
+	assert.NoError(t, err)
+	assert.NotContains(t, string(buf), "on_missing_tag")
+}
+
+func TestParseScheduleRuleJSON(t *testing.T) {
+	t.Parallel()
+
+	var ri RuleInfo
+	err := json.Unmarshal([]byte(`{
+		"type": "schedule",
+		"cron": "0 9 * * 1-5",
+		"duration": "8h",
+		"location": "UTC",
+		"on_match": "on",
+		"on_miss": "off"
+	}`), &ri)
+	assert.NoError(t, err)
+	r, ok := ri.Rule.(*ScheduleRule)
+	assert.True(t, ok)
+	assert.Equal(t, "0 9 * * 1-5", r.Cron)
+	assert.Equal(t, 8*time.Hour, r.Duration)
+	assert.Equal(t, time.UTC, r.Location)
+
+	buf, err := json.Marshal(ri)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"type": "schedule", "cron": "0 9 * * 1-5", "duration": "8h0m0s", "location": "UTC", "on_match": "on", "on_miss": "off"}`, string(buf))
+
+	// Bad schedules are errors parsing the flag
+	flags, _, err := parseFlagsJSON(strings.NewReader(`{"flags": [
+		{"name": "go.bad_cron", "active": true, "rules": [{"type": "schedule", "cron": "0 25 * * *", "duration": "1h", "on_match": "on", "on_miss": "off"}]},
+		{"name": "go.bad_duration", "active": true, "rules": [{"type": "schedule", "cron": "0 9 * * *", "duration": "0s", "on_match": "on", "on_miss": "off"}]}
+	]}`))
+	assert.Empty(t, flags)
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "go.bad_cron")
+	assert.Contains(t, errs[0].Error(), `"25" is out of range 0-23`)
+	assert.Contains(t, errs[1].Error(), "go.bad_duration")
+}
+
+func TestParseFlagsJSONBadRule(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(filepath.Join("fixtures", "flags_bad_rule.json"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	flags, _, err := parseFlagsJSON(f)
+
+	// The bad flag is reported, but doesn't prevent the others from loading
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "go.sun.mercury")
+
+	assert.Len(t, flags, 2)
+	assert.Equal(t, "go.sun.moon", flags[0].Name)
+	assert.Equal(t, "go.sun.venus", flags[1].Name)
+}
+
+func TestRefreshFlagsBadRule(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromJSONFile(filepath.Join("fixtures", "flags_bad_rule.json"))
+	g, buf := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+
+	_, ok := g.flags.Load("go.sun.moon")
+	assert.True(t, ok)
+	_, ok = g.flags.Load("go.sun.venus")
+	assert.True(t, ok)
+	_, ok = g.flags.Load("go.sun.mercury")
+	assert.False(t, ok)
+
+	assert.Contains(t, buf.String(), "go.sun.mercury")
+}
+
+func TestParseFlagsYAML(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(filepath.Join("fixtures", "flags_example.yaml"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	flags, updated, err := parseFlagsYAML(f)
+
+	// Malformed flags are reported, but don't prevent the others from loading
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, "go.bad.rate", errs[0].(ErrParseFlag).Flag)
+	assert.Contains(t, errs[1].Error(), "missing name")
+	assert.IsType(t, ErrParseFlag{}, errs[1])
+
+	assert.Equal(t, []Flag{
+		{Name: "go.sun.money", Active: false},
+		{Name: "go.moon.mercury", Active: true},
+		{Name: "go.stars.money", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}}},
+	}, flags)
+	assert.Equal(t, time.Unix(1519247256, 0), updated)
+}
+
+func TestParseFlagsTOML(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(filepath.Join("fixtures", "flags_example.toml"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	flags, updated, err := parseFlagsTOML(f)
+
+	// Malformed flags are reported, but don't prevent the others from loading
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "go.bad.rate")
+	assert.Contains(t, errs[1].Error(), "missing name")
+
+	assert.Equal(t, []Flag{
+		{Name: "go.sun.money", Active: false},
+		{Name: "go.moon.mercury", Active: true},
+		{Name: "go.stars.money", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}}},
+		{Name: "go.sun.mercury", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 1}, RuleOn, RuleOff}}},
+	}, flags)
+	assert.Equal(t, time.Unix(1519247256, 0), updated)
+}
+
+func TestBackendFromFiles(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goforit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	first := filepath.Join(dir, "first.csv")
+	second := filepath.Join(dir, "second.yaml")
+	assert.NoError(t, ioutil.WriteFile(first, []byte("go.sun.money,0\ngo.moon.mercury,1\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(second, []byte("flags:\n  - name: go.sun.money\n    active: true\n  - name: go.stars.money\n    active: true\n"), 0644))
+	modTime := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(first, modTime, modTime))
+	assert.NoError(t, os.Chtimes(second, modTime.Add(-time.Hour), modTime.Add(-time.Hour)))
+
+	// Later files win, and the collision is reported
+	backend := BackendFromFiles(first, second, filepath.Join(dir, "missing.json"))
+	flags, updated, err := backend.Refresh()
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "Flag go.sun.money in "+second+" replaces the one in "+first)
+	assert.Equal(t, []Flag{
+		{Name: "go.sun.money", Active: true},
+		{Name: "go.moon.mercury", Active: true},
+		{Name: "go.stars.money", Active: true},
+	}, flags)
+	assert.Equal(t, modTime, updated.UTC())
+
+	// Removing a file removes only its flags
+	assert.NoError(t, os.Remove(second))
+	flags, _, err = backend.Refresh()
+	assert.NoError(t, err)
+	assert.Len(t, flags, 2)
+	assert.Equal(t, "go.sun.money", flags[0].Name)
+	assert.Equal(t, []RuleInfo{{&RateRule{Rate: 0}, RuleOn, RuleOff}}, flags[0].Rules)
+
+	// A file that can't be parsed is an error
+	assert.NoError(t, ioutil.WriteFile(second, []byte("flags: ["), 0644))
+	_, _, err = backend.Refresh()
+	_, ok = err.(RefreshErrors)
+	assert.Error(t, err)
+	assert.False(t, ok)
+}
+
+// switchBackend fails while down is set
+type switchBackend struct {
+	down bool
+}
+
+func (b *switchBackend) Refresh() ([]Flag, time.Time, error) {
+	if b.down {
+		return nil, time.Time{}, errors.New("backend is down")
+	}
+	return []Flag{{Name: "go.primary", Active: true}}, time.Unix(1519247256, 0), nil
+}
+
+func TestFailoverBackend(t *testing.T) {
+	t.Parallel()
+
+	clock := goforittest.NewManualClock(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC))
+	primary := &switchBackend{}
+	secondary := &dummyFlagsBackend{[]Flag{{Name: "go.secondary", Active: true}}}
+	backend := FailoverBackend(primary, secondary, time.Minute)
+	backend.(*failoverBackend).now = clock.Now
+
+	flags, updated, err := backend.Refresh()
+	assert.NoError(t, err)
+	assert.Equal(t, "go.primary", flags[0].Name)
+	assert.Equal(t, time.Unix(1519247256, 0), updated)
+
+	// Briefly failing just returns the error
+	primary.down = true
+	_, _, err = backend.Refresh()
+	assert.EqualError(t, err, "backend is down")
+	clock.Advance(30 * time.Second)
+	_, _, err = backend.Refresh()
+	assert.EqualError(t, err, "backend is down")
+
+	// Then it fails over
+	clock.Advance(time.Minute)
+	flags, updated, err = backend.Refresh()
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "Primary backend failing for 1m30s, using the secondary: backend is down")
+	assert.Equal(t, "go.secondary", flags[0].Name)
+	assert.True(t, updated.IsZero())
+
+	// And back
+	primary.down = false
+	flags, _, err = backend.Refresh()
+	assert.EqualError(t, err, "Primary backend recovered, no longer using the secondary")
+	assert.Equal(t, "go.primary", flags[0].Name)
+	_, _, err = backend.Refresh()
+	assert.NoError(t, err)
+
+	// A new failure starts over
+	primary.down = true
+	_, _, err = backend.Refresh()
+	assert.EqualError(t, err, "backend is down")
+}
+
+type dummyErrorBackend struct{}
+
+func (b dummyErrorBackend) Refresh() ([]Flag, time.Time, error) {
+	return nil, time.Time{}, errors.New("backend is down")
+}
+
+func TestChainBackends(t *testing.T) {
+	t.Parallel()
+
+	newer := time.Unix(1519247256, 0)
+	older := newer.Add(-time.Hour)
+	first := &dummyAgeBackend{t: older}
+	second := BackendFromJSONFile(filepath.Join("fixtures", "flags_example.json"))
+
+	backend := ChainBackends(first, dummyErrorBackend{}, second, BackendFromFile(filepath.Join("fixtures", "flags_example.csv")))
+	flags, updated, err := backend.Refresh()
+
+	// Errors are reported, but don't stop the chain
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "backend is down")
+
+	// The first backend wins, and the newest age is used
+	names := []string{}
+	for _, flag := range flags {
+		names = append(names, flag.Name)
+	}
+	assert.Equal(t, []string{"go.sun.money", "go.sun.moon", "go.sun.mercury", "go.moon.mercury", "go.stars.money"}, names)
+	assert.Empty(t, flags[0].Rules)
+	assert.Equal(t, newer, updated)
+
+	// If everything fails, it's a real error
+	_, _, err = ChainBackends(dummyErrorBackend{}, dummyErrorBackend{}).Refresh()
+	assert.Error(t, err)
+	_, ok = err.(RefreshErrors)
+	assert.False(t, ok)
+}
+
+func TestParseRampRuleJSON(t *testing.T) {
+	t.Parallel()
+
+	var ri RuleInfo
+	err := json.Unmarshal([]byte(`{"type": "ramp", "start": "2018-03-01T00:00:00Z", "end": "2018-04-01T00:00:00Z", "properties": ["user"], "on_match": "on", "on_miss": "off"}`), &ri)
+	assert.NoError(t, err)
+	assert.Equal(t, &RampRule{
+		Start:      time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC),
+		End:        time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC),
+		Properties: []string{"user"},
+	}, ri.Rule)
+}
+
+func TestFlagJSONRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	flags := []Flag{
+		{Name: "go.simple", Active: true},
+		{Name: "go.timeout", Active: true, Value: "30"},
+		{Name: "go.rules", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleContinue},
+			{&RateRule{Rate: 0.5, Properties: []string{"user"}}, RuleContinue, RuleOff},
+			{&TimeWindowRule{start, start.AddDate(0, 1, 0)}, RuleContinue, RuleOff},
+			{&RampRule{start, start.AddDate(0, 1, 0), []string{"user"}}, RuleContinue, RuleOff},
+			{&BucketRule{Rate: 0.1, Buckets: 100, Properties: []string{"user"}}, RuleContinue, RuleOff},
+			{&PrerequisiteRule{[]string{"go.simple"}}, RuleOn, RuleOff},
+		}},
+		{Name: "go.variants", Active: true, Variants: []VariantInfo{{"control", 1}, {"treatment", 1}},
+			VariantProperties: []string{"user"}, Metadata: map[string]string{"owner": "payments"}},
+	}
+	buf, err := json.Marshal(flags)
+	assert.NoError(t, err)
+	var parsed []Flag
+	assert.NoError(t, json.Unmarshal(buf, &parsed))
+	assert.Equal(t, flags, parsed)
+
+	// Custom rules can't be written
+	_, err = json.Marshal(Flag{Name: "go.custom", Active: true, Rules: []RuleInfo{{&OnRule{}, RuleOn, RuleOff}}})
+	assert.Error(t, err)
+}
+
+func TestParseFlagsEnv(t *testing.T) {
+	t.Parallel()
+
+	flags, updated, err := parseFlagsEnv("GOFORIT_", []string{
+		"HOME=/root",
+		"GOFORIT_GO_SUN_MONEY=0",
+		"GOFORIT_GO_MOON_MERCURY=true",
+		"GOFORIT_GO_STARS__MONEY=0.5",
+		"GOFORIT_GO_BAD=maybe",
+		"GOFORIT_=1",
+	})
+
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 1)
+	perr, ok := errs[0].(ErrParseFlag)
+	assert.True(t, ok)
+	assert.Equal(t, "go.bad", perr.Flag)
+	assert.Equal(t, "maybe", perr.Value)
+	assert.True(t, updated.IsZero())
+	assert.Equal(t, []Flag{
+		{Name: "go.sun.money", Active: false},
+		{Name: "go.moon.mercury", Active: true},
+		{Name: "go.stars_money", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}}},
+	}, flags)
+}
+
+func TestEnvBackend(t *testing.T) {
+	t.Parallel()
+
+	os.Setenv("GOFORIT_TEST_ENV_BACKEND_ON", "1")
+	defer os.Unsetenv("GOFORIT_TEST_ENV_BACKEND_ON")
+	g, _ := testGoforit(0, BackendFromEnv("GOFORIT_TEST_ENV_"), enabledTickerInterval)
+	defer g.Close()
+
+	assert.True(t, g.Enabled(nil, "backend.on", nil))
+	assert.Equal(t, []string{"backend.on"}, g.Flags(nil))
+}
+
+func TestHTTPBackend(t *testing.T) {
+	t.Parallel()
+
+	buf, err := ioutil.ReadFile(filepath.Join("fixtures", "flags_example.json"))
+	assert.NoError(t, err)
+	lastModified := time.Date(2018, 2, 21, 21, 7, 36, 0, time.UTC)
+
+	var mtx sync.Mutex
+	status := http.StatusOK
+	requests := 0
+	notModified := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		requests++
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		if r.Header.Get("If-Modified-Since") == lastModified.Format(http.TimeFormat) {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write(buf)
+	}))
+	defer srv.Close()
+
+	backend := BackendFromHTTP(srv.URL)
+	flags, updated, err := backend.Refresh()
+	assert.NoError(t, err)
+	assert.Len(t, flags, 2)
+	assert.Equal(t, lastModified, updated.UTC())
+
+	// Unchanged flags aren't fetched again
+	flags, updated, err = backend.Refresh()
+	assert.NoError(t, err)
+	assert.Len(t, flags, 2)
+	assert.Equal(t, lastModified, updated.UTC())
+	mtx.Lock()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, 1, notModified)
+	mtx.Unlock()
+
+	// Errors keep the last good flags
+	g, logs := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	mtx.Lock()
+	status = http.StatusServiceUnavailable
+	mtx.Unlock()
+	g.RefreshFlags(backend)
+	assert.Contains(t, logs.String(), "503")
+	_, ok := g.flags.Load("go.sun.mercury")
+	assert.True(t, ok)
+}
+
+func TestHTTPBackendTimeout(t *testing.T) {
+	t.Parallel()
+
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Hang until the client gives up
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer srv.Close()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{{Name: "go.old", Active: true}}}, enabledTickerInterval)
+	defer g.Close()
+	g.SetRefreshTimeout(10 * time.Millisecond)
+	err := g.refreshFlags(BackendFromHTTP(srv.URL))
+	assert.Equal(t, ErrRefreshTimeout{10 * time.Millisecond}, err)
+	assert.True(t, g.Enabled(nil, "go.old", nil))
+
+	// The request itself was cancelled
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't cancelled")
+	}
+}
+
+func TestWrappedBackendTimeout(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	hung := BackendFromHTTPClient(srv.URL, &http.Client{})
+	empty := &dummyFlagsBackend{}
+
+	// Wrapping a ContextBackend still lets its refresh be cancelled
+	for _, backend := range []Backend{
+		ChainBackends(empty, hung),
+		FailoverBackend(hung, empty, time.Hour),
+	} {
+		_, ok := backend.(ContextBackend)
+		assert.True(t, ok)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		done := make(chan struct{})
+		go func() {
+			refreshContext(ctx, backend)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%T refresh wasn't cancelled", backend)
+		}
+		cancel()
+	}
+}
+
+func TestHTTPBackendClient(t *testing.T) {
+	t.Parallel()
+
+	// The default client doesn't wait forever
+	backend := BackendFromHTTP("http://example.com").(*httpBackend)
+	assert.Equal(t, httpTimeout, backend.client.Timeout)
+
+	released := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-released:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(released)
 
+	// A custom client's timeout applies, even without a refresh timeout
+	client := &http.Client{Timeout: 10 * time.Millisecond}
+	_, _, err := BackendFromHTTPClient(srv.URL, client).Refresh()
+	assert.Error(t, err)
 }
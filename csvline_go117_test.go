@@ -0,0 +1,29 @@
+//go:build go1.17
+// +build go1.17
+
+package goforit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFlagsCSVBlankLines(t *testing.T) {
+	t.Parallel()
+
+	f, err := os.Open(filepath.Join("fixtures", "flags_blank_line.csv"))
+	assert.NoError(t, err)
+	defer f.Close()
+
+	// Errors have the line in the file, not the number of the row
+	flags, _, err := parseFlagsCSV(f)
+	assert.Len(t, flags, 2)
+	errs, ok := err.(RefreshErrors)
+	assert.True(t, ok)
+	assert.Len(t, errs, 2)
+	assert.Equal(t, ErrParseFlag{Flag: "go.moon.mercury", Line: 3, Value: "lots", Err: errs[0].(ErrParseFlag).Err}, errs[0])
+	assert.Equal(t, ErrDuplicateFlag{Flag: "go.sun.money", PreviousLine: 1, Line: 5, PreviousValue: "0.5", Value: "0.7"}, errs[1])
+}
@@ -0,0 +1,13 @@
+//go:build !go1.17
+// +build !go1.17
+
+package goforit
+
+import "encoding/csv"
+
+// csvLine returns the line where the record just read from a CSV file starts.
+// The record is the number of the record, from 1. Before Go 1.17 the reader
+// can't tell us, so assume there are no blank lines.
+func csvLine(cr *csv.Reader, record int) int {
+	return record
+}
@@ -0,0 +1,26 @@
+//go:build go1.13
+// +build go1.13
+
+package goforit
+
+import "errors"
+
+// Is reports whether any of the errors matches target, for errors.Is
+func (e RefreshErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors that matches target, for errors.As
+func (e RefreshErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
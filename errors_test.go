@@ -0,0 +1,132 @@
+//go:build go1.13
+// +build go1.13
+
+package goforit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorsIs(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		err     error
+		matches []error
+		misses  []error
+	}{
+		{
+			ErrUnknownFlag{"go.a"},
+			[]error{ErrUnknownFlag{}, ErrUnknownFlag{"go.a"}},
+			[]error{ErrUnknownFlag{"go.b"}, ErrDataStale{}},
+		},
+		{
+			ErrParseFlag{Flag: "go.a", Line: 3, Value: "x", Err: io.EOF},
+			[]error{ErrParseFlag{}, ErrParseFlag{Flag: "go.a"}, ErrParseFlag{Line: 3}, io.EOF},
+			[]error{ErrParseFlag{Flag: "go.b"}, ErrParseFlag{Line: 4}, io.ErrUnexpectedEOF},
+		},
+		{
+			ErrDuplicateFlag{Flag: "go.a", PreviousLine: 1, Line: 2},
+			[]error{ErrDuplicateFlag{}, ErrDuplicateFlag{Flag: "go.a"}},
+			[]error{ErrDuplicateFlag{Flag: "go.b"}, ErrParseFlag{}},
+		},
+		{
+			ErrTagCardinality{Flag: "go.a", Count: 20, Max: 10},
+			[]error{ErrTagCardinality{}, ErrTagCardinality{Flag: "go.a"}},
+			[]error{ErrTagCardinality{Flag: "go.b"}},
+		},
+		{
+			ErrMissingTag{Flag: "go.a", Tag: "user"},
+			[]error{ErrMissingTag{}, ErrMissingTag{Flag: "go.a"}, ErrMissingTag{Tag: "user"}, ErrMissingTag{"go.a", "user"}},
+			[]error{ErrMissingTag{Tag: "host"}, ErrLockedTag{"go.a", "user"}},
+		},
+		{
+			ErrLockedTag{Flag: "go.a", Tag: "user"},
+			[]error{ErrLockedTag{}, ErrLockedTag{Flag: "go.a"}, ErrLockedTag{Tag: "user"}},
+			[]error{ErrLockedTag{Flag: "go.b"}, ErrMissingTag{}},
+		},
+		{
+			ErrClosed{"go.a"},
+			[]error{ErrClosed{}, ErrClosed{"go.a"}},
+			[]error{ErrClosed{"go.b"}, ErrUnknownFlag{"go.a"}},
+		},
+		{
+			ErrRefreshTimeout{time.Second},
+			[]error{ErrRefreshTimeout{}, ErrRefreshTimeout{time.Second}},
+			[]error{ErrRefreshTimeout{time.Minute}},
+		},
+		{
+			ErrDataStale{Flag: "go.a", Staleness: time.Hour, Threshold: time.Minute},
+			[]error{ErrDataStale{}, ErrDataStale{Flag: "go.a"}},
+			[]error{ErrDataStale{Flag: "go.b"}, ErrUnknownFlag{}},
+		},
+	}
+	for _, test := range tests {
+		wrapped := fmt.Errorf("wrapped: %w", test.err)
+		for _, target := range test.matches {
+			assert.True(t, errors.Is(test.err, target), "%#v should match %#v", test.err, target)
+			assert.True(t, errors.Is(wrapped, target), "wrapped %#v should match %#v", test.err, target)
+		}
+		for _, target := range test.misses {
+			assert.False(t, errors.Is(test.err, target), "%#v shouldn't match %#v", test.err, target)
+		}
+	}
+}
+
+func TestErrorsAs(t *testing.T) {
+	t.Parallel()
+
+	var unknown ErrUnknownFlag
+	assert.True(t, errors.As(fmt.Errorf("wrapped: %w", ErrUnknownFlag{"go.a"}), &unknown))
+	assert.Equal(t, "go.a", unknown.Flag)
+
+	var stale ErrDataStale
+	assert.True(t, errors.As(ErrDataStale{Flag: "go.a", Staleness: time.Hour}, &stale))
+	assert.Equal(t, time.Hour, stale.Staleness)
+	assert.False(t, errors.As(ErrUnknownFlag{"go.a"}, &stale))
+
+	// A parse error's cause can be found too
+	var pathErr *testPathError
+	parseErr := ErrParseFlag{Flag: "go.a", Err: &testPathError{"flags.csv"}}
+	assert.True(t, errors.As(parseErr, &pathErr))
+	assert.Equal(t, "flags.csv", pathErr.path)
+	var parsed ErrParseFlag
+	assert.True(t, errors.As(parseErr, &parsed))
+	assert.Equal(t, "go.a", parsed.Flag)
+}
+
+type testPathError struct {
+	path string
+}
+
+func (e *testPathError) Error() string {
+	return "bad file " + e.path
+}
+
+func TestRefreshErrorsUnwrap(t *testing.T) {
+	t.Parallel()
+
+	errs := RefreshErrors{ErrParseFlag{Flag: "go.a", Err: io.EOF}, ErrDuplicateFlag{Flag: "go.b"}}
+	unwrapped := errs.Unwrap()
+	assert.Len(t, unwrapped, 2)
+	assert.True(t, errors.Is(unwrapped[0], ErrParseFlag{Flag: "go.a"}))
+	assert.True(t, errors.Is(unwrapped[1], ErrDuplicateFlag{Flag: "go.b"}))
+
+	// errors.Is and errors.As look at each of them
+	assert.True(t, errors.Is(errs, ErrParseFlag{}))
+	assert.True(t, errors.Is(errs, ErrDuplicateFlag{Flag: "go.b"}))
+	assert.True(t, errors.Is(errs, io.EOF))
+	assert.False(t, errors.Is(errs, ErrDuplicateFlag{Flag: "go.c"}))
+	assert.True(t, errors.Is(fmt.Errorf("refreshing: %w", errs), ErrParseFlag{Flag: "go.a"}))
+	var dup ErrDuplicateFlag
+	assert.True(t, errors.As(errs, &dup))
+	assert.Equal(t, "go.b", dup.Flag)
+	var stale ErrDataStale
+	assert.False(t, errors.As(errs, &stale))
+}
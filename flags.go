@@ -3,14 +3,17 @@ package goforit
 import (
 	"bytes"
 	"context"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"math"
 	"math/rand"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,8 +27,9 @@ const lastAssertInterval = 5 * time.Minute
 
 const enabledTickerInterval = 10 * time.Second
 
-// An interface reflecting the parts of statsd that we need, so we can mock it
-type statsdClient interface {
+// A StatsdClient is the part of a statsd client that goforit uses to report
+// metrics, eg: a *statsd.Client, or a mock in tests
+type StatsdClient interface {
 	Histogram(string, float64, []string, float64) error
 	Gauge(string, float64, []string, float64) error
 	Count(string, int64, []string, float64) error
@@ -33,10 +37,49 @@ type statsdClient interface {
 }
 
 type goforit struct {
-	ticker *time.Ticker
+	ticker  *time.Ticker
+	backend Backend
+	// Whether Snapshot made this. A snapshot has no backend, and is never
+	// refreshed.
+	snapshot bool
+	// Closed to stop refreshing
+	done chan struct{}
 
-	stalenessMtx       sync.RWMutex
-	stalenessThreshold time.Duration
+	// Close is only done once. Non-zero once closed.
+	closeMtx sync.Mutex
+	closed   int32
+	// How much to randomly vary the refresh interval, as a fraction of it
+	refreshJitter float64
+	// The shortest refresh interval to allow
+	minRefreshInterval time.Duration
+	// How long a refresh can take before we give up on it
+	refreshTimeout time.Duration
+	// How to retry failed refreshes
+	refreshRetries   int
+	refreshRetryBase time.Duration
+	// Only one refresh at a time
+	refreshMtx sync.Mutex
+	// Non-zero if periodic refreshes are paused
+	refreshPaused int32
+
+	// Channels to notify about flag changes
+	watchersMtx    sync.Mutex
+	watchers       []chan FlagChange
+	watchersClosed bool
+
+	stalenessMtx sync.RWMutex
+	// How old the backend's flags and our last refresh can be
+	sourceStalenessThreshold  time.Duration
+	refreshStalenessThreshold time.Duration
+	// Staleness thresholds for particular flags
+	flagStaleness sync.Map
+	// What to do with stale flags, and overrides for particular flags
+	staleBehavior     int32
+	flagStaleBehavior sync.Map
+	// What to do with flags evaluated with errors, and overrides for
+	// particular flags
+	errorValuePolicy     int32
+	flagErrorValuePolicy sync.Map
 
 	flags sync.Map
 
@@ -47,9 +90,77 @@ type goforit struct {
 	// Unix time in nanos.
 	lastFlagRefreshTime int64
 
+	// The results of the last refresh
+	healthMtx      sync.Mutex
+	lastRefreshErr error
+	lastUpdated    time.Time
+
+	// Flag values to use until flags are first loaded
+	startupGraceEnd time.Time
+	startupDefaults map[string]bool
+	// Where to keep a copy of the flags, if anywhere
+	cacheFile string
+
 	defaultTags sync.Map
+	// Tags that can't be replaced by properties
+	lockedTags sync.Map
+	// Tags that should always be present when evaluating rules
+	requiredTags sync.Map
+	// Tags whose values shouldn't be shown by String
+	redactedTags sync.Map
+	// A TagNormalizer, applied to tags after merging
+	tagNormalizer atomic.Value
+	// A ContextTagger, to get tags from the context of each check
+	contextTagger atomic.Value
+	// Non-zero if the kill switch is on
+	killSwitch int32
+	// A flag that turns on the kill switch
+	killSwitchFlag atomic.Value
+	// A tagCardinalityGuard, applied to tags after merging
+	tagCardinalityGuard atomic.Value
+	// Other names for flags
+	aliases atomic.Value
+	// Non-zero if flag names are lowercased
+	caseInsensitive int32
+	// Flag names that collided when lowercased, which have been reported
+	caseCollisions sync.Map
+	// Overrides for every check, replaced on each change
+	globalOverrides     atomic.Value
+	globalOverrideFuncs atomic.Value
+	globalOverridesMtx  sync.Mutex
+	// Flags that roll back automatically, as *rollbackWindow
+	rollbacks sync.Map
+	// A RollbackCallback to call when a flag is rolled back
+	rollbackCallback atomic.Value
+	// The merged tags each flag's rules were last evaluated with
+	lastTags sync.Map
+	// How many recent results to keep for each flag, and the results
+	checkHistorySize int32
+	checkHistory     sync.Map
+	// Counts of checks of each flag, as *flagStats
+	checkStats sync.Map
 
-	stats statsdClient
+	stats StatsdClient
+	// The sample rate for per-check metrics, as bits for atomic access.
+	// Zero disables them.
+	checkMetricRate uint64
+	// A CheckCallback to call after each check
+	checkCallback atomic.Value
+	// The fraction of checks to pass to the CheckCallback, as a float64
+	checkCallbackRate atomic.Value
+	// Checks waiting for the CheckCallback, if it's called asynchronously
+	checkBuffer   atomic.Value
+	droppedChecks uint64
+	// A CheckReasonCallback to call after each check
+	checkReasonCallback atomic.Value
+	// A LatencyCallback to call after each check
+	latencyCallback atomic.Value
+	// An OverrideCallback to call when an override is used
+	overrideCallback atomic.Value
+	// An OverrideChangeCallback to call when a global override changes
+	overrideChangeCallback atomic.Value
+	// The HashFunc for sampling by properties, if not the default
+	hashFunc atomic.Value
 
 	// Last time we alerted that flags may be out of date
 	lastAssertMtx sync.Mutex
@@ -58,8 +169,47 @@ type goforit struct {
 	// rand is not concurrency safe, in general
 	rndMtx sync.Mutex
 	rnd    *rand.Rand
+	// Mixed into random numbers and hashes, so goforits can sample independently
+	salt string
 
 	logger *log.Logger
+
+	// Identical errors are only logged once per errorThrottle, if it's set
+	errorThrottleMtx sync.Mutex
+	errorThrottle    time.Duration
+	errorsLogged     map[string]time.Time
+	// An ErrorHandler to call with errors
+	errorHandler atomic.Value
+	// A function to call when checking an unknown flag
+	unknownFlagHandler atomic.Value
+
+	clock Clock
+}
+
+// A Clock tells goforit the current time. It can be replaced for testing.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// An afterClock is a Clock that can also wait, like time.After, eg: a
+// goforittest.ManualClock
+type afterClock interface {
+	Clock
+	After(d time.Duration) <-chan time.Time
+}
+
+// after waits for a duration, using our clock if it can wait
+func (g *goforit) after(d time.Duration) <-chan time.Time {
+	if c, ok := g.clock.(afterClock); ok {
+		return c.After(d)
+	}
+	return time.After(d)
 }
 
 const DefaultInterval = 30 * time.Second
@@ -67,11 +217,12 @@ const DefaultInterval = 30 * time.Second
 func newWithoutInit(enabledTickerInterval time.Duration) *goforit {
 	stats, _ := statsd.New(statsdAddress)
 	return &goforit{
-		stats: stats,
+		stats:                 stats,
 		enabledTickerInterval: enabledTickerInterval,
 		enabledTicker:         time.NewTicker(enabledTickerInterval),
 		rnd:                   rand.New(rand.NewSource(time.Now().UnixNano())),
 		logger:                log.New(os.Stderr, "[goforit] ", log.LstdFlags),
+		clock:                 realClock{},
 	}
 }
 
@@ -82,21 +233,268 @@ func New(interval time.Duration, backend Backend) *goforit {
 	return g
 }
 
+// SetRandSource sets where sample rules without properties get their
+// randomness. By default it's a math/rand source seeded with the current time,
+// which is fast but predictable. A cryptographically secure source is slower,
+// but makes it impossible to guess which checks will be sampled.
+// The source is only used by one goroutine at a time.
+func (g *goforit) SetRandSource(src rand.Source) {
+	g.rndMtx.Lock()
+	defer g.rndMtx.Unlock()
+	g.rnd = rand.New(src)
+}
+
+// SetSalt mixes a string into sampling, so that goforits with different salts
+// sample independently, even with the same rand source. Changing the salt
+// changes which users are sampled by properties, like SetHashFunc.
+func (g *goforit) SetSalt(salt string) {
+	g.rndMtx.Lock()
+	defer g.rndMtx.Unlock()
+	g.salt = salt
+}
+
+func (g *goforit) getSalt() string {
+	g.rndMtx.Lock()
+	defer g.rndMtx.Unlock()
+	return g.salt
+}
+
 func (g *goforit) rand() float64 {
 	g.rndMtx.Lock()
 	defer g.rndMtx.Unlock()
-	return g.rnd.Float64()
+	return saltedFloat64(g.rnd, g.salt)
+}
+
+// randFor gets where a check should get its randomness, either the source
+// from EnabledSeeded or our own
+func (g *goforit) randFor(ctx context.Context) func() float64 {
+	if ctx != nil {
+		if rnd, ok := ctx.Value(seededRandContextKey).(*rand.Rand); ok {
+			salt := g.getSalt()
+			return func() float64 {
+				return saltedFloat64(rnd, salt)
+			}
+		}
+	}
+	return g.rand
+}
+
+// saltedFloat64 gets a random number in [0, 1), mixed with a salt
+func saltedFloat64(rnd *rand.Rand, salt string) float64 {
+	if salt == "" {
+		return rnd.Float64()
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], rnd.Uint64())
+	x := sha1Hash(salt + "\000" + string(buf[:]))
+	// Use 53 bits, like rand.Float64
+	return float64(x>>11) / (1 << 53)
 }
 
 type Flag struct {
-	Name          string
-	Active        bool
-	Rules         []RuleInfo
+	Name   string
+	Active bool
+	Rules  []RuleInfo
+	// If there are variants, the rules decide whether to use the first one
+	// (the control) or to pick one by weight
+	Variants []VariantInfo
+	// The properties to hash when picking a variant. If there are none,
+	// variants are picked randomly.
+	VariantProperties []string
+	// Extra information about the flag, eg: its owner
+	Metadata map[string]string
+	// If set, this is a value flag: a config knob like a timeout, returned by
+	// Value when the flag is enabled
+	Value string
+	// What sampling rules do when a property they hash is missing
+	OnMissingTag  MissingTagPolicy
 	enabledTicker *time.Ticker
 }
 
+// A VariantInfo is one of several values a flag can have
+type VariantInfo struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+}
+
+// ErrUnknownFlag is returned when asking about a flag that doesn't exist
+type ErrUnknownFlag struct {
+	Flag string
+}
+
+func (e ErrUnknownFlag) Error() string {
+	return fmt.Sprintf("Unknown flag %s", e.Flag)
+}
+
+// Is matches an ErrUnknownFlag for the same flag, or for any flag if its Flag
+// is empty
+func (e ErrUnknownFlag) Is(target error) bool {
+	t, ok := target.(ErrUnknownFlag)
+	return ok && (t.Flag == "" || t.Flag == e.Flag)
+}
+
+// ErrParseFlag is returned by a backend when it can't understand a flag
+type ErrParseFlag struct {
+	// The flag's name, if known
+	Flag string
+	// The line where the flag is defined, or zero if not known
+	Line int
+	// The raw value that couldn't be parsed
+	Value string
+	Err   error
+}
+
+func (e ErrParseFlag) Error() string {
+	msg := "Error parsing flag"
+	if e.Flag != "" {
+		msg += " " + e.Flag
+	}
+	if e.Line > 0 {
+		msg += fmt.Sprintf(" on line %d", e.Line)
+	}
+	return fmt.Sprintf("%s: %s", msg, e.Err)
+}
+
+// Is matches an ErrParseFlag for the same flag and line. An empty Flag or zero
+// Line in the target matches any.
+func (e ErrParseFlag) Is(target error) bool {
+	t, ok := target.(ErrParseFlag)
+	return ok && (t.Flag == "" || t.Flag == e.Flag) && (t.Line == 0 || t.Line == e.Line)
+}
+
+func (e ErrParseFlag) Unwrap() error {
+	return e.Err
+}
+
+// ErrDuplicateFlag is returned by a backend when a flag is defined more than
+// once. The last definition wins.
+type ErrDuplicateFlag struct {
+	Flag string
+	// The lines of the earlier and later definitions
+	PreviousLine, Line int
+	// The raw values of the earlier and later definitions
+	PreviousValue, Value string
+}
+
+func (e ErrDuplicateFlag) Error() string {
+	return fmt.Sprintf("Flag %s defined on line %d as %q and again on line %d as %q, using the last",
+		e.Flag, e.PreviousLine, e.PreviousValue, e.Line, e.Value)
+}
+
+// Is matches an ErrDuplicateFlag for the same flag, or for any flag if its
+// Flag is empty
+func (e ErrDuplicateFlag) Is(target error) bool {
+	t, ok := target.(ErrDuplicateFlag)
+	return ok && (t.Flag == "" || t.Flag == e.Flag)
+}
+
+// ErrTagCardinality is logged when a flag is evaluated with more tags than
+// allowed by SetTagCardinalityGuard
+type ErrTagCardinality struct {
+	Flag  string
+	Count int
+	Max   int
+}
+
+func (e ErrTagCardinality) Error() string {
+	return fmt.Sprintf("Flag %s evaluated with %d tags, more than the maximum %d", e.Flag, e.Count, e.Max)
+}
+
+// Is matches an ErrTagCardinality for the same flag, or for any flag if its
+// Flag is empty
+func (e ErrTagCardinality) Is(target error) bool {
+	t, ok := target.(ErrTagCardinality)
+	return ok && (t.Flag == "" || t.Flag == e.Flag)
+}
+
+// ErrMissingTag is logged when a flag is evaluated without a required tag
+type ErrMissingTag struct {
+	Flag string
+	Tag  string
+}
+
+func (e ErrMissingTag) Error() string {
+	return fmt.Sprintf("Missing required tag %s for flag %s", e.Tag, e.Flag)
+}
+
+// Is matches an ErrMissingTag for the same flag and tag. An empty Flag or Tag
+// in the target matches any.
+func (e ErrMissingTag) Is(target error) bool {
+	t, ok := target.(ErrMissingTag)
+	return ok && (t.Flag == "" || t.Flag == e.Flag) && (t.Tag == "" || t.Tag == e.Tag)
+}
+
+// ErrClosed is returned when a flag is checked after Close
+type ErrClosed struct {
+	Flag string
+}
+
+func (e ErrClosed) Error() string {
+	return fmt.Sprintf("Checked flag %s after goforit was closed, using the default", e.Flag)
+}
+
+// Is matches an ErrClosed for the same flag, or for any flag if its Flag is
+// empty
+func (e ErrClosed) Is(target error) bool {
+	t, ok := target.(ErrClosed)
+	return ok && (t.Flag == "" || t.Flag == e.Flag)
+}
+
+// ErrRefreshTimeout is reported when the backend takes too long to refresh
+type ErrRefreshTimeout struct {
+	Timeout time.Duration
+}
+
+func (e ErrRefreshTimeout) Error() string {
+	return fmt.Sprintf("Backend didn't refresh within %s", e.Timeout)
+}
+
+// Is matches an ErrRefreshTimeout with the same timeout, or with any timeout
+// if its Timeout is zero
+func (e ErrRefreshTimeout) Is(target error) bool {
+	t, ok := target.(ErrRefreshTimeout)
+	return ok && (t.Timeout == 0 || t.Timeout == e.Timeout)
+}
+
+// ErrDataStale is returned when a flag is checked with StaleDefault, and the
+// flags haven't been refreshed within the staleness threshold
+type ErrDataStale struct {
+	Flag      string
+	Staleness time.Duration
+	Threshold time.Duration
+}
+
+func (e ErrDataStale) Error() string {
+	return fmt.Sprintf("Flags have not been refreshed in %s, past the threshold for %s (%s), using the default", e.Staleness, e.Flag, e.Threshold)
+}
+
+// Is matches an ErrDataStale for the same flag, or for any flag if its Flag is
+// empty
+func (e ErrDataStale) Is(target error) bool {
+	t, ok := target.(ErrDataStale)
+	return ok && (t.Flag == "" || t.Flag == e.Flag)
+}
+
+// ErrLockedTag is logged when a flag is evaluated with a property that would
+// replace a locked tag. The locked tag is used.
+type ErrLockedTag struct {
+	Flag string
+	Tag  string
+}
+
+func (e ErrLockedTag) Error() string {
+	return fmt.Sprintf("Property %s for flag %s can't replace a locked tag", e.Tag, e.Flag)
+}
+
+// Is matches an ErrLockedTag for the same flag and tag. An empty Flag or Tag
+// in the target matches any.
+func (e ErrLockedTag) Is(target error) bool {
+	t, ok := target.(ErrLockedTag)
+	return ok && (t.Flag == "" || t.Flag == e.Flag) && (t.Tag == "" || t.Tag == e.Tag)
+}
+
 func (f Flag) Equal(o Flag) bool {
-	if f.Name != o.Name || f.Active != o.Active || len(f.Rules) != len(o.Rules) {
+	if f.Name != o.Name || f.Active != o.Active || f.Value != o.Value || f.OnMissingTag != o.OnMissingTag || len(f.Rules) != len(o.Rules) {
 		return false
 	}
 	for i := 0; i < len(f.Rules); i++ {
@@ -104,72 +502,326 @@ func (f Flag) Equal(o Flag) bool {
 			return false
 		}
 	}
+	if len(f.Variants) != len(o.Variants) || len(f.VariantProperties) != len(o.VariantProperties) {
+		return false
+	}
+	for i := 0; i < len(f.Variants); i++ {
+		if f.Variants[i] != o.Variants[i] {
+			return false
+		}
+	}
+	for i := 0; i < len(f.VariantProperties); i++ {
+		if f.VariantProperties[i] != o.VariantProperties[i] {
+			return false
+		}
+	}
+	if len(f.Metadata) != len(o.Metadata) {
+		return false
+	}
+	for k, v := range f.Metadata {
+		if ov, ok := o.Metadata[k]; !ok || ov != v {
+			return false
+		}
+	}
 	return true
 }
 
-type RuleAction string
+// How many distinct errors to remember when throttling, before forgetting
+// expired ones
+const maxThrottledErrors = 1000
+
+// SetFlagStalenessThresholds sets staleness thresholds for particular flags,
+// replacing the one from SetRefreshStalenessThreshold. When one of these flags is
+// checked and the flags haven't been refreshed within its threshold, that's
+// logged. A threshold of zero disables the check for that flag.
+func (g *goforit) SetFlagStalenessThresholds(thresholds map[string]time.Duration) {
+	for name, threshold := range thresholds {
+		g.flagStaleness.Store(name, threshold)
+	}
+}
+
+// A StaleBehavior is what to do when a flag is checked, and the flags haven't
+// been refreshed within the staleness threshold
+type StaleBehavior int32
+
+const (
+	// StaleServe uses the flag anyway. This is the default.
+	StaleServe StaleBehavior = iota
+	// StaleDefault returns false, and reports an ErrDataStale
+	StaleDefault
+)
+
+// SetStaleBehavior sets what to do when flags are stale
+func (g *goforit) SetStaleBehavior(behavior StaleBehavior) {
+	atomic.StoreInt32(&g.staleBehavior, int32(behavior))
+}
+
+// SetFlagStaleBehaviors sets what to do when particular flags are stale,
+// replacing the one from SetStaleBehavior
+func (g *goforit) SetFlagStaleBehaviors(behaviors map[string]StaleBehavior) {
+	for name, behavior := range behaviors {
+		g.flagStaleBehavior.Store(name, behavior)
+	}
+}
+
+// An ErrorValuePolicy is what to do when a flag is evaluated with errors that
+// mean its value may be wrong: a missing required tag, a rule that failed, or
+// a variant that couldn't be picked. Other errors, like ErrLockedTag,
+// ErrTagCardinality, or a missing property handled by the flag's
+// OnMissingTag, are only reported.
+type ErrorValuePolicy int32
 
 const (
-	RuleOn       RuleAction = "on"
-	RuleOff      RuleAction = "off"
-	RuleContinue RuleAction = "continue"
+	// PreferValue uses the flag's value anyway. This is the default.
+	PreferValue ErrorValuePolicy = iota
+	// PreferDefault returns false, with ReasonError
+	PreferDefault
 )
 
-var validRuleActions = map[RuleAction]bool{
-	RuleOn:       true,
-	RuleOff:      true,
-	RuleContinue: true,
+// SetErrorValuePolicy sets what to do when flags are evaluated with errors.
+// The errors are reported either way.
+func (g *goforit) SetErrorValuePolicy(policy ErrorValuePolicy) {
+	atomic.StoreInt32(&g.errorValuePolicy, int32(policy))
 }
 
-type RuleInfo struct {
-	Rule    Rule
-	OnMatch RuleAction
-	OnMiss  RuleAction
+// SetFlagErrorValuePolicies sets what to do when particular flags are
+// evaluated with errors, replacing the one from SetErrorValuePolicy
+func (g *goforit) SetFlagErrorValuePolicies(policies map[string]ErrorValuePolicy) {
+	for name, policy := range policies {
+		g.flagErrorValuePolicy.Store(name, policy)
+	}
 }
 
-type Rule interface {
-	Handle(flag string, props map[string]string) (bool, error)
+func (g *goforit) flagErrorValuePolicyFor(name string) ErrorValuePolicy {
+	if p, ok := g.flagErrorValuePolicy.Load(name); ok {
+		return p.(ErrorValuePolicy)
+	}
+	return ErrorValuePolicy(atomic.LoadInt32(&g.errorValuePolicy))
 }
 
-type MatchListRule struct {
-	Property string
-	Values   []string
+// staleDefault checks whether a flag should use the default because the flags
+// are stale
+func (g *goforit) staleDefault(name string) error {
+	behavior := StaleBehavior(atomic.LoadInt32(&g.staleBehavior))
+	if b, ok := g.flagStaleBehavior.Load(name); ok {
+		behavior = b.(StaleBehavior)
+	}
+	if behavior != StaleDefault {
+		return nil
+	}
+	thresh := g.flagStalenessThreshold(name)
+	last := atomic.LoadInt64(&g.lastFlagRefreshTime)
+	if thresh == 0 || last == 0 || g.refreshIsPaused() {
+		return nil
+	}
+	staleness := g.clock.Now().Sub(time.Unix(0, last))
+	if staleness <= thresh {
+		return nil
+	}
+	return ErrDataStale{Flag: name, Staleness: staleness, Threshold: thresh}
 }
 
-type RateRule struct {
-	Rate       float64
-	Properties []string
+// flagStalenessThreshold gets the refresh staleness threshold for a flag
+func (g *goforit) flagStalenessThreshold(name string) time.Duration {
+	if thresh, ok := g.flagStaleness.Load(name); ok {
+		return thresh.(time.Duration)
+	}
+	return g.getRefreshStalenessThreshold()
 }
 
-func (g *goforit) getStalenessThreshold() time.Duration {
+func (g *goforit) getStalenessThresholds() (source, refresh time.Duration) {
 	g.stalenessMtx.RLock()
 	defer g.stalenessMtx.RUnlock()
-	return g.stalenessThreshold
+	return g.sourceStalenessThreshold, g.refreshStalenessThreshold
+}
+
+func (g *goforit) getSourceStalenessThreshold() time.Duration {
+	source, _ := g.getStalenessThresholds()
+	return source
+}
+
+func (g *goforit) getRefreshStalenessThreshold() time.Duration {
+	_, refresh := g.getStalenessThresholds()
+	return refresh
 }
 
 func (g *goforit) logStaleCheck() bool {
 	g.lastAssertMtx.Lock()
 	defer g.lastAssertMtx.Unlock()
-	if time.Since(g.lastAssert) < lastAssertInterval {
+	now := g.clock.Now()
+	if now.Sub(g.lastAssert) < lastAssertInterval {
 		return false
 	}
-	g.lastAssert = time.Now()
+	g.lastAssert = now
 	return true
 }
 
+// SetErrorThrottle makes goforit log identical errors at most once per window.
+// Zero, the default, logs every error.
+func (g *goforit) SetErrorThrottle(window time.Duration) {
+	g.errorThrottleMtx.Lock()
+	defer g.errorThrottleMtx.Unlock()
+	g.errorThrottle = window
+	g.errorsLogged = nil
+}
+
+// An ErrorHandler is called with errors that goforit encounters. The name is
+// the flag being checked, or empty if the error isn't about a particular flag.
+//
+// Errors from one check are reported in a fixed order: staleness of the
+// flags, then too many tags, then missing tags and locked tags, each sorted by
+// tag, then errors from the flag's rules.
+type ErrorHandler func(name string, err error)
+
+// SetErrorHandler sets a function to call with each error, in addition to
+// logging it. If errors are throttled, so are calls to the handler.
+func (g *goforit) SetErrorHandler(handler ErrorHandler) {
+	g.errorHandler.Store(handler)
+}
+
+// SetLogger replaces where errors are logged, which is stderr by default. A
+// nil logger turns off logging, eg: to log structured errors from an
+// ErrorHandler instead:
+//
+//	goforit.SetLogger(nil)
+//	goforit.SetErrorHandler(func(name string, err error) {
+//		buf, _ := json.Marshal(goforit.ErrorFields(name, err))
+//		...
+//	})
+//
+// This should be called before Init.
+func (g *goforit) SetLogger(logger *log.Logger) {
+	if logger == nil {
+		logger = log.New(ioutil.Discard, "", 0)
+	}
+	g.logger = logger
+}
+
+// ErrorFields breaks an error passed to an ErrorHandler into fields, for
+// structured logging. There are always "error" and "type" fields, and a "flag"
+// field if the error is about a flag. Errors from goforit have their other
+// fields too, with durations in seconds.
+func ErrorFields(name string, err error) map[string]interface{} {
+	fields := map[string]interface{}{
+		"error": err.Error(),
+		"type":  fmt.Sprintf("%T", err),
+	}
+	if name != "" {
+		fields["flag"] = name
+	}
+	switch e := err.(type) {
+	case ErrUnknownFlag:
+		fields["flag"] = e.Flag
+	case ErrParseFlag:
+		if e.Flag != "" {
+			fields["flag"] = e.Flag
+		}
+		if e.Line > 0 {
+			fields["line"] = e.Line
+		}
+		fields["value"] = e.Value
+	case ErrDuplicateFlag:
+		fields["flag"] = e.Flag
+		fields["line"] = e.Line
+		fields["value"] = e.Value
+		fields["previous_line"] = e.PreviousLine
+		fields["previous_value"] = e.PreviousValue
+	case ErrTagCardinality:
+		fields["flag"] = e.Flag
+		fields["count"] = e.Count
+		fields["max"] = e.Max
+	case ErrMissingTag:
+		fields["flag"] = e.Flag
+		fields["tag"] = e.Tag
+	case ErrLockedTag:
+		fields["flag"] = e.Flag
+		fields["tag"] = e.Tag
+	case ErrDataStale:
+		fields["flag"] = e.Flag
+		fields["age_s"] = e.Staleness.Seconds()
+		fields["threshold_s"] = e.Threshold.Seconds()
+	case ErrRefreshTimeout:
+		fields["timeout_s"] = e.Timeout.Seconds()
+	}
+	return fields
+}
+
+// reportError logs an error and passes it to the error handler, unless the
+// same error was reported recently. The name is the flag being checked, if any.
+func (g *goforit) reportError(name string, err error, prefix string) {
+	if g.throttleError(name + "\000" + err.Error()) {
+		return
+	}
+	g.handleError(name, err)
+	g.logger.Printf("%s%s", prefix, err)
+}
+
+// handleError passes an error to the error handler, if there is one
+func (g *goforit) handleError(name string, err error) {
+	if handler, _ := g.errorHandler.Load().(ErrorHandler); handler != nil {
+		handler(name, err)
+	}
+}
+
+// SetUnknownFlagHandler sets a function to call whenever a flag that doesn't
+// exist is checked, and isn't overridden. It's meant for tests, to catch
+// misspelled flag names, eg:
+//
+//	goforit.SetUnknownFlagHandler(func(name string) {
+//		t.Fatalf("Unknown flag %s", name)
+//	})
+//
+// The result of checking the flag is the same as without a handler.
+func (g *goforit) SetUnknownFlagHandler(handler func(name string)) {
+	g.unknownFlagHandler.Store(handler)
+}
+
+// handleUnknownFlag calls the unknown flag handler, if there is one
+func (g *goforit) handleUnknownFlag(name string) {
+	if handler, _ := g.unknownFlagHandler.Load().(func(name string)); handler != nil {
+		handler(name)
+	}
+}
+
+// throttleError checks if an error with the same key was reported recently.
+// If not, it remembers this one.
+func (g *goforit) throttleError(key string) bool {
+	g.errorThrottleMtx.Lock()
+	defer g.errorThrottleMtx.Unlock()
+	if g.errorThrottle > 0 {
+		now := g.clock.Now()
+		if last, ok := g.errorsLogged[key]; ok && now.Sub(last) < g.errorThrottle {
+			return true
+		}
+		if g.errorsLogged == nil {
+			g.errorsLogged = make(map[string]time.Time)
+		}
+		if len(g.errorsLogged) >= maxThrottledErrors {
+			// Don't grow forever, forget about anything that's expired
+			for k, last := range g.errorsLogged {
+				if now.Sub(last) >= g.errorThrottle {
+					delete(g.errorsLogged, k)
+				}
+			}
+		}
+		g.errorsLogged[key] = now
+	}
+	return false
+}
+
 // Check if a time is stale.
-func (g *goforit) staleCheck(t time.Time, metric string, metricRate float64, msg string, checkLastAssert bool) {
+// The name is the flag being checked, if any.
+func (g *goforit) staleCheck(name string, t time.Time, metric string, metricRate float64, thresh time.Duration, msg string, checkLastAssert bool) {
 	if t.IsZero() {
 		// Not really useful to treat this as a real time
 		return
 	}
 
 	// Report the staleness
-	staleness := time.Since(t)
+	staleness := g.clock.Now().Sub(t)
 	g.stats.Histogram(metric, staleness.Seconds(), nil, metricRate)
 
 	// Log if we're old
-	thresh := g.getStalenessThreshold()
 	if thresh == 0 {
 		return
 	}
@@ -177,8 +829,10 @@ func (g *goforit) staleCheck(t time.Time, metric string, metricRate float64, msg
 		return
 	}
 	// Don't log too often!
-	if !checkLastAssert || g.logStaleCheck() {
-		g.logger.Printf(msg, staleness, thresh)
+	if (!checkLastAssert || g.logStaleCheck()) && !g.throttleError(msg) {
+		err := fmt.Errorf(msg, staleness, thresh)
+		g.handleError(name, err)
+		g.logger.Printf("%s", err)
 	}
 }
 
@@ -186,260 +840,1635 @@ func (g *goforit) staleCheck(t time.Time, metric string, metricRate float64, msg
 // whether or not the flag should be considered
 // enabled. It returns false if no flag with the specified
 // name is found
-func (g *goforit) Enabled(ctx context.Context, name string, properties map[string]string) (enabled bool) {
-	enabled = false
-	f, ok := g.flags.Load(name)
-	var flag Flag
-	var tickerC <-chan time.Time
-	if ok {
-		flag = f.(Flag)
-		tickerC = flag.enabledTicker.C
-	} else {
-		tickerC = g.enabledTicker.C
+func (g *goforit) Enabled(ctx context.Context, name string, properties map[string]string) bool {
+	enabled, errs := g.enabled(ctx, name, properties, nil)
+	if len(errs) > 0 {
+		resolved := g.resolveAlias(name)
+		for _, err := range errs {
+			g.reportError(resolved, err, "[goforit] ")
+		}
 	}
+	return enabled
+}
 
-	select {
-	case <-tickerC:
-		defer func() {
-			var gauge float64
-			if enabled {
-				gauge = 1
-			}
-			g.stats.Gauge("goforit.flags.enabled", gauge, []string{fmt.Sprintf("flag:%s", name)}, 1)
-			last := atomic.LoadInt64(&g.lastFlagRefreshTime)
-			// time.Duration is conveniently measured in nanoseconds.
-			lastRefreshTime := time.Unix(last/int64(time.Second), last%int64(time.Second))
-			g.staleCheck(lastRefreshTime, "goforit.flags.last_refresh_s", 1,
-				"Refresh cycle has not run in %s, past our threshold (%s)", true)
-		}()
-	default:
+// EnabledOrDefault is like Enabled, but returns def if the flag doesn't exist.
+// The unknown flag is still logged, but isn't counted or passed to callbacks,
+// since they would see false rather than def.
+func (g *goforit) EnabledOrDefault(ctx context.Context, name string, properties map[string]string, def bool) bool {
+	if _, _, reason, _ := g.check(ctx, name, properties, nil, true); reason == ReasonUnknown {
+		resolved := g.resolveAlias(name)
+		g.handleUnknownFlag(resolved)
+		g.reportError(resolved, ErrUnknownFlag{resolved}, "[goforit] ")
+		return def
 	}
+	return g.Enabled(ctx, name, properties)
+}
 
-	// Check for an override.
-	if ctx != nil {
-		if ov, ok := ctx.Value(overrideContextKey).(overrides); ok {
-			if enabled, ok = ov[name]; ok {
-				return
-			}
+// Variant returns which variant of a flag to use. If the flag doesn't exist
+// or has no variants, it returns false. Overriding a variant flag to false
+// picks the control, the first variant, and overriding it to true picks the
+// second.
+func (g *goforit) Variant(ctx context.Context, name string, properties map[string]string) (string, bool) {
+	resolved := g.resolveAlias(name)
+	f, ok := g.flags.Load(resolved)
+	if !ok || len(f.(Flag).Variants) == 0 {
+		if !ok {
+			g.handleUnknownFlag(resolved)
 		}
+		err := ErrUnknownFlag{resolved}
+		g.reportError(resolved, err, "[goforit] ")
+		return "", false
 	}
-
-	// if flag is inactive, always return false
-	if !flag.Active {
-		return
+	_, variant, _, errs := g.check(ctx, name, properties, nil, false)
+	for _, err := range errs {
+		g.reportError(resolved, err, "[goforit] ")
 	}
+	return variant, true
+}
 
-	// if there are no rules, but flag is active, always return true
-	if len(flag.Rules) == 0 {
-		enabled = true
-		return
+// Value returns the value of a value flag, eg: a timeout or batch size. If the
+// flag is enabled its value is returned, otherwise "". Flags without a value
+// return "true" or "false". It returns false if the flag is unknown.
+func (g *goforit) Value(ctx context.Context, name string, properties map[string]string) (string, bool, error) {
+	resolved := g.resolveAlias(name)
+	f, ok := g.flags.Load(resolved)
+	if !ok {
+		g.handleUnknownFlag(resolved)
+		return "", false, ErrUnknownFlag{resolved}
 	}
-
-	mergedProperties := make(map[string]string)
-	g.defaultTags.Range(func(k, v interface{}) bool {
-		mergedProperties[k.(string)] = v.(string)
-		return true
-	})
-	for k, v := range properties {
-		mergedProperties[k] = v
+	enabled, _, _, errs := g.check(ctx, name, properties, nil, false)
+	var err error
+	if len(errs) > 0 {
+		err = errs[0]
 	}
-
-	for _, r := range flag.Rules {
-		res, err := r.Rule.Handle(flag.Name, mergedProperties)
-		if err != nil {
-			g.logger.Printf("[goforit] error evaluating rule:\n %s", err)
-			return
-		}
-		var matchBehavior RuleAction
-		if res {
-			matchBehavior = r.OnMatch
-		} else {
-			matchBehavior = r.OnMiss
-		}
-		switch matchBehavior {
-		case RuleOn:
-			enabled = true
-			return
-		case RuleOff:
-			enabled = false
-			return
-		case RuleContinue:
-			continue
-		default:
-			g.logger.Printf("[goforit] unknown match behavior: " + string(matchBehavior))
-			return
-		}
+	value := f.(Flag).Value
+	if value == "" {
+		return strconv.FormatBool(enabled), true, err
 	}
-	enabled = false
-	return
-}
-
-func getProperty(props map[string]string, prop string) (string, error) {
-	if v, ok := props[prop]; ok {
-		return v, nil
-	} else {
-		return "", errors.New("No property " + prop + " in properties map or default tags.")
-	}
-}
-
-func (r *RateRule) Handle(flag string, props map[string]string) (bool, error) {
-	if r.Properties != nil {
-		// get the sha1 of the properties values concat
-		h := sha1.New()
-		// sort the properties for consistent behavior
-		sort.Strings(r.Properties)
-		var buffer bytes.Buffer
-		buffer.WriteString(flag)
-		for _, val := range r.Properties {
-			buffer.WriteString("\000")
-			prop, err := getProperty(props, val)
-			if err != nil {
-				return false, err
-			}
-			buffer.WriteString(prop)
-		}
-		h.Write([]byte(buffer.String()))
-		bs := h.Sum(nil)
-		// get the most significant 32 digits
-		x := binary.BigEndian.Uint32(bs)
-		// check to see if the 32 most significant bits of the hex
-		// is less than (rate * 2^32)
-		return float64(x) < (r.Rate * float64(1<<32)), nil
-	} else {
-		f := rand.Float64()
-		return f < r.Rate, nil
+	if !enabled {
+		return "", true, err
 	}
+	return value, true, err
 }
 
-func (r *MatchListRule) Handle(flag string, props map[string]string) (bool, error) {
-	prop, err := getProperty(props, r.Property)
-	if err != nil {
-		return false, err
+// LastTags returns the tags that a flag's rules were most recently evaluated
+// with, after merging with the default tags. It returns false if the flag's
+// rules haven't been evaluated, eg: because it has none.
+func (g *goforit) LastTags(name string) (map[string]string, bool) {
+	v, ok := g.lastTags.Load(name)
+	if !ok {
+		return nil, false
 	}
-	for _, val := range r.Values {
-		if val == prop {
-			return true, nil
-		}
+	tags := make(map[string]string)
+	for k, val := range v.(map[string]string) {
+		tags[k] = val
 	}
-	return false, nil
+	return tags, true
 }
 
-// RefreshFlags will use the provided thunk function to
-// fetch all feature flags and update the internal cache.
-// The thunk provided can use a variety of mechanisms for
-// querying the flag values, such as a local file or
-// Consul key/value storage.
-func (g *goforit) RefreshFlags(backend Backend) {
-	// Ask the backend for the flags
-	var checkStatus statsd.ServiceCheckStatus
-	defer func() {
-		g.stats.SimpleServiceCheck("goforit.refreshFlags.present", checkStatus)
-	}()
-	refreshedFlags, updated, err := backend.Refresh()
-	if err != nil {
-		checkStatus = statsd.Warn
-		g.stats.Count("goforit.refreshFlags.errors", 1, nil, 1)
-		g.logger.Printf("Error refreshing flags: %s", err)
-		return
-	}
-	atomic.StoreInt64(&g.lastFlagRefreshTime, time.Now().UnixNano())
-
-	deleted := make(map[string]bool)
-	g.flags.Range(func(name, flag interface{}) bool {
-		deleted[name.(string)] = true
-		return true
-	})
+// checkRing holds the most recent results of checking a flag
+type checkRing struct {
+	mtx     sync.Mutex
+	results []bool
+	next    int
+}
 
-	for _, flag := range refreshedFlags {
-		delete(deleted, flag.Name)
-		oldFlag, ok := g.flags.Load(flag.Name)
-		if ok {
-			// Avoid churning the map if the flag hasn't changed.
-			if !oldFlag.(Flag).Equal(flag) {
-				flag.enabledTicker = oldFlag.(Flag).enabledTicker
-				g.flags.Store(flag.Name, flag)
-			}
-		} else {
-			flag.enabledTicker = time.NewTicker(g.enabledTickerInterval)
-			g.flags.Store(flag.Name, flag)
-		}
+// SetCheckHistory keeps the results of the last n checks of each flag, so
+// SimulateOverride can tell what an override would change. Zero, the default,
+// keeps none.
+func (g *goforit) SetCheckHistory(n int) {
+	atomic.StoreInt32(&g.checkHistorySize, int32(n))
+	if n == 0 {
+		g.checkHistory.Range(func(name, ring interface{}) bool {
+			g.checkHistory.Delete(name)
+			return true
+		})
 	}
+}
 
-	for name, _ := range deleted {
-		f, ok := g.flags.Load(name)
-		if ok {
-			f.(Flag).enabledTicker.Stop()
-			g.flags.Delete(name)
-		}
+func (g *goforit) recordCheck(name string, size int, enabled bool) {
+	r, ok := g.checkHistory.Load(name)
+	if !ok {
+		r, _ = g.checkHistory.LoadOrStore(name, &checkRing{})
 	}
+	ring := r.(*checkRing)
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+	if len(ring.results) > size {
+		ring.results, ring.next = ring.results[:0], 0
+	}
+	if len(ring.results) < size {
+		ring.results = append(ring.results, enabled)
+	} else {
+		ring.results[ring.next] = enabled
+		ring.next = (ring.next + 1) % size
+	}
+}
 
-	g.staleCheck(updated, "goforit.flags.cache_file_age_s", 0.1,
-		"Backend is stale (%s) past our threshold (%s)", false)
-
-	return
+// A FlagStat counts checks of a flag
+type FlagStat struct {
+	Checks   uint64
+	Enabled  uint64
+	Disabled uint64
+	// How many errors there were, eg: missing properties. A check can have
+	// more than one.
+	Errors uint64
+	// How many checks weren't passed to the CheckCallback, because the buffer
+	// from SetCheckBuffer was full or closed
+	Dropped uint64
 }
 
-func (g *goforit) SetStalenessThreshold(threshold time.Duration) {
-	g.stalenessMtx.Lock()
-	defer g.stalenessMtx.Unlock()
-	g.stalenessThreshold = threshold
+type flagStats struct {
+	enabled, disabled, errors, dropped uint64
 }
 
-func (g *goforit) AddDefaultTags(tags map[string]string) {
+// statsFor returns the counts for a flag, adding them if it has none
+func (g *goforit) statsFor(name string) *flagStats {
+	s, ok := g.checkStats.Load(name)
+	if !ok {
+		s, _ = g.checkStats.LoadOrStore(name, &flagStats{})
+	}
+	return s.(*flagStats)
+}
+
+func (g *goforit) countCheck(name string, enabled bool, errs int) {
+	stats := g.statsFor(name)
+	if enabled {
+		atomic.AddUint64(&stats.enabled, 1)
+	} else {
+		atomic.AddUint64(&stats.disabled, 1)
+	}
+	if errs > 0 {
+		atomic.AddUint64(&stats.errors, uint64(errs))
+	}
+}
+
+// Stats counts the checks of each flag that has been checked, since it was
+// created or since ResetStats.
+func (g *goforit) Stats() map[string]FlagStat {
+	result := make(map[string]FlagStat)
+	g.checkStats.Range(func(k, v interface{}) bool {
+		stats := v.(*flagStats)
+		stat := FlagStat{
+			Enabled:  atomic.LoadUint64(&stats.enabled),
+			Disabled: atomic.LoadUint64(&stats.disabled),
+			Errors:   atomic.LoadUint64(&stats.errors),
+			Dropped:  atomic.LoadUint64(&stats.dropped),
+		}
+		stat.Checks = stat.Enabled + stat.Disabled
+		result[k.(string)] = stat
+		return true
+	})
+	return result
+}
+
+// ResetStats clears the counts returned by Stats
+func (g *goforit) ResetStats() {
+	g.checkStats.Range(func(k, v interface{}) bool {
+		g.checkStats.Delete(k)
+		return true
+	})
+}
+
+// SimulateOverride counts how many of the recent checks of a flag would have
+// had a different result, if the flag were overridden to a value. This needs
+// SetCheckHistory, and only counts checks since it was set.
+func (g *goforit) SimulateOverride(name string, value bool) (int, error) {
+	if atomic.LoadInt32(&g.checkHistorySize) == 0 {
+		return 0, errors.New("Check history is off, see SetCheckHistory")
+	}
+	name = g.resolveAlias(name)
+	if !g.known(name) {
+		return 0, ErrUnknownFlag{name}
+	}
+	r, ok := g.checkHistory.Load(name)
+	if !ok {
+		return 0, nil
+	}
+	ring := r.(*checkRing)
+	ring.mtx.Lock()
+	defer ring.mtx.Unlock()
+	affected := 0
+	for _, enabled := range ring.results {
+		if enabled != value {
+			affected++
+		}
+	}
+	return affected, nil
+}
+
+// EnabledWith is like Enabled, but the properties don't have to be strings.
+// A TypedRule gets the values as they are, and other rules get them formatted
+// as strings. Default tags are still merged in, as strings.
+func (g *goforit) EnabledWith(ctx context.Context, name string, properties map[string]interface{}) bool {
+	strProperties := make(map[string]string, len(properties))
+	for k, v := range properties {
+		strProperties[k] = fmt.Sprint(v)
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, typedPropertiesContextKey, properties)
+	return g.Enabled(ctx, name, strProperties)
+}
+
+// EnabledSeeded is like Enabled, but random sampling uses a new source with the
+// given seed, eg: to reproduce a check in a support tool. It only makes a
+// difference for flags that sample randomly, and doesn't affect other checks.
+func (g *goforit) EnabledSeeded(ctx context.Context, name string, properties map[string]string, seed int64) bool {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, seededRandContextKey, rand.New(rand.NewSource(seed)))
+	return g.Enabled(ctx, name, properties)
+}
+
+// A unique context key for the random source from EnabledSeeded
+type seededRandContextKeyType struct{}
+
+var seededRandContextKey = seededRandContextKeyType{}
+
+// A unique context key for the properties passed to EnabledWith
+type typedPropertiesContextKeyType struct{}
+
+var typedPropertiesContextKey = typedPropertiesContextKeyType{}
+
+// typedProperties merges the properties passed to EnabledWith, if any, over
+// the usual merged properties
+func typedProperties(ctx context.Context, props map[string]string) map[string]interface{} {
+	typed := make(map[string]interface{}, len(props))
+	for k, v := range props {
+		typed[k] = v
+	}
+	if ctx != nil {
+		if extra, ok := ctx.Value(typedPropertiesContextKey).(map[string]interface{}); ok {
+			for k, v := range extra {
+				if _, ok := typed[k]; ok {
+					typed[k] = v
+				}
+			}
+		}
+	}
+	return typed
+}
+
+// SetAliases lets flags be checked by other names, eg: their old names after
+// being renamed. The aliases map each alias to the real name of a flag. Metrics
+// and callbacks for a check use the alias, but everything else, including
+// overrides and errors, uses the real name.
+func (g *goforit) SetAliases(aliases map[string]string) {
+	copied := make(map[string]string, len(aliases))
+	for alias, name := range aliases {
+		copied[g.normalizeName(alias)] = name
+	}
+	g.aliases.Store(copied)
+}
+
+func (g *goforit) resolveAlias(name string) string {
+	name = g.normalizeName(name)
+	if aliases, _ := g.aliases.Load().(map[string]string); len(aliases) > 0 {
+		if resolved, ok := aliases[name]; ok {
+			return g.normalizeName(resolved)
+		}
+	}
+	return name
+}
+
+// SetCaseInsensitiveNames lowercases flag names, both from the backend and
+// when checking flags, so "MyFlag" and "myflag" are the same flag. Overrides,
+// metrics and callbacks use the lowercase name. If flags from the backend
+// have the same lowercase name, the last one is used, and the collision is
+// reported once. This should be called before Init and any other setters.
+func (g *goforit) SetCaseInsensitiveNames(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&g.caseInsensitive, v)
+}
+
+func (g *goforit) normalizeName(name string) string {
+	if atomic.LoadInt32(&g.caseInsensitive) != 0 {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// normalizeFlags lowercases the names of flags if names are case
+// insensitive, reporting any collisions
+func (g *goforit) normalizeFlags(flags []Flag) []Flag {
+	if atomic.LoadInt32(&g.caseInsensitive) == 0 {
+		return flags
+	}
+	normalized := make([]Flag, 0, len(flags))
+	seen := make(map[string]int)
+	for _, flag := range flags {
+		name := strings.ToLower(flag.Name)
+		if i, ok := seen[name]; ok {
+			key := normalized[i].Name + "\000" + flag.Name
+			if _, reported := g.caseCollisions.LoadOrStore(key, true); !reported {
+				err := fmt.Errorf("Flags %s and %s have the same name ignoring case, using %s", normalized[i].Name, flag.Name, flag.Name)
+				g.handleError(name, err)
+				g.logger.Printf("[goforit] %s", err)
+			}
+			normalized[i] = flag
+			continue
+		}
+		seen[name] = len(normalized)
+		normalized = append(normalized, flag)
+	}
+	for i := range normalized {
+		normalized[i].Name = strings.ToLower(normalized[i].Name)
+	}
+	return normalized
+}
+
+// known checks whether a flag exists
+func (g *goforit) known(name string) bool {
+	_, ok := g.flags.Load(name)
+	return ok
+}
+
+// Metadata returns the extra information about a flag from the backend, eg: its
+// owner or description.
+func (g *goforit) Metadata(name string) (map[string]string, error) {
+	name = g.resolveAlias(name)
+	f, ok := g.flags.Load(name)
+	if !ok {
+		return nil, ErrUnknownFlag{name}
+	}
+	metadata := make(map[string]string, len(f.(Flag).Metadata))
+	for k, v := range f.(Flag).Metadata {
+		metadata[k] = v
+	}
+	return metadata, nil
+}
+
+// EnabledAll checks several flags at once, with the same properties. It returns
+// whether each flag is enabled, like Enabled, but is cheaper than calling
+// Enabled in a loop since the properties are merged with the default tags
+// only once.
+func (g *goforit) EnabledAll(ctx context.Context, names []string, properties map[string]string) map[string]bool {
+	properties = g.addContextTags(ctx, properties)
+	mergedProperties := g.mergeProperties(properties)
+	results := make(map[string]bool, len(names))
+	var errs []string
+	for _, name := range names {
+		enabled, flagErrs := g.enabled(ctx, name, properties, mergedProperties)
+		for _, err := range flagErrs {
+			if !g.throttleError(name + "\000" + err.Error()) {
+				g.handleError(name, err)
+				errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+			}
+		}
+		results[name] = enabled
+	}
+	if len(errs) > 0 {
+		g.logger.Printf("[goforit] errors checking flags:\n %s", strings.Join(errs, "\n "))
+	}
+	return results
+}
+
+// Export checks every known flag with each set of tags, eg: to compare the
+// results in a test. The results are keyed by flag name, then by the tags
+// formatted as sorted "key=value" pairs, separated by commas. Exporting
+// doesn't send metrics or call callbacks. A flag that had an error for some
+// tags is left out of the results for those tags, and the errors are returned.
+func (g *goforit) Export(tagSets []map[string]string) (map[string]map[string]bool, error) {
+	results := make(map[string]map[string]bool)
+	var errs []string
+	for _, name := range g.Flags(nil) {
+		results[name] = make(map[string]bool, len(tagSets))
+		for _, tags := range tagSets {
+			key := formatTags(tags)
+			enabled, _, _, flagErrs := g.check(nil, name, tags, nil, true)
+			if len(flagErrs) > 0 {
+				for _, err := range flagErrs {
+					errs = append(errs, fmt.Sprintf("%s [%s]: %s", name, key, err))
+				}
+				continue
+			}
+			results[name][key] = enabled
+		}
+	}
+	if len(errs) > 0 {
+		return results, fmt.Errorf("errors exporting flags:\n %s", strings.Join(errs, "\n "))
+	}
+	return results, nil
+}
+
+// formatTags formats tags as sorted "key=value" pairs
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
 	for k, v := range tags {
-		g.defaultTags.Store(k, v)
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// A Source is where the result of a flag check came from
+type Source int
+
+const (
+	// SourceBackend means the flag was evaluated
+	SourceBackend Source = iota
+	// SourceOverride means the flag was overridden in the context
+	SourceOverride
+	// SourceDefault means the flag is unknown, the flags are stale with
+	// StaleDefault or haven't loaded, or the context was cancelled
+	SourceDefault
+)
+
+func (s Source) String() string {
+	switch s {
+	case SourceBackend:
+		return "backend"
+	case SourceOverride:
+		return "override"
+	case SourceDefault:
+		return "default"
+	}
+	return fmt.Sprintf("Source(%d)", int(s))
+}
+
+// An EvalReason is why a flag check had its result
+type EvalReason int
+
+const (
+	// ReasonEvaluated means the flag's rules were evaluated, or it has none
+	ReasonEvaluated EvalReason = iota
+	// ReasonFlagOff means the flag is inactive
+	ReasonFlagOff
+	// ReasonUnknown means the flag doesn't exist
+	ReasonUnknown
+	// ReasonError means there was an error evaluating the flag's rules
+	ReasonError
+	// ReasonOverride means the flag was overridden in the context
+	ReasonOverride
+	// ReasonStaleDefault means the flags are stale, with StaleDefault
+	ReasonStaleDefault
+	// ReasonStartupDefault means the flags haven't loaded yet, so the
+	// startup default was used
+	ReasonStartupDefault
+	// ReasonCancelled means the context was cancelled
+	ReasonCancelled
+	// ReasonKillSwitch means the kill switch is on, so every flag is off
+	ReasonKillSwitch
+	// ReasonClosed means goforit was closed, so the default was used
+	ReasonClosed
+)
+
+func (r EvalReason) String() string {
+	switch r {
+	case ReasonEvaluated:
+		return "evaluated"
+	case ReasonFlagOff:
+		return "flag off"
+	case ReasonUnknown:
+		return "unknown"
+	case ReasonError:
+		return "error"
+	case ReasonOverride:
+		return "override"
+	case ReasonStaleDefault:
+		return "stale default"
+	case ReasonStartupDefault:
+		return "startup default"
+	case ReasonCancelled:
+		return "cancelled"
+	case ReasonKillSwitch:
+		return "kill switch"
+	case ReasonClosed:
+		return "closed"
+	}
+	return fmt.Sprintf("EvalReason(%d)", int(r))
+}
+
+// Source gets where a result with this reason came from
+func (r EvalReason) Source() Source {
+	switch r {
+	case ReasonEvaluated, ReasonFlagOff, ReasonError:
+		return SourceBackend
+	case ReasonOverride:
+		return SourceOverride
+	}
+	return SourceDefault
+}
+
+// An Explanation describes the result of a flag check
+type Explanation struct {
+	Enabled bool
+	// The variant used, if the flag has variants
+	Variant string
+	Source  Source
+	Reason  EvalReason
+	// How old the flags are, according to the backend if it knows, or else
+	// since they were last refreshed. Zero if they've never been refreshed.
+	Age time.Duration
+	// The tags the flag was checked with, including the default tags
+	Tags map[string]string
+}
+
+// Explain checks a flag like Enabled, and describes the result, eg: for a
+// debugging page. It doesn't send metrics or call callbacks. Any errors
+// checking the flag are returned, rather than logged.
+func (g *goforit) Explain(ctx context.Context, name string, properties map[string]string) (Explanation, error) {
+	properties = g.addContextTags(ctx, properties)
+	tags := g.mergeProperties(properties)
+	enabled, variant, reason, errs := g.check(ctx, name, properties, tags, true)
+	ex := Explanation{Enabled: enabled, Variant: variant, Source: reason.Source(), Reason: reason, Tags: tags}
+
+	g.healthMtx.Lock()
+	updated := g.lastUpdated
+	g.healthMtx.Unlock()
+	if updated.IsZero() {
+		if last := atomic.LoadInt64(&g.lastFlagRefreshTime); last != 0 {
+			updated = time.Unix(0, last)
+		}
+	}
+	if !updated.IsZero() {
+		ex.Age = g.clock.Now().Sub(updated)
+	}
+
+	if len(errs) > 0 {
+		msgs := make([]string, 0, len(errs))
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return ex, fmt.Errorf("errors checking flag %s:\n %s", name, strings.Join(msgs, "\n "))
+	}
+	return ex, nil
+}
+
+// EnabledByPrefix checks every known flag whose name starts with the prefix,
+// eg: all the flags for one feature, like EnabledAll.
+func (g *goforit) EnabledByPrefix(ctx context.Context, prefix string, properties map[string]string) map[string]bool {
+	var names []string
+	for _, name := range g.Flags(ctx) {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return g.EnabledAll(ctx, names, properties)
+}
+
+// Flags returns the names of all known flags, in sorted order. This includes
+// flags from the backend, and any flags overridden globally or in the context.
+func (g *goforit) Flags(ctx context.Context) []string {
+	seen := make(map[string]bool)
+	g.flags.Range(func(name, flag interface{}) bool {
+		seen[name.(string)] = true
+		return true
+	})
+	for name := range g.loadGlobalOverrides() {
+		seen[name] = true
+	}
+	funcs, _ := g.globalOverrideFuncs.Load().(overrideFuncs)
+	for name := range funcs {
+		seen[name] = true
+	}
+	if ctx != nil {
+		if ov, ok := ctx.Value(overrideContextKey).(overrides); ok {
+			for name := range ov {
+				seen[name] = true
+			}
+		}
 	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
-// init initializes the flag backend, using the provided refresh function
-// to update the internal cache of flags periodically, at the specified interval.
-func (g *goforit) init(interval time.Duration, backend Backend) {
-	g.RefreshFlags(backend)
-	if interval != 0 {
-		ticker := time.NewTicker(interval)
-		g.ticker = ticker
+// Rate returns the fraction of checks for which a flag is enabled. Flags that
+// are simply on or off have a rate of one or zero. The boolean result is false
+// if the flag has rules that can't be described by a rate, such as a match list.
+func (g *goforit) Rate(name string) (float64, bool, error) {
+	name = g.resolveAlias(name)
+	f, ok := g.flags.Load(name)
+	if !ok {
+		return 0, false, ErrUnknownFlag{name}
+	}
+	flag := f.(Flag)
+
+	switch {
+	case !flag.Active:
+		return 0, true, nil
+	case len(flag.Rules) == 0:
+		return 1, true, nil
+	case len(flag.Rules) == 1:
+		r := flag.Rules[0]
+		if rr, ok := r.Rule.(*RateRule); ok && r.OnMatch == RuleOn && r.OnMiss == RuleOff {
+			return rr.Rate, true, nil
+		}
+	}
+	return 0, false, nil
+}
 
-		go func() {
-			for _ = range ticker.C {
-				g.RefreshFlags(backend)
+// A ContextTagger gets tags from a context, eg: a user ID put there by
+// middleware
+type ContextTagger func(ctx context.Context) map[string]string
+
+// SetContextTagger sets a function to get tags from the context of each
+// check. Properties passed to Enabled take precedence over tags from the
+// context, which take precedence over the default tags. Locked tags still
+// can't be replaced.
+func (g *goforit) SetContextTagger(tagger ContextTagger) {
+	g.contextTagger.Store(tagger)
+}
+
+// addContextTags adds tags from the context to properties, if there's a
+// ContextTagger
+func (g *goforit) addContextTags(ctx context.Context, properties map[string]string) map[string]string {
+	tagger, _ := g.contextTagger.Load().(ContextTagger)
+	if tagger == nil || ctx == nil {
+		return properties
+	}
+	tags := tagger(ctx)
+	if len(tags) == 0 {
+		return properties
+	}
+	combined := make(map[string]string, len(tags)+len(properties))
+	for k, v := range tags {
+		combined[k] = v
+	}
+	for k, v := range properties {
+		combined[k] = v
+	}
+	return combined
+}
+
+// mergeProperties combines the default tags with the given properties, which
+// take precedence.
+func (g *goforit) mergeProperties(properties map[string]string) map[string]string {
+	mergedProperties := make(map[string]string)
+	g.defaultTags.Range(func(k, v interface{}) bool {
+		mergedProperties[k.(string)] = v.(string)
+		return true
+	})
+	for k, v := range properties {
+		mergedProperties[k] = v
+	}
+	g.lockedTags.Range(func(k, v interface{}) bool {
+		mergedProperties[k.(string)] = v.(string)
+		return true
+	})
+
+	if normalize, _ := g.tagNormalizer.Load().(TagNormalizer); normalize != nil {
+		normalized := make(map[string]string, len(mergedProperties))
+		for k, v := range mergedProperties {
+			k, v = normalize(k, v)
+			if k != "" {
+				normalized[k] = v
 			}
+		}
+		mergedProperties = normalized
+	}
+	return mergedProperties
+}
+
+// enabled does the work of Enabled. If mergedProperties is nil, the properties
+// will be merged with the default tags only if they're needed.
+// Any errors are returned, even if they didn't prevent evaluating the flag.
+func (g *goforit) enabled(ctx context.Context, name string, properties, mergedProperties map[string]string) (bool, []error) {
+	enabled, _, _, errs := g.check(ctx, name, properties, mergedProperties, false)
+	return enabled, errs
+}
+
+// check is like enabled, but also returns the variant of the flag, if it has
+// any, and why it has this result. A flag with variants is enabled if it's
+// not using the control. A quiet check doesn't send metrics, call callbacks or
+// remember tags.
+func (g *goforit) check(ctx context.Context, name string, properties, mergedProperties map[string]string, quiet bool) (enabled bool, variant string, reason EvalReason, errs []error) {
+	enabled = false
+	// Metrics and callbacks use the name we were asked about, even if it's an alias
+	requested := g.normalizeName(name)
+	if mergedProperties == nil {
+		properties = g.addContextTags(ctx, properties)
+	}
+	if rate := math.Float64frombits(atomic.LoadUint64(&g.checkMetricRate)); rate > 0 && !quiet {
+		defer func() {
+			tags := []string{fmt.Sprintf("flag:%s", requested), fmt.Sprintf("enabled:%t", enabled)}
+			g.stats.Count("goforit.flags.checks", 1, tags, rate)
+		}()
+	}
+	if !quiet {
+		defer func() {
+			g.countCheck(requested, enabled, len(errs))
+		}()
+	}
+	if size := atomic.LoadInt32(&g.checkHistorySize); size > 0 && !quiet {
+		defer func() {
+			g.recordCheck(name, int(size), enabled)
 		}()
 	}
+	if callback, _ := g.latencyCallback.Load().(LatencyCallback); callback != nil && !quiet {
+		start := time.Now()
+		defer func() {
+			callback(requested, time.Since(start))
+		}()
+	}
+	if callback, _ := g.checkReasonCallback.Load().(CheckReasonCallback); callback != nil && !quiet {
+		defer func() {
+			callback(requested, enabled, reason)
+		}()
+	}
+	if callback, _ := g.checkCallback.Load().(CheckCallback); callback != nil && !quiet && g.sampleCheckCallback() {
+		defer func() {
+			var tags map[string]string
+			if mergedProperties == nil {
+				tags = g.mergeProperties(properties)
+			} else {
+				tags = make(map[string]string, len(mergedProperties))
+				for k, v := range mergedProperties {
+					tags[k] = v
+				}
+			}
+			if buffer, _ := g.checkBuffer.Load().(*checkBuffer); buffer != nil {
+				if !buffer.add(checkEvent{requested, enabled, tags}) {
+					g.dropCheck(requested)
+				}
+				return
+			}
+			callback(requested, enabled, tags)
+		}()
+	}
+	name = g.resolveAlias(name)
+	f, known := g.flags.Load(name)
+	var flag Flag
+	var tickerC <-chan time.Time
+	if known {
+		flag = f.(Flag)
+		tickerC = flag.enabledTicker.C
+	} else {
+		tickerC = g.enabledTicker.C
+	}
+
+	if quiet {
+		tickerC = nil
+	}
+	select {
+	case <-tickerC:
+		defer func() {
+			var gauge float64
+			if enabled {
+				gauge = 1
+			}
+			g.stats.Gauge("goforit.flags.enabled", gauge, []string{fmt.Sprintf("flag:%s", name)}, 1)
+			if g.refreshIsPaused() {
+				// Not refreshing is deliberate
+				return
+			}
+			last := atomic.LoadInt64(&g.lastFlagRefreshTime)
+			// time.Duration is conveniently measured in nanoseconds.
+			lastRefreshTime := time.Unix(last/int64(time.Second), last%int64(time.Second))
+			if thresh, ok := g.flagStaleness.Load(name); ok {
+				g.staleCheck(name, lastRefreshTime, "goforit.flags.last_refresh_s", 1, thresh.(time.Duration),
+					"Refresh cycle has not run in %s, past the threshold for "+strings.Replace(name, "%", "%%", -1)+" (%s)", true)
+			} else {
+				g.staleCheck(name, lastRefreshTime, "goforit.flags.last_refresh_s", 1, g.getRefreshStalenessThreshold(),
+					"Refresh cycle has not run in %s, past our threshold (%s)", true)
+			}
+		}()
+	default:
+	}
+
+	if atomic.LoadInt32(&g.closed) != 0 {
+		if len(flag.Variants) > 0 {
+			variant = flag.Variants[0].Name
+		}
+		reason = ReasonClosed
+		errs = append(errs, ErrClosed{name})
+		return
+	}
+
+	if g.killed(ctx, name) {
+		if len(flag.Variants) > 0 {
+			variant = flag.Variants[0].Name
+		}
+		reason = ReasonKillSwitch
+		return
+	}
+
+	// Check for an override.
+	var ok bool
+	mergeOnce := func() map[string]string {
+		if mergedProperties == nil {
+			mergedProperties = g.mergeProperties(properties)
+		}
+		return mergedProperties
+	}
+	if enabled, ok = g.getOverride(ctx, name, mergeOnce); ok {
+		if len(flag.Variants) > 1 && enabled {
+			variant = flag.Variants[1].Name
+		} else if len(flag.Variants) > 0 {
+			variant = flag.Variants[0].Name
+			enabled = false
+		}
+		reason = ReasonOverride
+		if !quiet {
+			g.overrideHit(name, enabled)
+		}
+		return
+	}
+
+	// Check for a result from earlier in this request
+	if cache := getRequestCache(ctx); cache != nil {
+		var result requestCacheResult
+		if result, ok = cache.get(name); ok {
+			enabled, variant, reason = result.enabled, result.variant, result.reason
+			return
+		}
+		defer func() {
+			if len(errs) == 0 {
+				cache.set(name, requestCacheResult{enabled, variant, reason})
+			}
+		}()
+	}
+
+	if len(flag.Variants) > 0 {
+		variant = flag.Variants[0].Name
+	}
+
+	if !known {
+		reason = ReasonUnknown
+		if !quiet {
+			g.handleUnknownFlag(name)
+		}
+	}
+
+	// if the caller has given up, don't bother evaluating
+	if ctx != nil && ctx.Err() != nil {
+		reason = ReasonCancelled
+		errs = append(errs, fmt.Errorf("not evaluating flag %s: %s", name, ctx.Err()))
+		return
+	}
+
+	// if we haven't loaded flags yet, use the startup defaults
+	if !known && g.inStartupGrace() {
+		reason = ReasonStartupDefault
+		enabled = g.startupDefaults[name]
+		return
+	}
+
+	if known {
+		if err := g.staleDefault(name); err != nil {
+			reason = ReasonStaleDefault
+			errs = append(errs, err)
+			return
+		}
+	}
+
+	// if flag is inactive, always return false
+	if !flag.Active {
+		if known {
+			reason = ReasonFlagOff
+		}
+		return
+	}
+
+	// if there are no rules or variants, but flag is active, always return true
+	if len(flag.Rules) == 0 && len(flag.Variants) == 0 {
+		enabled = true
+		return
+	}
+
+	if mergedProperties == nil {
+		mergedProperties = g.mergeProperties(properties)
+	}
+	if guard, _ := g.tagCardinalityGuard.Load().(tagCardinalityGuard); guard.maxKeys > 0 && len(mergedProperties) > guard.maxKeys {
+		errs = append(errs, ErrTagCardinality{Flag: name, Count: len(mergedProperties), Max: guard.maxKeys})
+		if guard.drop {
+			mergedProperties = guard.trim(mergedProperties)
+		}
+	}
+	if !quiet {
+		g.lastTags.Store(name, mergedProperties)
+	}
+	var missing, locked []string
+	g.requiredTags.Range(func(k, v interface{}) bool {
+		if _, ok := mergedProperties[k.(string)]; !ok {
+			missing = append(missing, k.(string))
+		}
+		return true
+	})
+	for k := range properties {
+		if _, ok := g.lockedTags.Load(k); ok {
+			locked = append(locked, k)
+		}
+	}
+	sort.Strings(missing)
+	for _, tag := range missing {
+		errs = append(errs, ErrMissingTag{Flag: name, Tag: tag})
+	}
+	// Whether there were errors that mean the value may be wrong
+	fatal := len(missing) > 0
+	sort.Strings(locked)
+	for _, tag := range locked {
+		errs = append(errs, ErrLockedTag{Flag: name, Tag: tag})
+	}
+
+	enabled = true
+	var warnings []error
+	if len(flag.Rules) > 0 {
+		var err error
+		enabled, err = g.evaluate(ctx, flag, mergedProperties, 0, &warnings)
+		if err != nil {
+			reason = ReasonError
+			errs = append(errs, err)
+			fatal = true
+		}
+	}
+	if enabled && len(flag.Variants) > 0 {
+		i, err := g.pickVariant(g.randFor(ctx), flag, mergedProperties)
+		if err != nil {
+			reason = ReasonError
+			errs = append(errs, err)
+			fatal = true
+		}
+		variant = flag.Variants[i].Name
+		enabled = i != 0
+	}
+	if fatal && g.flagErrorValuePolicyFor(name) == PreferDefault {
+		enabled = false
+		if len(flag.Variants) > 0 {
+			variant = flag.Variants[0].Name
+		}
+		reason = ReasonError
+	}
+	// Missing properties that a policy handled are still reported, but they
+	// don't change the result
+	errs = append(errs, warnings...)
+	return
 }
 
-// A unique context key for overrides
-type overrideContextKeyType struct{}
+// pickVariant chooses the index of a flag's variant, by weight. On error, it
+// picks the control.
+func (g *goforit) pickVariant(rnd func() float64, flag Flag, props map[string]string) (int, error) {
+	var total float64
+	for _, v := range flag.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return 0, nil
+	}
+
+	var f float64
+	if len(flag.VariantProperties) == 0 {
+		f = rnd()
+	} else {
+		// Salt the flag name, so this doesn't correlate with a sample rule
+		// on the same properties
+		x, err := hashProperties(g.getHashFunc(), flag.Name+"\000variant", flag.VariantProperties, props)
+		if err != nil {
+			return 0, fmt.Errorf("error picking variant:\n %s", err)
+		}
+		f = float64(x>>32) / float64(1<<32)
+	}
+
+	target := f * total
+	for i, v := range flag.Variants {
+		if target < v.Weight {
+			return i, nil
+		}
+		target -= v.Weight
+	}
+	// Only reachable through rounding
+	return len(flag.Variants) - 1, nil
+}
 
-var overrideContextKey = overrideContextKeyType{}
+// SetStalenessThreshold logs when either the backend's flags are older than
+// the threshold, or flags haven't been refreshed within it. It's the same as
+// calling both SetSourceStalenessThreshold and SetRefreshStalenessThreshold.
+func (g *goforit) SetStalenessThreshold(threshold time.Duration) {
+	g.stalenessMtx.Lock()
+	defer g.stalenessMtx.Unlock()
+	g.sourceStalenessThreshold = threshold
+	g.refreshStalenessThreshold = threshold
+}
 
-type overrides map[string]bool
+// SetSourceStalenessThreshold logs when the flags returned by the backend are
+// older than the threshold, eg: because the file they come from is out of date.
+func (g *goforit) SetSourceStalenessThreshold(threshold time.Duration) {
+	g.stalenessMtx.Lock()
+	defer g.stalenessMtx.Unlock()
+	g.sourceStalenessThreshold = threshold
+}
 
-// Override allows overriding the value of a goforit flag within a context.
-// This is mainly useful for tests.
-func Override(ctx context.Context, name string, value bool) context.Context {
-	ov := overrides{}
-	if old, ok := ctx.Value(overrideContextKey).(overrides); ok {
-		for k, v := range old {
-			ov[k] = v
+// SetRefreshStalenessThreshold logs when flags haven't been successfully
+// refreshed from the backend within the threshold.
+func (g *goforit) SetRefreshStalenessThreshold(threshold time.Duration) {
+	g.stalenessMtx.Lock()
+	defer g.stalenessMtx.Unlock()
+	g.refreshStalenessThreshold = threshold
+}
+
+// SetStatsdClient replaces the client used to report metrics. A *statsd.Client
+// Namespace can be used to prefix the metric names. This should be called
+// before Init.
+func (g *goforit) SetStatsdClient(client StatsdClient) {
+	g.stats = client
+}
+
+// SetCheckMetricRate enables a goforit.flags.checks count metric for every
+// call to Enabled, tagged with the flag and the result. The metric is sampled
+// at the given rate, to limit volume for hot flags. A rate of zero disables it.
+func (g *goforit) SetCheckMetricRate(rate float64) {
+	atomic.StoreUint64(&g.checkMetricRate, math.Float64bits(rate))
+}
+
+// A TagNormalizer transforms a tag before flags are evaluated. If it returns
+// an empty key, the tag is dropped.
+type TagNormalizer func(key, value string) (string, string)
+
+// SetTagNormalizer sets a function to clean up every tag, after the
+// properties passed to Enabled are merged with the default tags.
+func (g *goforit) SetTagNormalizer(normalize TagNormalizer) {
+	g.tagNormalizer.Store(normalize)
+}
+
+type tagCardinalityGuard struct {
+	maxKeys int
+	drop    bool
+}
+
+// trim keeps only the first maxKeys tags, in sorted order
+func (c tagCardinalityGuard) trim(tags map[string]string) map[string]string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	trimmed := make(map[string]string, c.maxKeys)
+	for _, k := range keys[:c.maxKeys] {
+		trimmed[k] = tags[k]
+	}
+	return trimmed
+}
+
+// SetTagCardinalityGuard logs an ErrTagCardinality whenever a flag is
+// evaluated with more than maxKeys tags, after merging with the default tags.
+// If drop is true, only the first maxKeys tags in sorted order are used. A
+// maxKeys of zero disables the guard.
+func (g *goforit) SetTagCardinalityGuard(maxKeys int, drop bool) {
+	g.tagCardinalityGuard.Store(tagCardinalityGuard{maxKeys, drop})
+}
+
+// SetKillSwitch turns every flag off while enabled, regardless of the backend
+// or any overrides, eg: during an incident. Checks report ReasonKillSwitch.
+func (g *goforit) SetKillSwitch(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&g.killSwitch, v)
+}
+
+// SetKillSwitchFlag names a flag that acts like SetKillSwitch: while it's
+// enabled, every other flag is off. It's checked without any properties, other
+// than the default tags.
+func (g *goforit) SetKillSwitchFlag(name string) {
+	g.killSwitchFlag.Store(name)
+}
+
+// killed checks whether the kill switch is on, for a flag other than the kill
+// switch flag itself
+func (g *goforit) killed(ctx context.Context, name string) bool {
+	if atomic.LoadInt32(&g.killSwitch) != 0 {
+		return true
+	}
+	flag, _ := g.killSwitchFlag.Load().(string)
+	if flag == "" || g.resolveAlias(flag) == name {
+		return false
+	}
+	enabled, _, _, _ := g.check(ctx, flag, nil, nil, true)
+	return enabled
+}
+
+// A CheckCallback is called with the result of every flag check, and the tags
+// the flag was checked with.
+type CheckCallback func(name string, enabled bool, tags map[string]string)
+
+// SetCheckCallback sets a function to call after every flag check, eg: to
+// record which groups of users have a flag enabled. The tags are merged with
+// the default tags, and can be kept or modified by the callback.
+func (g *goforit) SetCheckCallback(callback CheckCallback) {
+	g.checkCallback.Store(callback)
+}
+
+// SetCheckCallbackSampleRate passes only this fraction of checks to the
+// CheckCallback, picked randomly, to limit volume for hot flags. Counts from
+// the callback should be divided by the rate. Stats still counts every check.
+// The default rate of 1 passes every check.
+func (g *goforit) SetCheckCallbackSampleRate(rate float64) {
+	g.checkCallbackRate.Store(rate)
+}
+
+// sampleCheckCallback decides whether to pass a check to the CheckCallback
+func (g *goforit) sampleCheckCallback() bool {
+	rate, ok := g.checkCallbackRate.Load().(float64)
+	if !ok || rate >= 1 {
+		return true
+	}
+	return g.rand() < rate
+}
+
+// A checkEvent is a check waiting to be passed to the CheckCallback
+type checkEvent struct {
+	name    string
+	enabled bool
+	tags    map[string]string
+}
+
+// A checkBuffer holds checks for a goroutine that calls the CheckCallback
+type checkBuffer struct {
+	events chan checkEvent
+	// Closed to ask the goroutine to finish, and by it when it has
+	stop chan struct{}
+	done chan struct{}
+
+	// Held to add checks, so none are added after the goroutine finishes
+	mtx     sync.RWMutex
+	stopped bool
+}
+
+// SetCheckBuffer makes the CheckCallback be called from a single goroutine,
+// rather than during each check, so a slow callback doesn't slow down checks.
+// Up to size checks are buffered, after which they're dropped and counted by
+// DroppedChecks, Stats and the goforit.flags.dropped_checks metric. Checks
+// after Close are dropped too. Close calls the callback for any buffered
+// checks. Calling it again replaces the buffer, after calling the callback
+// for the checks in the old one. It does nothing after Close, or if size
+// isn't positive.
+func (g *goforit) SetCheckBuffer(size int) {
+	if size <= 0 {
+		g.reportError("", fmt.Errorf("SetCheckBuffer called with size %d, which isn't positive", size), "[goforit] ")
+		return
+	}
+	g.closeMtx.Lock()
+	defer g.closeMtx.Unlock()
+	if atomic.LoadInt32(&g.closed) != 0 {
+		g.reportError("", errors.New("SetCheckBuffer called after Close"), "[goforit] ")
+		return
+	}
+
+	buffer := &checkBuffer{
+		events: make(chan checkEvent, size),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if old, _ := g.checkBuffer.Load().(*checkBuffer); old != nil {
+		defer old.finish()
+	}
+	g.checkBuffer.Store(buffer)
+	go func() {
+		defer close(buffer.done)
+		call := func(e checkEvent) {
+			if callback, _ := g.checkCallback.Load().(CheckCallback); callback != nil {
+				callback(e.name, e.enabled, e.tags)
+			}
+		}
+		for {
+			select {
+			case e := <-buffer.events:
+				call(e)
+			case <-buffer.stop:
+				for {
+					select {
+					case e := <-buffer.events:
+						call(e)
+					default:
+						return
+					}
+				}
+			}
 		}
+	}()
+}
+
+// add buffers a check, unless the buffer is full or finished. It returns
+// whether it did.
+func (b *checkBuffer) add(e checkEvent) bool {
+	b.mtx.RLock()
+	defer b.mtx.RUnlock()
+	if b.stopped {
+		return false
 	}
-	ov[name] = value
-	return context.WithValue(ctx, overrideContextKey, ov)
+	select {
+	case b.events <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// finish stops the goroutine, after it calls the callback for any buffered
+// checks
+func (b *checkBuffer) finish() {
+	b.mtx.Lock()
+	b.stopped = true
+	b.mtx.Unlock()
+	close(b.stop)
+	<-b.done
+}
+
+// dropCheck counts a check that wasn't passed to the CheckCallback
+func (g *goforit) dropCheck(name string) {
+	atomic.AddUint64(&g.droppedChecks, 1)
+	atomic.AddUint64(&g.statsFor(name).dropped, 1)
+	g.stats.Count("goforit.flags.dropped_checks", 1, []string{fmt.Sprintf("flag:%s", name)}, 1)
+}
+
+// DroppedChecks returns how many checks weren't passed to the CheckCallback,
+// because the buffer from SetCheckBuffer was full or closed
+func (g *goforit) DroppedChecks() uint64 {
+	return atomic.LoadUint64(&g.droppedChecks)
+}
+
+// A CheckReasonCallback is called with the result of every flag check, and
+// why it had that result.
+type CheckReasonCallback func(name string, enabled bool, reason EvalReason)
+
+// SetCheckReasonCallback sets a function to call after every flag check, eg:
+// to tell flags that are off from flags that failed to evaluate.
+func (g *goforit) SetCheckReasonCallback(callback CheckReasonCallback) {
+	g.checkReasonCallback.Store(callback)
+}
+
+// A LatencyCallback is called with how long each flag check took
+type LatencyCallback func(name string, d time.Duration)
+
+// SetLatencyCallback sets a function to call with how long each flag check
+// took, eg: to find flags with expensive rules.
+func (g *goforit) SetLatencyCallback(callback LatencyCallback) {
+	g.latencyCallback.Store(callback)
+}
+
+// SetHashFunc replaces the hash function used by rules and variants that
+// sample by properties, eg: to match how users are grouped elsewhere. Bucket
+// rules use the whole hash modulo the number of buckets, and the others use
+// its top 32 bits. The default is the first 8 bytes of SHA-1.
+// Changing the hash function changes which users are sampled, so it shouldn't
+// be done while a flag is being rolled out.
+func (g *goforit) SetHashFunc(hash HashFunc) {
+	g.hashFunc.Store(hash)
+}
+
+func (g *goforit) getHashFunc() HashFunc {
+	hash, _ := g.hashFunc.Load().(HashFunc)
+	if hash == nil {
+		hash = sha1Hash
+	}
+	if salt := g.getSalt(); salt != "" {
+		return func(s string) uint64 {
+			return hash(salt + "\000" + s)
+		}
+	}
+	return hash
+}
+
+// SetClock replaces the clock used for staleness checks and time-based rules.
+// If the clock also has an After method, like time.After, it's used to wait
+// too, eg: between webhook retries. This is mainly useful for tests, and
+// should be called before Init.
+func (g *goforit) SetClock(clock Clock) {
+	g.clock = clock
+}
+
+func (g *goforit) AddDefaultTags(tags map[string]string) {
+	for k, v := range tags {
+		g.defaultTags.Store(k, v)
+	}
+}
+
+// AddLockedTags adds tags like AddDefaultTags, but these can't be replaced by
+// the properties passed to Enabled, eg: to stop a caller from claiming to be in
+// another cluster. Trying to replace one logs an ErrLockedTag.
+func (g *goforit) AddLockedTags(tags map[string]string) {
+	for k, v := range tags {
+		g.lockedTags.Store(k, v)
+	}
+}
+
+// RequireTags causes an ErrMissingTag to be logged whenever a flag's rules are
+// evaluated without one of these tags, either in the properties passed to
+// Enabled or in the default tags. The flag is still evaluated as usual.
+func (g *goforit) RequireTags(tags ...string) {
+	for _, tag := range tags {
+		g.requiredTags.Store(tag, true)
+	}
+}
+
+// SetStartupGrace provides values for flags until the backend first loads
+// successfully, so that features aren't briefly disabled if the backend is slow
+// or broken at startup. After the grace period, or once flags are loaded,
+// these values are no longer used. Flags without a default are disabled as
+// usual. This should be called before Init.
+func (g *goforit) SetStartupGrace(grace time.Duration, defaults map[string]bool) {
+	g.startupGraceEnd = g.clock.Now().Add(grace)
+	g.startupDefaults = make(map[string]bool, len(defaults))
+	for k, v := range defaults {
+		g.startupDefaults[k] = v
+	}
+}
+
+// inStartupGrace checks whether the startup defaults should be used
+func (g *goforit) inStartupGrace() bool {
+	if g.startupDefaults == nil || atomic.LoadInt64(&g.lastFlagRefreshTime) != 0 {
+		return false
+	}
+	return g.clock.Now().Before(g.startupGraceEnd)
+}
+
+// RedactTags hides the values of these tags when the configuration is
+// described by String, eg: because they contain secrets.
+func (g *goforit) RedactTags(tags ...string) {
+	for _, tag := range tags {
+		g.redactedTags.Store(tag, true)
+	}
+}
+
+// String describes goforit's configuration, for debugging
+func (g *goforit) String() string {
+	var defaultTags []string
+	g.defaultTags.Range(func(k, v interface{}) bool {
+		value := v.(string)
+		if _, ok := g.redactedTags.Load(k); ok {
+			value = "<redacted>"
+		}
+		defaultTags = append(defaultTags, fmt.Sprintf("%s=%s", k, value))
+		return true
+	})
+	sort.Strings(defaultTags)
+
+	var requiredTags []string
+	g.requiredTags.Range(func(k, v interface{}) bool {
+		requiredTags = append(requiredTags, k.(string))
+		return true
+	})
+	sort.Strings(requiredTags)
+
+	var overrides []string
+	for name, value := range g.loadGlobalOverrides() {
+		overrides = append(overrides, fmt.Sprintf("%s=%t", name, value))
+	}
+	funcs, _ := g.globalOverrideFuncs.Load().(overrideFuncs)
+	for name := range funcs {
+		overrides = append(overrides, fmt.Sprintf("%s=<func>", name))
+	}
+	sort.Strings(overrides)
+
+	flags := 0
+	g.flags.Range(func(k, v interface{}) bool {
+		flags++
+		return true
+	})
+
+	lastRefresh := "never"
+	if last := atomic.LoadInt64(&g.lastFlagRefreshTime); last != 0 {
+		lastRefresh = time.Unix(0, last).String()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "goforit:\n")
+	fmt.Fprintf(&buf, "  backend: %T\n", g.backend)
+	fmt.Fprintf(&buf, "  flags: %d\n", flags)
+	fmt.Fprintf(&buf, "  last refresh: %s\n", lastRefresh)
+	source, refresh := g.getStalenessThresholds()
+	fmt.Fprintf(&buf, "  staleness thresholds: source %s, refresh %s\n", source, refresh)
+	fmt.Fprintf(&buf, "  default tags: %s\n", strings.Join(defaultTags, ", "))
+	fmt.Fprintf(&buf, "  required tags: %s\n", strings.Join(requiredTags, ", "))
+	fmt.Fprintf(&buf, "  global overrides: %s\n", strings.Join(overrides, ", "))
+	return buf.String()
+}
+
+// A unique context key for request caches
+type requestCacheContextKeyType struct{}
+
+var requestCacheContextKey = requestCacheContextKeyType{}
+
+type requestCacheResult struct {
+	enabled bool
+	variant string
+	reason  EvalReason
+}
+
+// A requestCache remembers flag results for the lifetime of a context
+type requestCache struct {
+	mtx     sync.Mutex
+	results map[string]requestCacheResult
+}
+
+func (c *requestCache) get(name string) (requestCacheResult, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	result, ok := c.results[name]
+	return result, ok
+}
+
+func (c *requestCache) set(name string, result requestCacheResult) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.results[name] = result
+}
+
+// getRequestCache looks for a request cache in the context
+func getRequestCache(ctx context.Context) *requestCache {
+	if ctx == nil {
+		return nil
+	}
+	cache, _ := ctx.Value(requestCacheContextKey).(*requestCache)
+	return cache
+}
+
+// NewRequestContext returns a context that remembers the result of each flag
+// the first time it's checked, so later checks with the context get the same
+// result, even for sampled flags. The result is remembered by flag name only,
+// so checks with different properties also get the same result.
+// Overrides still take precedence.
+func NewRequestContext(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestCacheContextKey, &requestCache{results: make(map[string]requestCacheResult)})
+}
+
+// A FlagChange describes a flag that changed when flags were refreshed. A flag
+// that was added has an empty Old, and one that was removed has an empty New.
+type FlagChange struct {
+	Name string
+	Old  Flag
+	New  Flag
+}
+
+// How many changes a watcher can fall behind before old ones are dropped
+const watchBufferSize = 100
+
+// Watch returns a channel that receives a FlagChange whenever a refresh changes
+// a flag. If changes aren't received quickly enough, the oldest are dropped.
+// The channel is closed by Close.
+func (g *goforit) Watch() <-chan FlagChange {
+	ch := make(chan FlagChange, watchBufferSize)
+	g.watchersMtx.Lock()
+	defer g.watchersMtx.Unlock()
+	if g.watchersClosed {
+		close(ch)
+	} else {
+		g.watchers = append(g.watchers, ch)
+	}
+	return ch
+}
+
+// notifyWatchers tells each watcher about a change, without blocking
+func (g *goforit) notifyWatchers(oldFlag, newFlag Flag) {
+	oldFlag.enabledTicker = nil
+	newFlag.enabledTicker = nil
+	change := FlagChange{Name: oldFlag.Name, Old: oldFlag, New: newFlag}
+	if change.Name == "" {
+		change.Name = newFlag.Name
+	}
+
+	g.watchersMtx.Lock()
+	defer g.watchersMtx.Unlock()
+	for _, ch := range g.watchers {
+		for sent := false; !sent; {
+			select {
+			case ch <- change:
+				sent = true
+			default:
+				// Full, so make room
+				select {
+				case <-ch:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Snapshot returns a goforit with a copy of the current flags that's never
+// refreshed, eg: so a batch job sees the same flags throughout. It has the
+// same tags, aliases, overrides, callbacks and error handling as they are
+// now, but later changes to them aren't copied. It can be closed
+// independently. It's an error if no flags have been loaded yet.
+//
+// Refreshing a snapshot, eg: with Refresh or RefreshFlags, does nothing and
+// reports an error, so it never writes a cache file. Since it isn't
+// refreshed, Healthy reports it as stale once it's past the staleness
+// thresholds, like its checks.
+func (g *goforit) Snapshot() (*goforit, error) {
+	if atomic.LoadInt64(&g.lastFlagRefreshTime) == 0 {
+		return nil, errors.New("Can't snapshot before flags are loaded")
+	}
+	s := &goforit{
+		stats:                 g.stats,
+		enabledTickerInterval: g.enabledTickerInterval,
+		enabledTicker:         time.NewTicker(g.enabledTickerInterval),
+		rnd:                   rand.New(rand.NewSource(time.Now().UnixNano())),
+		salt:                  g.getSalt(),
+		logger:                g.logger,
+		clock:                 g.clock,
+		snapshot:              true,
+		lastFlagRefreshTime:   atomic.LoadInt64(&g.lastFlagRefreshTime),
+		killSwitch:            atomic.LoadInt32(&g.killSwitch),
+		caseInsensitive:       atomic.LoadInt32(&g.caseInsensitive),
+		checkMetricRate:       atomic.LoadUint64(&g.checkMetricRate),
+		staleBehavior:         atomic.LoadInt32(&g.staleBehavior),
+		errorValuePolicy:      atomic.LoadInt32(&g.errorValuePolicy),
+		startupGraceEnd:       g.startupGraceEnd,
+		startupDefaults:       g.startupDefaults,
+	}
+	s.sourceStalenessThreshold, s.refreshStalenessThreshold = g.getStalenessThresholds()
+	g.healthMtx.Lock()
+	s.lastRefreshErr, s.lastUpdated = g.lastRefreshErr, g.lastUpdated
+	g.healthMtx.Unlock()
+	g.errorThrottleMtx.Lock()
+	s.errorThrottle = g.errorThrottle
+	g.errorThrottleMtx.Unlock()
+
+	for _, m := range []struct{ dst, src *sync.Map }{
+		{&s.defaultTags, &g.defaultTags},
+		{&s.lockedTags, &g.lockedTags},
+		{&s.requiredTags, &g.requiredTags},
+		{&s.redactedTags, &g.redactedTags},
+		{&s.flagStaleness, &g.flagStaleness},
+		{&s.flagStaleBehavior, &g.flagStaleBehavior},
+		{&s.flagErrorValuePolicy, &g.flagErrorValuePolicy},
+	} {
+		dst := m.dst
+		m.src.Range(func(k, v interface{}) bool {
+			dst.Store(k, v)
+			return true
+		})
+	}
+	// The check buffer isn't copied, so the CheckCallback is called directly
+	for _, v := range []struct{ dst, src *atomic.Value }{
+		{&s.tagNormalizer, &g.tagNormalizer},
+		{&s.contextTagger, &g.contextTagger},
+		{&s.killSwitchFlag, &g.killSwitchFlag},
+		{&s.tagCardinalityGuard, &g.tagCardinalityGuard},
+		{&s.aliases, &g.aliases},
+		{&s.globalOverrides, &g.globalOverrides},
+		{&s.globalOverrideFuncs, &g.globalOverrideFuncs},
+		{&s.checkCallback, &g.checkCallback},
+		{&s.checkCallbackRate, &g.checkCallbackRate},
+		{&s.checkReasonCallback, &g.checkReasonCallback},
+		{&s.latencyCallback, &g.latencyCallback},
+		{&s.overrideCallback, &g.overrideCallback},
+		{&s.overrideChangeCallback, &g.overrideChangeCallback},
+		{&s.hashFunc, &g.hashFunc},
+		{&s.errorHandler, &g.errorHandler},
+		{&s.unknownFlagHandler, &g.unknownFlagHandler},
+	} {
+		if val := v.src.Load(); val != nil {
+			v.dst.Store(val)
+		}
+	}
+
+	var flags []Flag
+	g.flags.Range(func(k, v interface{}) bool {
+		flags = append(flags, v.(Flag))
+		return true
+	})
+	s.storeFlags(flags)
+	return s, nil
 }
 
 // Close releases resources held
-// It's still safe to call Enabled()
+// It's still safe to call Enabled(), but it returns the default and reports an
+// ErrClosed. A refresh that's still running when Close is called is discarded.
+// It's also safe to call Close() more than once, or concurrently
 func (g *goforit) Close() error {
+	g.closeMtx.Lock()
+	defer g.closeMtx.Unlock()
+	if atomic.LoadInt32(&g.closed) != 0 {
+		return nil
+	}
+	atomic.StoreInt32(&g.closed, 1)
+
+	g.watchersMtx.Lock()
+	for _, ch := range g.watchers {
+		close(ch)
+	}
+	g.watchers = nil
+	g.watchersClosed = true
+	g.watchersMtx.Unlock()
+
+	if buffer, _ := g.checkBuffer.Load().(*checkBuffer); buffer != nil {
+		buffer.finish()
+	}
+
 	if g.ticker != nil {
 		g.ticker.Stop()
 		g.ticker = nil
-
-		g.flags.Range(func(k, v interface{}) bool {
-			v.(Flag).enabledTicker.Stop()
-			return true
-		})
-
-		g.enabledTicker.Stop()
+		close(g.done)
 	}
+
+	g.flags.Range(func(k, v interface{}) bool {
+		v.(Flag).enabledTicker.Stop()
+		return true
+	})
+	g.enabledTicker.Stop()
 	return nil
 }
@@ -3,19 +3,28 @@ package goforit
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math"
 	"math/rand"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/goforit/goforittest"
 )
 
 // arbitrary but fixed for reproducible testing
@@ -26,16 +35,30 @@ const ε = .02
 type mockStatsd struct {
 	lock            sync.RWMutex
 	histogramValues map[string][]float64
+	counts          map[string]int64
 }
 
 func (m *mockStatsd) Gauge(string, float64, []string, float64) error {
 	return nil
 }
 
-func (m *mockStatsd) Count(string, int64, []string, float64) error {
+func (m *mockStatsd) Count(name string, value int64, tags []string, rate float64) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.counts == nil {
+		m.counts = make(map[string]int64)
+	}
+	key := strings.Join(append([]string{name}, tags...), ",")
+	m.counts[key] += value
 	return nil
 }
 
+func (m *mockStatsd) getCount(name string, tags ...string) int64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.counts[strings.Join(append([]string{name}, tags...), ",")]
+}
+
 func (m *mockStatsd) SimpleServiceCheck(string, statsd.ServiceCheckStatus) error {
 	return nil
 }
@@ -113,6 +136,360 @@ func TestEnabled(t *testing.T) {
 	assert.InEpsilon(t, 0.5, actualRate, ε)
 }
 
+func TestEnabledAll(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, buf := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("test", Flag{Name: "test", Active: true, Rules: []RuleInfo{{&MatchListRule{"host_name", []string{"apibox_123"}}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
+
+	// Every flag is in the results, even unknown ones
+	g.AddDefaultTags(map[string]string{"host_name": "apibox_123"})
+	results := g.EnabledAll(nil, []string{"go.sun.money", "go.moon.mercury", "go.extra", "test"}, nil)
+	assert.Equal(t, map[string]bool{"go.sun.money": false, "go.moon.mercury": true, "go.extra": false, "test": true}, results)
+
+	// Properties override default tags, and overrides apply
+	ctx := Override(context.Background(), "go.sun.money", true)
+	results = g.EnabledAll(ctx, []string{"go.sun.money", "test"}, map[string]string{"host_name": "apibox_456"})
+	assert.Equal(t, map[string]bool{"go.sun.money": true, "test": false}, results)
+	assert.Zero(t, buf.String())
+
+	// Errors are logged together
+	g.flags.Store("test2", Flag{Name: "test2", Active: true, Rules: []RuleInfo{{&MatchListRule{"db", []string{"mongo"}}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
+	g.flags.Store("test3", Flag{Name: "test3", Active: true, Rules: []RuleInfo{{&MatchListRule{"cluster", []string{"east"}}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
+	results = g.EnabledAll(nil, []string{"test", "test2", "test3"}, nil)
+	assert.Equal(t, map[string]bool{"test": true, "test2": false, "test3": false}, results)
+	assert.Equal(t, 1, strings.Count(buf.String(), "[goforit]"))
+	assert.Contains(t, buf.String(), "No property db")
+	assert.Contains(t, buf.String(), "No property cluster")
+}
+
+func BenchmarkEnabledAll(b *testing.B) {
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"host_name": "apibox_123", "cluster": "east"})
+	names := []string{"go.sun.money", "go.moon.mercury", "go.stars.money"}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = g.EnabledAll(context.Background(), names, nil)
+	}
+}
+
+func TestCheckMetric(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	stats := g.stats.(*mockStatsd)
+
+	// Off by default
+	g.Enabled(nil, "go.moon.mercury", nil)
+	assert.Zero(t, stats.getCount("goforit.flags.checks", "flag:go.moon.mercury", "enabled:true"))
+
+	g.SetCheckMetricRate(1)
+	g.Enabled(nil, "go.moon.mercury", nil)
+	g.Enabled(nil, "go.moon.mercury", nil)
+	g.Enabled(nil, "go.sun.money", nil)
+	assert.EqualValues(t, 2, stats.getCount("goforit.flags.checks", "flag:go.moon.mercury", "enabled:true"))
+	assert.EqualValues(t, 1, stats.getCount("goforit.flags.checks", "flag:go.sun.money", "enabled:false"))
+
+	// Any StatsdClient can be used
+	other := &mockStatsd{}
+	g.SetStatsdClient(other)
+	g.Enabled(nil, "go.moon.mercury", nil)
+	assert.EqualValues(t, 1, other.getCount("goforit.flags.checks", "flag:go.moon.mercury", "enabled:true"))
+	assert.EqualValues(t, 2, stats.getCount("goforit.flags.checks", "flag:go.moon.mercury", "enabled:true"))
+}
+
+func TestCheckCallback(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+
+	type check struct {
+		name    string
+		enabled bool
+		tags    map[string]string
+	}
+	var checks []check
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks = append(checks, check{name, enabled, tags})
+		tags["changed"] = "yes"
+	})
+
+	props := map[string]string{"host_name": "apibox_123"}
+	g.Enabled(context.Background(), "test", props)
+	g.EnabledAll(context.Background(), []string{"test", "test2"}, props)
+	g.Enabled(context.Background(), "go.extra", nil)
+	assert.Equal(t, []check{
+		{"test", true, map[string]string{"host_name": "apibox_123", "cluster": "east", "changed": "yes"}},
+		{"test", true, map[string]string{"host_name": "apibox_123", "cluster": "east", "changed": "yes"}},
+		{"test2", false, map[string]string{"host_name": "apibox_123", "cluster": "east", "changed": "yes"}},
+		{"go.extra", false, map[string]string{"cluster": "east", "changed": "yes"}},
+	}, checks)
+
+	// Changes by the callback don't affect anything else
+	assert.Equal(t, map[string]string{"host_name": "apibox_123"}, props)
+	assert.Equal(t, map[string]string{"host_name": "apibox_123", "cluster": "east"}, g.mergeProperties(props))
+}
+
+func TestSetCheckCallbackSampleRate(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{{Name: "go.on", Active: true}}}, enabledTickerInterval)
+	defer g.Close()
+	called := 0
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		called++
+	})
+
+	const n = 10000
+	g.SetCheckCallbackSampleRate(0.1)
+	for i := 0; i < n; i++ {
+		g.Enabled(nil, "go.on", nil)
+	}
+	assert.InEpsilon(t, 0.1, float64(called)/n, 0.1)
+	// Stats still count every check
+	assert.Equal(t, uint64(n), g.Stats()["go.on"].Checks)
+
+	called = 0
+	g.SetCheckCallbackSampleRate(0)
+	g.Enabled(nil, "go.on", nil)
+	assert.Equal(t, 0, called)
+	g.SetCheckCallbackSampleRate(1)
+	g.Enabled(nil, "go.on", nil)
+	assert.Equal(t, 1, called)
+}
+
+func TestCheckReasonCallback(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	store := func(name string, active bool, rules ...RuleInfo) {
+		g.flags.Store(name, Flag{Name: name, Active: active, Rules: rules, enabledTicker: time.NewTicker(time.Second)})
+	}
+	store("go.on", true)
+	store("go.off", false)
+	store("go.users", true, RuleInfo{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff})
+
+	type check struct {
+		name    string
+		enabled bool
+		reason  EvalReason
+	}
+	var checks []check
+	g.SetCheckReasonCallback(func(name string, enabled bool, reason EvalReason) {
+		checks = append(checks, check{name, enabled, reason})
+	})
+
+	g.Enabled(nil, "go.on", nil)
+	g.Enabled(nil, "go.off", nil)
+	g.Enabled(nil, "go.users", map[string]string{"user": "bob"})
+	g.Enabled(nil, "go.users", nil)
+	g.Enabled(nil, "go.missing", nil)
+	g.Enabled(Override(context.Background(), "go.off", true), "go.off", nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	g.Enabled(ctx, "go.on", nil)
+	assert.Equal(t, []check{
+		{"go.on", true, ReasonEvaluated},
+		{"go.off", false, ReasonFlagOff},
+		{"go.users", false, ReasonEvaluated},
+		{"go.users", false, ReasonError},
+		{"go.missing", false, ReasonUnknown},
+		{"go.off", true, ReasonOverride},
+		{"go.on", false, ReasonCancelled},
+	}, checks)
+	assert.Equal(t, "flag off", ReasonFlagOff.String())
+	assert.Equal(t, SourceDefault, ReasonUnknown.Source())
+}
+
+func TestSetKillSwitch(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.variants", Active: true, Variants: []VariantInfo{{"control", 0}, {"treatment", 1}}},
+		{Name: "go.kill", Active: false},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var reasons []EvalReason
+	g.SetCheckReasonCallback(func(name string, enabled bool, reason EvalReason) {
+		reasons = append(reasons, reason)
+	})
+	ctx := Override(context.Background(), "go.on", true)
+
+	g.SetKillSwitch(true)
+	assert.False(t, g.Enabled(ctx, "go.on", nil))
+	variant, _ := g.Variant(nil, "go.variants", nil)
+	assert.Equal(t, "control", variant)
+	assert.Equal(t, []EvalReason{ReasonKillSwitch, ReasonKillSwitch}, reasons)
+	g.SetKillSwitch(false)
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+
+	g.SetKillSwitchFlag("go.kill")
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	g.SetGlobalOverride("go.kill", true)
+	assert.False(t, g.Enabled(ctx, "go.on", nil))
+	assert.True(t, g.Enabled(nil, "go.kill", nil))
+	g.ClearGlobalOverride("go.kill")
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+}
+
+func TestSetCheckBuffer(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	g.SetCheckBuffer(2)
+	var mtx sync.Mutex
+	var checked []string
+	started := make(chan struct{})
+	release := make(chan struct{})
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		if name == "test" {
+			close(started)
+			<-release
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		checked = append(checked, name)
+	})
+
+	// The callback doesn't block checks, and extra checks are dropped
+	g.Enabled(nil, "test", nil)
+	<-started
+	for i := 0; i < 5; i++ {
+		g.Enabled(nil, "test2", nil)
+	}
+	assert.Equal(t, uint64(3), g.DroppedChecks())
+	assert.Equal(t, uint64(3), g.Stats()["test2"].Dropped)
+
+	// Close flushes the buffer
+	close(release)
+	g.Close()
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, []string{"test", "test2", "test2"}, checked)
+
+	// Checks after Close are dropped, not lost
+	g.Enabled(nil, "test2", nil)
+	assert.Equal(t, uint64(4), g.DroppedChecks())
+	assert.Equal(t, uint64(4), g.Stats()["test2"].Dropped)
+	assert.EqualValues(t, 4, g.stats.(*mockStatsd).getCount("goforit.flags.dropped_checks", "flag:test2"))
+	assert.Equal(t, []string{"test", "test2", "test2"}, checked)
+}
+
+func TestSetCheckBufferSize(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	var checked []string
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checked = append(checked, name)
+	})
+
+	// Sizes that aren't positive are refused, and checks call the callback
+	// as before
+	g.SetCheckBuffer(0)
+	g.SetCheckBuffer(-1)
+	assert.Len(t, errs, 2)
+	assert.Nil(t, g.checkBuffer.Load())
+	g.Enabled(nil, "test", nil)
+	assert.Equal(t, []string{"test"}, checked)
+	assert.Zero(t, g.DroppedChecks())
+}
+
+func TestSetCheckBufferTwice(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	var mtx sync.Mutex
+	var checked []string
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		mtx.Lock()
+		defer mtx.Unlock()
+		checked = append(checked, name)
+	})
+	count := func() int {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(checked)
+	}
+
+	// Replacing the buffer flushes the old one
+	g.SetCheckBuffer(10)
+	first, _ := g.checkBuffer.Load().(*checkBuffer)
+	for i := 0; i < 3; i++ {
+		g.Enabled(nil, "test", nil)
+	}
+	g.SetCheckBuffer(10)
+	assert.Equal(t, 3, count())
+	<-first.done
+
+	g.Enabled(nil, "test", nil)
+	g.Close()
+	assert.Equal(t, 4, count())
+
+	// After closing, there's no new buffer
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	last := g.checkBuffer.Load()
+	g.SetCheckBuffer(10)
+	assert.True(t, last == g.checkBuffer.Load())
+	assert.Len(t, errs, 1)
+}
+
+func TestOverrideCallback(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+
+	type hit struct {
+		name    string
+		enabled bool
+	}
+	var hits []hit
+	g.SetOverrideCallback(func(name string, enabled bool) {
+		hits = append(hits, hit{name, enabled})
+	})
+	var checks int
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks++
+	})
+
+	ctx := Override(context.Background(), "test", false)
+	ctx = Override(ctx, "go.missing", true)
+	assert.False(t, g.Enabled(ctx, "test", nil))
+	g.Enabled(ctx, "test2", nil)
+	assert.True(t, g.EnabledOrDefault(ctx, "go.missing", nil, false))
+	assert.Equal(t, []hit{{"test", false}, {"go.missing", true}}, hits)
+	assert.Equal(t, 3, checks)
+
+	// Export, Explain and the admin handler don't count as hits
+	g.SetGlobalOverride("test", true)
+	_, err := g.Export([]map[string]string{{}})
+	assert.NoError(t, err)
+	_, err = g.Explain(ctx, "test", nil)
+	assert.NoError(t, err)
+	g.AdminHandler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/flags", nil))
+	assert.Len(t, hits, 2)
+}
+
 func TestMatchListRule(t *testing.T) {
 
 	var r = MatchListRule{"host_name", []string{"apibox_123", "apibox_456", "apibox_789"}}
@@ -179,7 +556,7 @@ func TestRateRule(t *testing.T) {
 	var r = RateRule{0.5, []string{"a", "b", "c"}}
 	for a := 0; a < 100; a++ {
 		for b := 0; b < 100; b++ {
-			props := map[string]string{"a": string(a), "b": string(b), "c": "a"}
+			props := map[string]string{"a": string(rune(a)), "b": string(rune(b)), "c": "a"}
 			match, err := r.Handle("test", props)
 			assert.Nil(t, err)
 			if match {
@@ -194,7 +571,7 @@ func TestRateRule(t *testing.T) {
 
 	for a := 0; a < 100; a++ {
 		for b := 0; b < 100; b++ {
-			props := map[string]string{"a": string(a), "b": string(b), "c": "a"}
+			props := map[string]string{"a": string(rune(a)), "b": string(rune(b)), "c": "a"}
 			match, err := r.Handle("test", props)
 			assert.Nil(t, err)
 			assert.Equal(t, results[resultKey{a, b}], match)
@@ -206,7 +583,7 @@ func TestRateRule(t *testing.T) {
 	disagree := 0
 	for a := 0; a < 100; a++ {
 		for b := 0; b < 100; b++ {
-			props := map[string]string{"a": string(a), "b": string(b), "c": "a"}
+			props := map[string]string{"a": string(rune(a)), "b": string(rune(b)), "c": "a"}
 			match, err := r.Handle("test2", props)
 			assert.Nil(t, err)
 			if results[resultKey{a, b}] != match {
@@ -223,223 +600,2094 @@ func TestRateRule(t *testing.T) {
 	assert.Error(t, err)
 }
 
-type OnRule struct{}
-type OffRule struct{}
-
-func (r *OnRule) Handle(flag string, props map[string]string) (bool, error) {
-	return true, nil
-}
+func TestRateRuleMonotonic(t *testing.T) {
+	t.Parallel()
 
-func (r *OffRule) Handle(flag string, props map[string]string) (bool, error) {
-	return false, nil
+	// Raising the rate of a sticky rollout should only ever add users
+	enabled := map[int]bool{}
+	for _, rate := range []float64{0.1, 0.2, 0.3, 0.4, 0.5} {
+		r := RateRule{rate, []string{"user"}}
+		count := 0
+		for user := 0; user < 10000; user++ {
+			match, err := r.Handle("test", map[string]string{"user": strconv.Itoa(user)})
+			assert.Nil(t, err)
+			if enabled[user] {
+				assert.True(t, match, "user %d lost access at rate %v", user, rate)
+			}
+			if match {
+				enabled[user] = true
+				count++
+			}
+		}
+		assert.InDelta(t, rate*10000, count, 200)
+	}
 }
 
-type dummyRulesBackend struct{}
+func TestRateRuleMultipleProperties(t *testing.T) {
+	t.Parallel()
 
-func (b *dummyRulesBackend) Refresh() ([]Flag, time.Time, error) {
-	var flags = []Flag{
-		Flag{
-			"test1",
-			true,
-			[]RuleInfo{
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test2",
-			true,
-			[]RuleInfo{
-				{&OnRule{}, RuleOff, RuleOn},
-			},
-			nil,
-		},
-		Flag{
-			"test3",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOn, RuleContinue},
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test4",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOn, RuleOff},
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test5",
-			true,
-			[]RuleInfo{
-				{&OnRule{}, RuleContinue, RuleOn},
-				{&OffRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test6",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOff, RuleContinue},
-				{&OffRule{}, RuleContinue, RuleOff},
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test7",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOff, RuleContinue},
-				{&OnRule{}, RuleContinue, RuleOff},
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test8",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOff, RuleContinue},
-				{&OffRule{}, RuleOn, RuleContinue},
-				{&OnRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test9",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOff, RuleContinue},
-				{&OffRule{}, RuleOn, RuleContinue},
-				{&OffRule{}, RuleOn, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test10",
-			true,
-			[]RuleInfo{
-				{&OffRule{}, RuleOn, RuleContinue},
-				{&OffRule{}, RuleOn, RuleOff},
-				{&OnRule{}, RuleContinue, RuleOff},
-			},
-			nil,
-		},
-		Flag{
-			"test11",
-			true,
-			[]RuleInfo{},
-			nil,
-		},
-		Flag{
-			"test12",
-			false,
-			[]RuleInfo{
-				{&OnRule{}, RuleOn, RuleOn},
-			},
-			nil,
-		},
+	// The values are hashed together, in order of property name, so each
+	// combination is always bucketed the same way
+	r := RateRule{Rate: 0.2, Properties: []string{"device_id", "account_id"}}
+	reordered := RateRule{Rate: 0.2, Properties: []string{"account_id", "device_id"}}
+	for i := 0; i < 10; i++ {
+		for device, expected := range map[string]bool{"dev_456": false, "dev_789": true} {
+			props := map[string]string{"account_id": "acct_123", "device_id": device}
+			match, err := r.Handle("go.rollout", props)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, match, device)
+			match, err = reordered.Handle("go.rollout", props)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, match, device)
+		}
 	}
-	return flags, time.Time{}, nil
+	x, err := hashProperties(sha1Hash, "go.rollout", r.Properties, map[string]string{"account_id": "acct_123", "device_id": "dev_456"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(950835916), uint32(x>>32))
+
+	// Missing any of them is an error naming it
+	_, err = r.Handle("go.rollout", map[string]string{"account_id": "acct_123"})
+	assert.EqualError(t, err, "No property device_id in properties map or default tags.")
 }
 
-func TestCascadingRules(t *testing.T) {
+func TestRateRuleBoundaries(t *testing.T) {
 	t.Parallel()
 
-	g, _ := testGoforit(DefaultInterval, &dummyRulesBackend{}, enabledTickerInterval)
-	defer g.Close()
+	// The extremes of each sampler
+	samplers := []sampler{
+		{rand: func() float64 { return 0 }, hash: func(string) uint64 { return 0 }},
+		{rand: func() float64 { return math.Nextafter(1, 0) }, hash: func(string) uint64 { return math.MaxUint64 }},
+	}
+	for _, s := range samplers {
+		for _, properties := range [][]string{nil, {"user"}} {
+			off := RateRule{0, properties}
+			on := RateRule{1, properties}
+			props := map[string]string{"user": "alice"}
+			match, err := off.handleSample(s, "test", props)
+			assert.NoError(t, err)
+			assert.False(t, match)
+			match, err = on.handleSample(s, "test", props)
+			assert.NoError(t, err)
+			assert.True(t, match)
+		}
+	}
 
-	// test match on, miss off single rule
-	assert.True(t, g.Enabled(context.Background(), "test1", nil))
+	// And many real draws
+	off := RateRule{Rate: 0}
+	on := RateRule{Rate: 1}
+	for i := 0; i < 10000; i++ {
+		match, _ := off.Handle("test", nil)
+		assert.False(t, match)
+		match, _ = on.Handle("test", nil)
+		assert.True(t, match)
+	}
+}
 
-	// test match off, miss on single rule
-	assert.False(t, g.Enabled(context.Background(), "test2", nil))
+// A source of secure random numbers
+type cryptoSource struct{}
 
-	// test match on, miss continue
-	assert.True(t, g.Enabled(context.Background(), "test3", nil))
+func (s cryptoSource) Int63() int64 {
+	var buf [8]byte
+	if _, err := cryptorand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return int64(binary.BigEndian.Uint64(buf[:]) &^ (1 << 63))
+}
 
-	// test match on, miss off
-	assert.False(t, g.Enabled(context.Background(), "test4", nil))
+func (s cryptoSource) Seed(seed int64) {}
 
-	// test match continue
-	assert.False(t, g.Enabled(context.Background(), "test5", nil))
+func TestBucketRule(t *testing.T) {
+	t.Parallel()
 
-	// test 3 rules -- 2nd rule off
-	assert.False(t, g.Enabled(context.Background(), "test6", nil))
+	// Known buckets, from sha1 computed elsewhere
+	cases := []struct {
+		flag    string
+		user    string
+		buckets int
+		bucket  int
+	}{
+		{"go.beta", "alice", 0, 2545},
+		{"go.beta", "bob", 0, 5923},
+		{"go.beta", "carol", 10000, 2567},
+		{"go.other", "alice", 0, 1527},
+		{"go.beta", "alice", 100, 45},
+	}
+	for _, c := range cases {
+		r := BucketRule{Buckets: c.buckets, Properties: []string{"user"}}
+		bucket, err := r.bucket(sha1Hash, c.flag, map[string]string{"user": c.user})
+		assert.NoError(t, err)
+		assert.Equal(t, c.bucket, bucket, "%s %s", c.flag, c.user)
+	}
 
-	// test cascade to last rule (continue to last rule)
-	// must match both 2nd and 3rd rule
-	assert.True(t, g.Enabled(context.Background(), "test7", nil))
+	r := BucketRule{Rate: 0.3, Properties: []string{"user"}}
+	match, err := r.Handle("go.beta", map[string]string{"user": "alice"})
+	assert.NoError(t, err)
+	assert.True(t, match)
+	match, _ = r.Handle("go.beta", map[string]string{"user": "bob"})
+	assert.False(t, match)
+	_, err = r.Handle("go.beta", nil)
+	assert.Error(t, err)
+}
 
-	// test cascade to last rule (continue to last rule)
-	// must match either 2nd rule or 3rd rule, only 3rd on
-	assert.True(t, g.Enabled(context.Background(), "test8", nil))
+func TestSetHashFunc(t *testing.T) {
+	t.Parallel()
 
-	// test cascade to last rule (continue to last rule)
-	// must match either 2nd or 3rd, all 3 off
-	assert.False(t, g.Enabled(context.Background(), "test9", nil))
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.flags.Store("go.beta", Flag{Name: "go.beta", Active: true, Rules: []RuleInfo{
+		{&BucketRule{Rate: 0.3, Properties: []string{"user"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	props := map[string]string{"user": "bob"}
+
+	// bob is in bucket 5923 with sha1
+	assert.False(t, g.Enabled(nil, "go.beta", props))
+
+	var hashed []string
+	g.SetHashFunc(func(s string) uint64 {
+		hashed = append(hashed, s)
+		return 0
+	})
+	assert.True(t, g.Enabled(nil, "go.beta", props))
+	assert.Equal(t, []string{"go.beta\000bob"}, hashed)
+
+	// Buckets use all 64 bits of the hash, eg: to match a 64-bit hash modulo
+	// the number of buckets elsewhere
+	g.SetHashFunc(func(s string) uint64 {
+		return 1<<32 + 2999
+	})
+	assert.True(t, g.Enabled(nil, "go.beta", props))
+	g.SetHashFunc(func(s string) uint64 {
+		return 3000
+	})
+	assert.False(t, g.Enabled(nil, "go.beta", props))
+}
 
-	// test default behavior is off if all rules are "continue"
-	assert.False(t, g.Enabled(context.Background(), "test10", nil))
+func TestRampRule(t *testing.T) {
+	t.Parallel()
 
-	// test default on if no rules and active = true
-	assert.True(t, g.Enabled(context.Background(), "test11", nil))
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start.Add(-time.Hour))
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.flags.Store("go.ramp", Flag{Name: "go.ramp", Active: true, Rules: []RuleInfo{
+		{&RampRule{start, start.AddDate(0, 0, 10), []string{"user"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+
+	count := func() int {
+		n := 0
+		for user := 0; user < 1000; user++ {
+			if g.Enabled(nil, "go.ramp", map[string]string{"user": strconv.Itoa(user)}) {
+				n++
+			}
+		}
+		return n
+	}
 
-	// test return false categorically if active = false
-	assert.False(t, g.Enabled(context.Background(), "test12", nil))
-}
+	// Nobody before the ramp starts
+	assert.Equal(t, 0, count())
 
-// dummyBackend lets us test the RefreshFlags
-// by returning the flags only the second time the Refresh
-// method is called
-type dummyBackend struct {
-	// tally how many times Refresh() has been called
-	refreshedCount int
+	// Increasing during it
+	clock.Set(start.AddDate(0, 0, 2))
+	assert.InDelta(t, 200, count(), 50)
+	clock.Set(start.AddDate(0, 0, 5))
+	assert.InDelta(t, 500, count(), 50)
+
+	// Everyone after
+	clock.Set(start.AddDate(0, 0, 10))
+	assert.Equal(t, 1000, count())
 }
 
-func (b *dummyBackend) Refresh() ([]Flag, time.Time, error) {
-	defer func() {
-		b.refreshedCount++
-	}()
+func TestSetRandSource(t *testing.T) {
+	t.Parallel()
 
-	if b.refreshedCount == 0 {
-		return []Flag{}, time.Time{}, nil
+	sample := func(g *goforit) []bool {
+		g.flags.Store("go.sampled", Flag{Name: "go.sampled", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
+		var results []bool
+		for i := 0; i < 100; i++ {
+			results = append(results, g.Enabled(nil, "go.sampled", nil))
+		}
+		return results
 	}
 
-	f, err := os.Open(filepath.Join("fixtures", "flags_example.csv"))
-	if err != nil {
-		return nil, time.Time{}, err
-	}
-	defer f.Close()
-	return parseFlagsCSV(f)
+	// The same seed samples the same way
+	g1, _ := testGoforit(0, nil, enabledTickerInterval)
+	g1.SetRandSource(rand.NewSource(seed))
+	g2, _ := testGoforit(0, nil, enabledTickerInterval)
+	g2.SetRandSource(rand.NewSource(seed))
+	expected := sample(g1)
+	assert.Equal(t, expected, sample(g2))
+
+	// But a secure source doesn't
+	g3, _ := testGoforit(0, nil, enabledTickerInterval)
+	g3.SetRandSource(cryptoSource{})
+	assert.NotEqual(t, expected, sample(g3))
 }
 
-func TestRefresh(t *testing.T) {
+func TestEnabledSeeded(t *testing.T) {
 	t.Parallel()
 
-	backend := &dummyBackend{}
-	g, _ := testGoforit(10*time.Millisecond, backend, enabledTickerInterval)
-
-	assert.False(t, g.Enabled(context.Background(), "go.sun.money", nil))
-	assert.False(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
-
-	defer g.Close()
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.flags.Store("go.sampled", Flag{Name: "go.sampled", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
 
-	// ensure refresh runs twice to avoid race conditions
-	// in which the Refresh method returns but the assertions get called
-	// before the flags are actually updated
-	for backend.refreshedCount < 2 {
-		<-time.After(10 * time.Millisecond)
+	for seed := int64(0); seed < 100; seed++ {
+		expected := rand.New(rand.NewSource(seed)).Float64() < 0.5
+		assert.Equal(t, expected, g.EnabledSeeded(nil, "go.sampled", nil, seed))
+		assert.Equal(t, expected, g.EnabledSeeded(nil, "go.sampled", nil, seed))
 	}
 
-	assert.False(t, g.Enabled(context.Background(), "go.sun.money", nil))
-	assert.True(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+	// Our own source wasn't used
+	assert.Equal(t, rand.New(rand.NewSource(seed)).Float64(), g.rand())
+}
+
+func TestValue(t *testing.T) {
+	t.Parallel()
+
+	var flags []Flag
+	err := json.Unmarshal([]byte(`[
+		{"name": "go.timeout", "active": true, "value": "30"},
+		{"name": "go.batch_size", "active": false, "value": "100"},
+		{"name": "go.users", "active": true, "value": "big", "rules": [
+			{"type": "match_list", "property": "user", "values": ["alice"], "on_match": "on", "on_miss": "off"}
+		]},
+		{"name": "go.boolean", "active": true}
+	]`), &flags)
+	assert.NoError(t, err)
+	g, _ := testGoforit(0, &dummyFlagsBackend{flags}, enabledTickerInterval)
+	defer g.Close()
+
+	value := func(name string, properties map[string]string) (string, bool, error) {
+		return g.Value(nil, name, properties)
+	}
+	assertValue := func(expected, name string, properties map[string]string) {
+		v, ok, err := value(name, properties)
+		assert.Equal(t, expected, v, name)
+		assert.True(t, ok)
+		assert.NoError(t, err)
+	}
+	assertValue("30", "go.timeout", nil)
+	assertValue("", "go.batch_size", nil)
+	assertValue("big", "go.users", map[string]string{"user": "alice"})
+	assertValue("", "go.users", map[string]string{"user": "bob"})
+	assertValue("true", "go.boolean", nil)
+	g.SetGlobalOverride("go.boolean", false)
+	assertValue("false", "go.boolean", nil)
+
+	v, ok, err := value("go.users", nil)
+	assert.Equal(t, "", v)
+	assert.True(t, ok)
+	assert.Error(t, err)
+
+	_, ok, err = value("go.unknown", nil)
+	assert.False(t, ok)
+	assert.Equal(t, ErrUnknownFlag{"go.unknown"}, err)
+}
+
+func TestSetSalt(t *testing.T) {
+	t.Parallel()
+
+	sample := func(g *goforit, properties []string) []bool {
+		g.flags.Store("go.sampled", Flag{Name: "go.sampled", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 0.5, Properties: properties}, RuleOn, RuleOff}}, enabledTicker: time.NewTicker(time.Second)})
+		var results []bool
+		for i := 0; i < 100; i++ {
+			results = append(results, g.Enabled(nil, "go.sampled", map[string]string{"user": strconv.Itoa(i)}))
+		}
+		return results
+	}
+	agreement := func(a, b []bool) int {
+		n := 0
+		for i := range a {
+			if a[i] == b[i] {
+				n++
+			}
+		}
+		return n
+	}
+	salted := func(salt string) *goforit {
+		g, _ := testGoforit(0, nil, enabledTickerInterval)
+		g.SetRandSource(rand.NewSource(seed))
+		g.SetSalt(salt)
+		return g
+	}
+
+	for _, properties := range [][]string{nil, {"user"}} {
+		// The same salt samples the same way
+		expected := sample(salted("a"), properties)
+		assert.Equal(t, expected, sample(salted("a"), properties))
+
+		// A different salt agrees about as often as chance
+		n := agreement(expected, sample(salted("b"), properties))
+		assert.True(t, n > 30 && n < 70, "%v agreed %d times", properties, n)
+		n = agreement(expected, sample(salted(""), properties))
+		assert.True(t, n > 30 && n < 70, "%v agreed %d times", properties, n)
+	}
+}
+
+// A rule that wants an int
+type minRule struct {
+	property string
+	min      int
+}
+
+func (r *minRule) Handle(flag string, props map[string]string) (bool, error) {
+	return false, errors.New("Needs typed properties")
+}
+
+func (r *minRule) HandleTyped(flag string, props map[string]interface{}) (bool, error) {
+	v, ok := props[r.property].(int)
+	if !ok {
+		return false, fmt.Errorf("Property %s is %T, not an int", r.property, props[r.property])
+	}
+	return v >= r.min, nil
+}
+
+func TestEnabledWith(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+	g.flags.Store("go.old", Flag{Name: "go.old", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"cluster", []string{"east"}}, RuleContinue, RuleOff},
+		{&minRule{"age", 30}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	g.flags.Store("go.host", Flag{Name: "go.host", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"age", []string{"40"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+
+	assert.True(t, g.EnabledWith(context.Background(), "go.old", map[string]interface{}{"age": 40}))
+	assert.False(t, g.EnabledWith(context.Background(), "go.old", map[string]interface{}{"age": 20}))
+	assert.Empty(t, buf.String())
+
+	// Other rules see strings
+	assert.True(t, g.EnabledWith(context.Background(), "go.host", map[string]interface{}{"age": 40}))
+
+	// Default tags still apply
+	assert.False(t, g.EnabledWith(context.Background(), "go.old", map[string]interface{}{"age": 40, "cluster": "west"}))
+
+	// Without typed properties, the rule gets strings
+	assert.False(t, g.Enabled(context.Background(), "go.old", map[string]string{"age": "40"}))
+	assert.Contains(t, buf.String(), "Property age is string, not an int")
+}
+
+func TestTimeWindowRule(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2018, 4, 1, 0, 0, 0, 0, time.UTC)
+	r := TimeWindowRule{start, end}
+	matchesAt := func(now time.Time) bool {
+		match, err := r.handleAt(now, "test", nil)
+		assert.NoError(t, err)
+		return match
+	}
+	assert.False(t, matchesAt(start.Add(-time.Nanosecond)))
+	assert.True(t, matchesAt(start))
+	assert.True(t, matchesAt(end.Add(-time.Nanosecond)))
+	assert.False(t, matchesAt(end))
+
+	// Open-ended windows
+	r = TimeWindowRule{Start: start}
+	assert.False(t, matchesAt(start.Add(-time.Nanosecond)))
+	assert.True(t, matchesAt(end.Add(100*time.Hour)))
+	r = TimeWindowRule{End: end}
+	assert.True(t, matchesAt(start.Add(-100*time.Hour)))
+	assert.False(t, matchesAt(end))
+
+	// Handle uses the current time
+	r = TimeWindowRule{Start: time.Now().Add(-time.Hour), End: time.Now().Add(time.Hour)}
+	match, err := r.Handle("test", nil)
+	assert.NoError(t, err)
+	assert.True(t, match)
+	r = TimeWindowRule{End: time.Now().Add(-time.Hour)}
+	match, err = r.Handle("test", nil)
+	assert.NoError(t, err)
+	assert.False(t, match)
+}
+
+func TestScheduleRule(t *testing.T) {
+	t.Parallel()
+
+	// A Thursday
+	thu := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	r := ScheduleRule{Cron: "0 9 * * 1-5", Duration: 8 * time.Hour}
+	matchesAt := func(now time.Time) bool {
+		match, err := r.handleAt(now, "test", nil)
+		assert.NoError(t, err)
+		return match
+	}
+	assert.False(t, matchesAt(thu.Add(9*time.Hour-time.Nanosecond)))
+	assert.True(t, matchesAt(thu.Add(9*time.Hour)))
+	assert.True(t, matchesAt(thu.Add(17*time.Hour-time.Nanosecond)))
+	assert.False(t, matchesAt(thu.Add(17*time.Hour)))
+	assert.False(t, matchesAt(thu.AddDate(0, 0, 2).Add(10*time.Hour)))
+
+	// Occurrences can run past midnight
+	r = ScheduleRule{Cron: "0 22 * * *", Duration: 4 * time.Hour}
+	assert.True(t, matchesAt(thu.Add(25*time.Hour)))
+	assert.False(t, matchesAt(thu.Add(26*time.Hour)))
+
+	// Steps and lists
+	r = ScheduleRule{Cron: "*/15 10,12 * * *", Duration: time.Minute}
+	assert.True(t, matchesAt(thu.Add(10*time.Hour+45*time.Minute)))
+	assert.True(t, matchesAt(thu.Add(12*time.Hour)))
+	assert.False(t, matchesAt(thu.Add(10*time.Hour+46*time.Minute)))
+	assert.False(t, matchesAt(thu.Add(11*time.Hour)))
+
+	// A number with a step starts there, and steps to the end of the range
+	r = ScheduleRule{Cron: "5/20 10 * * *", Duration: time.Minute}
+	assert.True(t, matchesAt(thu.Add(10*time.Hour+5*time.Minute)))
+	assert.True(t, matchesAt(thu.Add(10*time.Hour+45*time.Minute)))
+	assert.False(t, matchesAt(thu.Add(10*time.Hour+15*time.Minute)))
+	assert.False(t, matchesAt(thu.Add(10*time.Hour)))
+
+	// Rare occurrences are found without looking at every minute
+	r = ScheduleRule{Cron: "30 12 29 2 *", Duration: 24 * time.Hour}
+	assert.True(t, matchesAt(time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)))
+	assert.True(t, matchesAt(time.Date(2020, 3, 1, 12, 29, 0, 0, time.UTC)))
+	assert.False(t, matchesAt(time.Date(2020, 3, 1, 12, 30, 0, 0, time.UTC)))
+	assert.False(t, matchesAt(time.Date(2020, 2, 29, 12, 29, 0, 0, time.UTC)))
+	r = ScheduleRule{Cron: "30 12 29 2 *", Duration: 3 * 365 * 24 * time.Hour}
+	assert.True(t, matchesAt(time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, matchesAt(time.Date(2023, 3, 1, 0, 0, 0, 0, time.UTC)))
+	assert.False(t, matchesAt(time.Date(2020, 2, 29, 12, 29, 0, 0, time.UTC)))
+
+	// Like cron, days match either day of month or day of week
+	r = ScheduleRule{Cron: "0 0 13 * 5", Duration: time.Minute}
+	assert.True(t, matchesAt(thu.AddDate(0, 0, 1)))
+	assert.True(t, matchesAt(thu.AddDate(0, 0, 12)))
+	assert.False(t, matchesAt(thu.AddDate(0, 0, 13)))
+
+	// Times are in the location
+	r = ScheduleRule{Cron: "0 9 * * *", Duration: time.Hour, Location: time.FixedZone("PST", -8*60*60)}
+	assert.False(t, matchesAt(thu.Add(9*time.Hour)))
+	assert.True(t, matchesAt(thu.Add(17*time.Hour)))
+
+	for _, cron := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "5-1 * * * *", "*/0 * * * *", "a * * * *"} {
+		r = ScheduleRule{Cron: cron, Duration: time.Hour}
+		_, err := r.handleAt(thu, "test", nil)
+		assert.Error(t, err, cron)
+	}
+
+	// Flags use our clock
+	clock := goforittest.NewManualClock(thu)
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.flags.Store("go.business_hours", Flag{Name: "go.business_hours", Active: true, Rules: []RuleInfo{
+		{&ScheduleRule{Cron: "0 9 * * 1-5", Duration: 8 * time.Hour}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	assert.False(t, g.Enabled(nil, "go.business_hours", nil))
+	clock.Advance(12 * time.Hour)
+	assert.True(t, g.Enabled(nil, "go.business_hours", nil))
+}
+
+func TestClock(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	backend := &dummyAgeBackend{t: start.Add(-time.Hour)}
+	g, buf := testGoforit(0, nil, time.Nanosecond)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(90 * time.Minute)
+	g.init(0, backend)
+	defer g.Close()
+
+	// The backend isn't stale yet
+	assert.Zero(t, buf.String())
+	clock.Advance(time.Hour)
+	g.RefreshFlags(backend)
+	lines := strings.Split(strings.TrimRight(buf.String(), "\n"), "\n")
+	assert.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "Backend is stale (2h0m0s)")
+	assert.Contains(t, lines[0], "1h30m")
+
+	// Refreshing is stale once the clock moves on
+	buf.Reset()
+	clock.Advance(89 * time.Minute)
+	g.Enabled(nil, "go.sun.money", nil)
+	assert.Zero(t, buf.String())
+	clock.Advance(2 * time.Minute)
+	time.Sleep(time.Millisecond) // let the enabled ticker fire
+	g.Enabled(nil, "go.sun.money", nil)
+	assert.Contains(t, buf.String(), "Refresh cycle has not run in 1h31m0s")
+
+	// Time-based rules use the clock
+	g.flags.Store("go.march", Flag{Name: "go.march", Active: true, Rules: []RuleInfo{
+		{&TimeWindowRule{start, start.AddDate(0, 1, 0)}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	assert.True(t, g.Enabled(nil, "go.march", nil))
+	clock.Set(start.AddDate(0, 1, 0))
+	assert.False(t, g.Enabled(nil, "go.march", nil))
+}
+
+func TestSeparateStalenessThresholds(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	backend := &dummyAgeBackend{t: start.Add(-time.Hour)}
+	g, buf := testGoforit(0, nil, time.Nanosecond)
+	g.SetClock(clock)
+	g.SetSourceStalenessThreshold(2 * time.Hour)
+	g.SetRefreshStalenessThreshold(time.Minute)
+	g.init(0, backend)
+	defer g.Close()
+
+	// The source is allowed to lag
+	assert.Zero(t, buf.String())
+
+	// But refreshes aren't
+	clock.Advance(2 * time.Minute)
+	time.Sleep(time.Millisecond) // let the enabled ticker fire
+	g.Enabled(nil, "go.sun.money", nil)
+	assert.Contains(t, buf.String(), "Refresh cycle has not run in 2m0s, past our threshold (1m0s)")
+
+	// Until the source gets too old
+	buf.Reset()
+	clock.Advance(time.Hour)
+	g.RefreshFlags(backend)
+	assert.Contains(t, buf.String(), "Backend is stale (2h2m0s) past our threshold (2h0m0s)")
+}
+
+func TestHealthy(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetSourceStalenessThreshold(time.Hour)
+	g.SetRefreshStalenessThreshold(time.Minute)
+
+	healthy, err := g.Healthy()
+	assert.False(t, healthy)
+	assert.EqualError(t, err, "Flags have never been refreshed")
+
+	backend := &dummyAgeBackend{t: start.Add(-30 * time.Minute)}
+	g.RefreshFlags(backend)
+	healthy, err = g.Healthy()
+	assert.True(t, healthy)
+	assert.NoError(t, err)
+
+	// Refreshes stop working
+	g.RefreshFlags(dummyErrorBackend{})
+	healthy, err = g.Healthy()
+	assert.False(t, healthy)
+	assert.EqualError(t, err, "Last refresh failed: backend is down")
+
+	// Refreshes haven't happened recently
+	g.RefreshFlags(backend)
+	clock.Advance(2 * time.Minute)
+	healthy, err = g.Healthy()
+	assert.False(t, healthy)
+	assert.EqualError(t, err, "Refresh cycle has not run in 2m0s, past our threshold (1m0s)")
+
+	// The backend's flags are old
+	clock.Advance(30 * time.Minute)
+	g.RefreshFlags(backend)
+	healthy, err = g.Healthy()
+	assert.False(t, healthy)
+	assert.EqualError(t, err, "Backend is stale (1h2m0s) past our threshold (1h0m0s)")
+}
+
+func TestFlagStalenessThresholds(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	backend := &dummyAgeBackend{}
+	g, buf := testGoforit(0, nil, time.Nanosecond)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(time.Hour)
+	g.SetFlagStalenessThresholds(map[string]time.Duration{"go.fast": time.Minute})
+	g.init(0, backend)
+	defer g.Close()
+	g.flags.Store("go.fast", Flag{Name: "go.fast", Active: true, enabledTicker: time.NewTicker(time.Nanosecond)})
+
+	// Other flags use the global threshold
+	clock.Advance(10 * time.Minute)
+	time.Sleep(time.Millisecond) // let the enabled ticker fire
+	g.Enabled(nil, "go.sun.money", nil)
+	assert.Zero(t, buf.String())
+
+	// But this flag has its own
+	g.Enabled(nil, "go.fast", nil)
+	assert.Contains(t, buf.String(), "Refresh cycle has not run in 10m0s, past the threshold for go.fast (1m0s)")
+}
+
+// countingBackend counts how many times it's refreshed
+type countingBackend struct {
+	calls int32
+}
+
+func (b *countingBackend) Refresh() ([]Flag, time.Time, error) {
+	atomic.AddInt32(&b.calls, 1)
+	return []Flag{{Name: "go.on", Active: true}}, time.Time{}, nil
+}
+
+func TestPauseRefresh(t *testing.T) {
+	t.Parallel()
+
+	backend := &countingBackend{}
+	g, _ := testGoforit(time.Millisecond, backend, enabledTickerInterval)
+	defer g.Close()
+	g.PauseRefresh()
+	// A refresh may already be in progress
+	time.Sleep(10 * time.Millisecond)
+	paused := atomic.LoadInt32(&backend.calls)
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, paused, atomic.LoadInt32(&backend.calls))
+
+	// Refreshing on demand still works
+	assert.NoError(t, g.Refresh())
+	assert.Equal(t, paused+1, atomic.LoadInt32(&backend.calls))
+
+	assert.NoError(t, g.ResumeRefresh())
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&backend.calls) > paused+2)
+}
+
+func TestPauseRefreshStaleness(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(time.Minute)
+	g.SetStaleBehavior(StaleDefault)
+	g.init(0, &dummyAgeBackend{})
+	defer g.Close()
+
+	// Paused flags aren't stale
+	g.PauseRefresh()
+	clock.Advance(time.Hour)
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.Zero(t, buf.String())
+
+	// Until we resume, which refreshes them
+	assert.NoError(t, g.ResumeRefresh())
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	clock.Advance(time.Hour)
+	assert.False(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.Contains(t, buf.String(), "using the default")
+}
+
+func TestSetErrorValuePolicy(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 1}, RuleOn, RuleOff}}},
+		{Name: "go.strict", Active: true, Rules: []RuleInfo{{&RateRule{Rate: 1}, RuleOn, RuleOff}}},
+		{Name: "go.variants", Active: true, Variants: []VariantInfo{{"control", 0}, {"treatment", 1}}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var reasons []EvalReason
+	g.SetCheckReasonCallback(func(name string, enabled bool, reason EvalReason) {
+		reasons = append(reasons, reason)
+	})
+	// A missing required tag is an error, but the flag still has a value
+	g.RequireTags("user")
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	assert.True(t, g.Enabled(nil, "go.strict", nil))
+
+	g.SetFlagErrorValuePolicies(map[string]ErrorValuePolicy{"go.strict": PreferDefault})
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	assert.False(t, g.Enabled(nil, "go.strict", nil))
+	assert.True(t, g.Enabled(nil, "go.strict", map[string]string{"user": "alice"}))
+
+	g.SetErrorValuePolicy(PreferDefault)
+	g.SetFlagErrorValuePolicies(map[string]ErrorValuePolicy{"go.strict": PreferValue})
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	assert.True(t, g.Enabled(nil, "go.strict", nil))
+	variant, _ := g.Variant(nil, "go.variants", nil)
+	assert.Equal(t, "control", variant)
+	variant, _ = g.Variant(nil, "go.variants", map[string]string{"user": "alice"})
+	assert.Equal(t, "treatment", variant)
+	assert.Equal(t, []EvalReason{
+		ReasonEvaluated, ReasonEvaluated,
+		ReasonEvaluated, ReasonError, ReasonEvaluated,
+		ReasonError, ReasonEvaluated, ReasonError, ReasonEvaluated,
+	}, reasons)
+
+	// Errors that don't make the value wrong are only reported
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	g.AddLockedTags(map[string]string{"user": "alice"})
+	assert.True(t, g.Enabled(nil, "go.on", map[string]string{"user": "bob"}))
+	g.SetTagCardinalityGuard(1, true)
+	assert.True(t, g.Enabled(nil, "go.on", map[string]string{"zone": "a"}))
+	assert.Equal(t, []error{
+		ErrLockedTag{Flag: "go.on", Tag: "user"},
+		ErrTagCardinality{Flag: "go.on", Count: 2, Max: 1},
+	}, errs)
+}
+
+func TestOnMissingTag(t *testing.T) {
+	t.Parallel()
+
+	hashed := func(name string, policy MissingTagPolicy, rate float64) Flag {
+		return Flag{Name: name, Active: true, OnMissingTag: policy, Rules: []RuleInfo{
+			{&RateRule{Rate: rate, Properties: []string{"user"}}, RuleOn, RuleOff},
+		}}
+	}
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		hashed("go.error", MissError, 1),
+		hashed("go.random_on", MissRandom, 1),
+		hashed("go.random_off", MissRandom, 0),
+		hashed("go.false", MissFalse, 1),
+		hashed("go.true", MissTrue, 0),
+		{Name: "go.bucket", Active: true, OnMissingTag: MissTrue, Rules: []RuleInfo{
+			{&BucketRule{Rate: 0, Properties: []string{"user"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var handled []string
+	g.SetErrorHandler(func(name string, err error) {
+		handled = append(handled, name)
+		assert.Contains(t, err.Error(), "No property user")
+	})
+
+	assert.False(t, g.Enabled(nil, "go.error", nil))
+	assert.True(t, g.Enabled(nil, "go.random_on", nil))
+	assert.False(t, g.Enabled(nil, "go.random_off", nil))
+	assert.False(t, g.Enabled(nil, "go.false", nil))
+	assert.True(t, g.Enabled(nil, "go.true", nil))
+	assert.True(t, g.Enabled(nil, "go.bucket", nil))
+	// Every missing property is reported, whatever the policy
+	assert.Equal(t, []string{"go.error", "go.random_on", "go.random_off", "go.false", "go.true", "go.bucket"}, handled)
+
+	// With the property, the policy doesn't matter
+	handled = nil
+	props := map[string]string{"user": "alice"}
+	assert.True(t, g.Enabled(nil, "go.false", props))
+	assert.False(t, g.Enabled(nil, "go.true", props))
+	assert.Empty(t, handled)
+
+	// A handled missing property isn't a failed evaluation
+	g.SetErrorValuePolicy(PreferDefault)
+	assert.True(t, g.Enabled(nil, "go.true", nil))
+	assert.False(t, g.Enabled(nil, "go.error", nil))
+}
+
+func TestMatchListMissingTag(t *testing.T) {
+	t.Parallel()
+
+	list := func(name string, policy MissingTagPolicy, onMatch, onMiss RuleAction) Flag {
+		return Flag{Name: name, Active: true, OnMissingTag: policy, Rules: []RuleInfo{
+			{&MatchListRule{Property: "user", Values: []string{"xavier"}}, onMatch, onMiss},
+		}}
+	}
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		list("go.allow", MissError, RuleOn, RuleOff),
+		list("go.block", MissFalse, RuleOff, RuleOn),
+		list("go.block_error", MissError, RuleOff, RuleOn),
+		list("go.random", MissRandom, RuleOn, RuleOff),
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+
+	// A blocklist is on without the property, and the missing tag is reported
+	assert.True(t, g.Enabled(nil, "go.block", nil))
+	assert.Equal(t, []error{ErrMissingTag{Flag: "go.block", Tag: "user"}}, errs)
+	assert.True(t, g.Enabled(nil, "go.block", map[string]string{"user": "alice"}))
+	assert.False(t, g.Enabled(nil, "go.block", map[string]string{"user": "xavier"}))
+
+	// Without a policy, a missing property is an error
+	errs = nil
+	assert.False(t, g.Enabled(nil, "go.allow", nil))
+	assert.False(t, g.Enabled(nil, "go.block_error", nil))
+	assert.Len(t, errs, 2)
+	assert.Contains(t, errs[0].Error(), "No property user")
+
+	// Random doesn't match a list
+	errs = nil
+	assert.False(t, g.Enabled(nil, "go.random", nil))
+	assert.Equal(t, []error{ErrMissingTag{Flag: "go.random", Tag: "user"}}, errs)
+}
+
+func TestStaleBehavior(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(time.Hour)
+	g.SetFlagStalenessThresholds(map[string]time.Duration{"go.fast": time.Minute})
+	g.SetStaleBehavior(StaleDefault)
+	g.SetFlagStaleBehaviors(map[string]StaleBehavior{"go.serve": StaleServe})
+	g.init(0, &dummyAgeBackend{})
+	defer g.Close()
+	for _, name := range []string{"go.fast", "go.serve"} {
+		g.flags.Store(name, Flag{Name: name, Active: true, enabledTicker: time.NewTicker(time.Hour)})
+	}
+	var checks []bool
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks = append(checks, enabled)
+	})
+
+	// Fresh flags are used
+	clock.Advance(10 * time.Second)
+	assert.True(t, g.Enabled(nil, "go.fast", nil))
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.Zero(t, buf.String())
+
+	// Past its threshold, a flag is off
+	clock.Advance(10 * time.Minute)
+	assert.False(t, g.Enabled(nil, "go.fast", nil))
+	assert.Contains(t, buf.String(), "past the threshold for go.fast (1m0s), using the default")
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.True(t, g.Enabled(nil, "go.serve", nil))
+
+	clock.Advance(time.Hour)
+	assert.False(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.True(t, g.Enabled(nil, "go.serve", nil))
+	assert.Equal(t, []bool{true, true, false, true, true, false, true}, checks)
+
+	// Overrides still apply
+	ctx := Override(context.Background(), "go.fast", true)
+	assert.True(t, g.Enabled(ctx, "go.fast", nil))
+}
+
+func TestPrerequisiteRule(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	store := func(name string, active bool, rules ...RuleInfo) {
+		g.flags.Store(name, Flag{Name: name, Active: active, Rules: rules, enabledTicker: time.NewTicker(time.Second)})
+	}
+	prereqs := func(flags ...string) RuleInfo {
+		return RuleInfo{&PrerequisiteRule{flags}, RuleContinue, RuleOff}
+	}
+	store("go.on", true)
+	store("go.off", false)
+	store("go.user", true, RuleInfo{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff})
+	store("go.child", true, prereqs("go.on", "go.user"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+	store("go.grandchild", true, prereqs("go.child"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+	store("go.orphan", true, prereqs("go.off"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+
+	alice := map[string]string{"user": "alice"}
+	bob := map[string]string{"user": "bob"}
+	assert.True(t, g.Enabled(nil, "go.child", alice))
+	assert.False(t, g.Enabled(nil, "go.child", bob))
+	assert.True(t, g.Enabled(nil, "go.grandchild", alice))
+	assert.False(t, g.Enabled(nil, "go.grandchild", bob))
+	assert.False(t, g.Enabled(nil, "go.orphan", alice))
+	assert.Zero(t, buf.String())
+
+	// Overrides apply to prerequisites
+	ctx := Override(context.Background(), "go.user", true)
+	assert.True(t, g.Enabled(ctx, "go.grandchild", bob))
+	ctx = Override(context.Background(), "go.on", false)
+	assert.False(t, g.Enabled(ctx, "go.grandchild", alice))
+
+	// Unknown prerequisites are an error
+	store("go.unknown", true, prereqs("go.nope"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+	assert.False(t, g.Enabled(nil, "go.unknown", nil))
+	assert.Contains(t, buf.String(), ErrUnknownFlag{"go.nope"}.Error())
+
+	// Cycles don't recurse forever
+	buf.Reset()
+	store("go.cycle1", true, prereqs("go.cycle2"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+	store("go.cycle2", true, prereqs("go.cycle1"), RuleInfo{&OnRule{}, RuleOn, RuleOff})
+	assert.False(t, g.Enabled(nil, "go.cycle1", nil))
+	assert.Contains(t, buf.String(), "cycle")
+}
+
+type OnRule struct{}
+type OffRule struct{}
+
+func (r *OnRule) Handle(flag string, props map[string]string) (bool, error) {
+	return true, nil
+}
+
+func (r *OffRule) Handle(flag string, props map[string]string) (bool, error) {
+	return false, nil
+}
+
+// ctxRule matches if the context has a value for its key
+type ctxRule struct {
+	key string
+}
+
+func (r *ctxRule) Handle(flag string, props map[string]string) (bool, error) {
+	return false, nil
+}
+
+func (r *ctxRule) HandleContext(ctx context.Context, flag string, props map[string]string) (bool, error) {
+	return ctx.Value(r.key) != nil, nil
+}
+
+type dummyContextBackend struct{}
+
+func (b *dummyContextBackend) Refresh() ([]Flag, time.Time, error) {
+	return []Flag{
+		{Name: "go.ctx", Active: true, Rules: []RuleInfo{{&ctxRule{"user"}, RuleOn, RuleOff}}},
+		{Name: "go.on", Active: true},
+	}, time.Time{}, nil
+}
+
+func TestContextRule(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, &dummyContextBackend{}, enabledTickerInterval)
+	defer g.Close()
+
+	// Context rules see the context passed to Enabled
+	assert.False(t, g.Enabled(nil, "go.ctx", nil))
+	assert.False(t, g.Enabled(context.Background(), "go.ctx", nil))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "user", "alice"))
+	assert.True(t, g.Enabled(ctx, "go.ctx", nil))
+	assert.True(t, g.Enabled(ctx, "go.on", nil))
+	assert.Zero(t, buf.String())
+
+	// Nothing is enabled once the context is cancelled
+	cancel()
+	assert.False(t, g.Enabled(ctx, "go.ctx", nil))
+	assert.False(t, g.Enabled(ctx, "go.on", nil))
+	assert.Contains(t, buf.String(), context.Canceled.Error())
+
+	// But overrides still apply
+	assert.True(t, g.Enabled(Override(ctx, "go.on", true), "go.on", nil))
+}
+
+// slowRule takes a while to match
+type slowRule struct{}
+
+func (r *slowRule) Handle(flag string, props map[string]string) (bool, error) {
+	time.Sleep(10 * time.Millisecond)
+	return true, nil
+}
+
+func TestLatencyCallback(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.slow", Flag{Name: "go.slow", Active: true, Rules: []RuleInfo{
+		{&slowRule{}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	latencies := map[string]time.Duration{}
+	g.SetLatencyCallback(func(name string, d time.Duration) {
+		latencies[name] = d
+	})
+
+	assert.True(t, g.Enabled(nil, "go.slow", nil))
+	assert.False(t, g.Enabled(nil, "go.missing", nil))
+	assert.Len(t, latencies, 2)
+	assert.True(t, latencies["go.slow"] >= 10*time.Millisecond)
+	assert.True(t, latencies["go.missing"] < 10*time.Millisecond)
+}
+
+type panicRule struct{}
+
+func (r *panicRule) Handle(flag string, props map[string]string) (bool, error) {
+	panic("oops")
+}
+
+func TestRulePanic(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.panic", Flag{Name: "go.panic", Active: true, Rules: []RuleInfo{
+		{&panicRule{}, RuleOn, RuleOn},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	var handled error
+	g.SetErrorHandler(func(name string, err error) {
+		handled = err
+	})
+
+	assert.False(t, g.Enabled(nil, "go.panic", nil))
+	assert.Error(t, handled)
+	assert.Contains(t, handled.Error(), "rule for flag go.panic panicked: oops")
+	assert.Contains(t, handled.Error(), "goroutine")
+	assert.Contains(t, buf.String(), "rule for flag go.panic panicked: oops")
+}
+
+type dummyRulesBackend struct{}
+
+func (b *dummyRulesBackend) Refresh() ([]Flag, time.Time, error) {
+	var flags = []Flag{
+		Flag{
+			Name:   "test1",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test2",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OnRule{}, RuleOff, RuleOn},
+			},
+		},
+		Flag{
+			Name:   "test3",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOn, RuleContinue},
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test4",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOn, RuleOff},
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test5",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OnRule{}, RuleContinue, RuleOn},
+				{&OffRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test6",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOff, RuleContinue},
+				{&OffRule{}, RuleContinue, RuleOff},
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test7",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOff, RuleContinue},
+				{&OnRule{}, RuleContinue, RuleOff},
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test8",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOff, RuleContinue},
+				{&OffRule{}, RuleOn, RuleContinue},
+				{&OnRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test9",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOff, RuleContinue},
+				{&OffRule{}, RuleOn, RuleContinue},
+				{&OffRule{}, RuleOn, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test10",
+			Active: true,
+			Rules: []RuleInfo{
+				{&OffRule{}, RuleOn, RuleContinue},
+				{&OffRule{}, RuleOn, RuleOff},
+				{&OnRule{}, RuleContinue, RuleOff},
+			},
+		},
+		Flag{
+			Name:   "test11",
+			Active: true,
+			Rules:  []RuleInfo{},
+		},
+		Flag{
+			Name:   "test12",
+			Active: false,
+			Rules: []RuleInfo{
+				{&OnRule{}, RuleOn, RuleOn},
+			},
+		},
+	}
+	return flags, time.Time{}, nil
+}
+
+func TestCascadingRules(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(DefaultInterval, &dummyRulesBackend{}, enabledTickerInterval)
+	defer g.Close()
+
+	// test match on, miss off single rule
+	assert.True(t, g.Enabled(context.Background(), "test1", nil))
+
+	// test match off, miss on single rule
+	assert.False(t, g.Enabled(context.Background(), "test2", nil))
+
+	// test match on, miss continue
+	assert.True(t, g.Enabled(context.Background(), "test3", nil))
+
+	// test match on, miss off
+	assert.False(t, g.Enabled(context.Background(), "test4", nil))
+
+	// test match continue
+	assert.False(t, g.Enabled(context.Background(), "test5", nil))
+
+	// test 3 rules -- 2nd rule off
+	assert.False(t, g.Enabled(context.Background(), "test6", nil))
+
+	// test cascade to last rule (continue to last rule)
+	// must match both 2nd and 3rd rule
+	assert.True(t, g.Enabled(context.Background(), "test7", nil))
+
+	// test cascade to last rule (continue to last rule)
+	// must match either 2nd rule or 3rd rule, only 3rd on
+	assert.True(t, g.Enabled(context.Background(), "test8", nil))
+
+	// test cascade to last rule (continue to last rule)
+	// must match either 2nd or 3rd, all 3 off
+	assert.False(t, g.Enabled(context.Background(), "test9", nil))
+
+	// test default behavior is off if all rules are "continue"
+	assert.False(t, g.Enabled(context.Background(), "test10", nil))
+
+	// test default on if no rules and active = true
+	assert.True(t, g.Enabled(context.Background(), "test11", nil))
+
+	// test return false categorically if active = false
+	assert.False(t, g.Enabled(context.Background(), "test12", nil))
+}
+
+// dummyBackend lets us test the RefreshFlags
+// by returning the flags only the second time the Refresh
+// method is called
+type dummyBackend struct {
+	// tally how many times Refresh() has been called
+	refreshedCount int
+}
+
+func (b *dummyBackend) Refresh() ([]Flag, time.Time, error) {
+	defer func() {
+		b.refreshedCount++
+	}()
+
+	if b.refreshedCount == 0 {
+		return []Flag{}, time.Time{}, nil
+	}
+
+	f, err := os.Open(filepath.Join("fixtures", "flags_example.csv"))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer f.Close()
+	return parseFlagsCSV(f)
+}
+
+func TestRefresh(t *testing.T) {
+	t.Parallel()
+
+	backend := &dummyBackend{}
+	g, _ := testGoforit(10*time.Millisecond, backend, enabledTickerInterval)
+
+	assert.False(t, g.Enabled(context.Background(), "go.sun.money", nil))
+	assert.False(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+
+	defer g.Close()
+
+	// ensure refresh runs twice to avoid race conditions
+	// in which the Refresh method returns but the assertions get called
+	// before the flags are actually updated
+	for backend.refreshedCount < 2 {
+		<-time.After(10 * time.Millisecond)
+	}
+
+	assert.False(t, g.Enabled(context.Background(), "go.sun.money", nil))
+	assert.True(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+}
+
+func TestRefreshNow(t *testing.T) {
+	t.Parallel()
+
+	// Without a backend, there's nothing to do
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	assert.Error(t, g.Refresh())
+
+	backend := &dummyBackend{}
+	g, _ = testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	assert.False(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+
+	// No need to wait for the ticker
+	assert.NoError(t, g.Refresh())
+	assert.True(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+
+	// Errors are returned
+	g.backend = dummyErrorBackend{}
+	assert.Error(t, g.Refresh())
+	assert.True(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+}
+
+func TestStartupGrace(t *testing.T) {
+	t.Parallel()
+
+	clock := goforittest.NewManualClock(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC))
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetStartupGrace(time.Minute, map[string]bool{"go.moon.mercury": true})
+
+	// The backend is down, so use the defaults
+	g.init(0, dummyErrorBackend{})
+	defer g.Close()
+	assert.True(t, g.Enabled(nil, "go.moon.mercury", nil))
+	assert.False(t, g.Enabled(nil, "go.sun.money", nil))
+
+	// Not forever though
+	clock.Advance(time.Minute)
+	assert.False(t, g.Enabled(nil, "go.moon.mercury", nil))
+
+	// Once flags load, they're used instead
+	clock.Set(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC))
+	g.RefreshFlags(&dummyAgeBackend{})
+	assert.False(t, g.Enabled(nil, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+}
+
+func TestRefreshJitter(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	assert.Equal(t, time.Minute, g.jitterInterval(time.Minute))
+
+	g.SetRefreshJitter(0.1)
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 100; i++ {
+		interval := g.jitterInterval(time.Minute)
+		assert.InDelta(t, time.Minute, interval, float64(6*time.Second))
+		seen[interval] = true
+	}
+	assert.True(t, len(seen) > 1)
+
+	// The same seed gives the same intervals
+	g2, _ := testGoforit(0, nil, enabledTickerInterval)
+	g2.SetRefreshJitter(0.1)
+	g3, _ := testGoforit(0, nil, enabledTickerInterval)
+	g3.SetRefreshJitter(0.1)
+	assert.Equal(t, g2.jitterInterval(time.Minute), g3.jitterInterval(time.Minute))
+
+	// Never go past the staleness threshold
+	g.SetStalenessThreshold(time.Minute)
+	for i := 0; i < 100; i++ {
+		assert.True(t, g.jitterInterval(time.Minute) <= time.Minute)
+	}
+}
+
+func TestSetMinRefreshInterval(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	assert.Equal(t, time.Millisecond, g.clampInterval(time.Millisecond))
+
+	g.SetMinRefreshInterval(time.Minute)
+	assert.Equal(t, time.Hour, g.clampInterval(time.Hour))
+	assert.Equal(t, time.Duration(0), g.clampInterval(0))
+	assert.Empty(t, errs)
+	assert.Equal(t, time.Minute, g.clampInterval(time.Millisecond))
+	assert.Len(t, errs, 1)
+	assert.Contains(t, buf.String(), "Refresh interval 1ms is shorter than the minimum 1m0s")
+
+	// Jitter doesn't go below the minimum either
+	g.SetRefreshJitter(0.5)
+	for i := 0; i < 100; i++ {
+		assert.True(t, g.jitterInterval(time.Minute) >= time.Minute)
+	}
+}
+
+// slowBackend doesn't finish refreshing until it's released
+type slowBackend struct {
+	flags   []Flag
+	release chan struct{}
+}
+
+func (b *slowBackend) Refresh() ([]Flag, time.Time, error) {
+	<-b.release
+	return b.flags, time.Time{}, nil
+}
+
+func TestSetRefreshTimeout(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, &dummyFlagsBackend{[]Flag{{Name: "go.old", Active: true}}}, enabledTickerInterval)
+	defer g.Close()
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	g.SetRefreshTimeout(10 * time.Millisecond)
+
+	slow := &slowBackend{[]Flag{{Name: "go.new", Active: true}}, make(chan struct{})}
+	defer close(slow.release)
+	start := time.Now()
+	err := g.refreshFlags(slow)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Equal(t, ErrRefreshTimeout{10 * time.Millisecond}, err)
+	assert.Equal(t, []error{ErrRefreshTimeout{10 * time.Millisecond}}, errs)
+	assert.Contains(t, buf.String(), "Backend didn't refresh within 10ms")
+
+	// The flags we had are kept
+	assert.True(t, g.Enabled(nil, "go.old", nil))
+	_, ok := g.flags.Load("go.new")
+	assert.False(t, ok)
+
+	// Fast enough refreshes work as usual
+	assert.NoError(t, g.refreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.new", Active: true}}}))
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+}
+
+// dummyFlagsBackend returns whatever flags it's given
+type dummyFlagsBackend struct {
+	flags []Flag
+}
+
+func (b *dummyFlagsBackend) Refresh() ([]Flag, time.Time, error) {
+	return b.flags, time.Time{}, nil
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	assert.Empty(t, g.Stats())
+
+	for i := 0; i < 3; i++ {
+		g.Enabled(nil, "go.on", nil)
+	}
+	g.Enabled(nil, "go.users", map[string]string{"user": "alice"})
+	g.Enabled(nil, "go.users", map[string]string{"user": "bob"})
+	g.Enabled(nil, "go.users", nil)
+	g.EnabledAll(nil, []string{"go.on", "go.missing"}, nil)
+	// Quiet checks aren't counted
+	g.Explain(nil, "go.on", nil)
+	assert.Equal(t, map[string]FlagStat{
+		"go.on":      {Checks: 4, Enabled: 4},
+		"go.users":   {Checks: 3, Enabled: 1, Disabled: 2, Errors: 1},
+		"go.missing": {Checks: 1, Disabled: 1},
+	}, g.Stats())
+
+	g.ResetStats()
+	assert.Empty(t, g.Stats())
+	g.Enabled(nil, "go.on", nil)
+	assert.Equal(t, map[string]FlagStat{"go.on": {Checks: 1, Enabled: 1}}, g.Stats())
+}
+
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	_, err := g.Snapshot()
+	assert.Error(t, err)
+
+	backend := &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}
+	g.init(0, backend)
+	g.AddDefaultTags(map[string]string{"user": "alice"})
+	g.SetGlobalOverride("go.forced", true)
+
+	snap, err := g.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"go.forced", "go.on", "go.users"}, snap.Flags(nil))
+	assert.True(t, snap.Enabled(nil, "go.users", nil))
+	assert.True(t, snap.Enabled(nil, "go.forced", nil))
+
+	// Later changes to the flags, tags and overrides don't affect it
+	backend.flags = []Flag{{Name: "go.on", Active: false}}
+	assert.NoError(t, g.Refresh())
+	g.AddDefaultTags(map[string]string{"user": "bob"})
+	g.ClearGlobalOverride("go.forced")
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	assert.True(t, snap.Enabled(nil, "go.on", nil))
+	assert.True(t, snap.Enabled(nil, "go.users", nil))
+	assert.True(t, snap.Enabled(nil, "go.forced", nil))
+
+	// Nor do changes to it affect the original
+	snap.SetGlobalOverride("go.on", true)
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+
+	// They're closed independently
+	assert.NoError(t, snap.Close())
+	assert.False(t, snap.Enabled(nil, "go.on", nil))
+	assert.NoError(t, g.Refresh())
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	g.SetGlobalOverride("go.on", true)
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+}
+
+func TestSnapshotPolicies(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(time.Hour)
+	g.SetFlagStalenessThresholds(map[string]time.Duration{"go.fast": time.Minute})
+	g.SetStaleBehavior(StaleDefault)
+	g.SetFlagStaleBehaviors(map[string]StaleBehavior{"go.serve": StaleServe})
+	g.SetErrorValuePolicy(PreferDefault)
+	g.SetFlagErrorValuePolicies(map[string]ErrorValuePolicy{"go.lenient": PreferValue})
+	g.RequireTags("user")
+	sampled := []RuleInfo{{&RateRule{Rate: 1}, RuleOn, RuleOff}}
+	g.init(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.fast", Active: true},
+		{Name: "go.serve", Active: true},
+		{Name: "go.strict", Active: true, Rules: sampled},
+		{Name: "go.lenient", Active: true, Rules: sampled},
+	}})
+	defer g.Close()
+
+	snap, err := g.Snapshot()
+	assert.NoError(t, err)
+	defer snap.Close()
+
+	// The snapshot handles errors like the original
+	assert.False(t, snap.Enabled(nil, "go.strict", nil))
+	assert.True(t, snap.Enabled(nil, "go.lenient", nil))
+
+	// And staleness, since it's never refreshed
+	clock.Advance(10 * time.Minute)
+	assert.False(t, snap.Enabled(nil, "go.fast", nil))
+	assert.True(t, snap.Enabled(nil, "go.strict", map[string]string{"user": "alice"}))
+	clock.Advance(time.Hour)
+	assert.False(t, snap.Enabled(nil, "go.strict", map[string]string{"user": "alice"}))
+	assert.True(t, snap.Enabled(nil, "go.serve", nil))
+}
+
+func TestSnapshotRefresh(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetStalenessThreshold(time.Hour)
+	g.init(0, &dummyFlagsBackend{[]Flag{{Name: "go.on", Active: true}}})
+	defer g.Close()
+
+	snap, err := g.Snapshot()
+	assert.NoError(t, err)
+	defer snap.Close()
+	var errs []error
+	snap.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	dir, err := ioutil.TempDir("", "goforit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cacheFile := filepath.Join(dir, "flags.json")
+	snap.SetCacheFile(cacheFile)
+
+	// Refreshing doesn't change the flags or write the cache file
+	off := &dummyFlagsBackend{[]Flag{{Name: "go.on", Active: false}}}
+	assert.EqualError(t, snap.Refresh(), "Can't refresh a snapshot")
+	snap.RefreshFlags(off)
+	snap.PauseRefresh()
+	assert.Error(t, snap.ResumeRefresh())
+	assert.Len(t, errs, 3)
+	assert.True(t, snap.Enabled(nil, "go.on", nil))
+	_, err = os.Stat(cacheFile)
+	assert.True(t, os.IsNotExist(err))
+
+	// It's healthy until it's stale
+	ok, err := snap.Healthy()
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	clock.Advance(2 * time.Hour)
+	ok, err = snap.Healthy()
+	assert.False(t, ok)
+	assert.Contains(t, err.Error(), "Refresh cycle has not run")
+
+	// It can be described
+	assert.Contains(t, snap.String(), "backend: <nil>")
+}
+
+func TestSetAutoRollback(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.init(0, &dummyFlagsBackend{[]Flag{{Name: "go.new", Active: true}, {Name: "go.other", Active: true}}})
+	defer g.Close()
+	var rolledBack []float64
+	g.SetRollbackCallback(func(name string, failureRate float64) {
+		assert.Equal(t, "go.new", name)
+		rolledBack = append(rolledBack, failureRate)
+	})
+	g.SetAutoRollback("go.new", 0.5, time.Minute, 4)
+	report := func(name string, successes, failures int) {
+		for i := 0; i < successes; i++ {
+			g.ReportOutcome(name, true)
+		}
+		for i := 0; i < failures; i++ {
+			g.ReportOutcome(name, false)
+		}
+	}
+
+	// Too few outcomes, or few enough failures
+	report("go.new", 3, 0)
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+	report("go.new", 0, 3)
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+
+	// Old outcomes don't count
+	clock.Advance(2 * time.Minute)
+	report("go.new", 1, 1)
+	report("go.other", 0, 10)
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+	assert.True(t, g.Enabled(nil, "go.other", nil))
+	assert.Empty(t, rolledBack)
+
+	report("go.new", 0, 2)
+	assert.False(t, g.Enabled(nil, "go.new", nil))
+	assert.Equal(t, []float64{0.75}, rolledBack)
+	assert.Contains(t, buf.String(), "Rolled back flag go.new, 75% of outcomes failed")
+
+	// Once it's off, more failures don't matter
+	report("go.new", 0, 10)
+	assert.Len(t, rolledBack, 1)
+
+	// It can be enabled again, and starts afresh
+	g.ClearGlobalOverride("go.new")
+	report("go.new", 2, 1)
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+	assert.Len(t, rolledBack, 1)
+}
+
+func TestSetAutoRollbackBefore1970(t *testing.T) {
+	t.Parallel()
+
+	// A manual clock that's never been set starts at the zero time
+	clock := goforittest.NewManualClock(time.Time{})
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.init(0, &dummyFlagsBackend{[]Flag{{Name: "go.new", Active: true}}})
+	defer g.Close()
+	g.SetAutoRollback("go.new", 0.5, time.Minute, 4)
+
+	for i := 0; i < 4; i++ {
+		g.ReportOutcome("go.new", false)
+		clock.Advance(time.Second)
+	}
+	assert.False(t, g.Enabled(nil, "go.new", nil))
+}
+
+func TestSnapshotOverrides(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.a", Active: true},
+		{Name: "go.b", Active: true},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	g.SetGlobalOverride("go.a", false)
+	snapshot := g.SnapshotOverrides()
+	assert.Equal(t, map[string]bool{"go.a": false}, snapshot)
+
+	// A test case changes the overrides
+	g.ClearGlobalOverride("go.a")
+	g.SetGlobalOverride("go.b", false)
+	g.SetGlobalOverrideFunc("go.c", func(tags map[string]string) bool { return true })
+	assert.True(t, g.Enabled(nil, "go.a", nil))
+	assert.False(t, g.Enabled(nil, "go.b", nil))
+
+	// Restoring replaces all of them
+	g.RestoreOverrides(snapshot)
+	assert.Equal(t, map[string]bool{"go.a": false}, g.GlobalOverrides())
+	assert.False(t, g.Enabled(nil, "go.a", nil))
+	assert.True(t, g.Enabled(nil, "go.b", nil))
+	assert.False(t, g.Enabled(nil, "go.c", nil))
+
+	// Changing the snapshot doesn't change the overrides
+	snapshot["go.b"] = false
+	assert.True(t, g.Enabled(nil, "go.b", nil))
+	g.RestoreOverrides(nil)
+	assert.Empty(t, g.GlobalOverrides())
+}
+
+func TestSetOverrideChangeCallback(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.a", Active: true},
+		{Name: "go.b", Active: true},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	type change struct {
+		name           string
+		value, cleared bool
+		enabled        bool
+	}
+	var changes []change
+	g.SetOverrideChangeCallback(func(name string, value bool, cleared bool) {
+		// The change has already happened
+		changes = append(changes, change{name, value, cleared, g.Enabled(nil, name, nil)})
+	})
+
+	g.SetGlobalOverride("go.a", false)
+	g.SetGlobalOverride("go.a", false)
+	g.SetGlobalOverride("go.b", false)
+	g.ClearGlobalOverride("go.a")
+	g.ClearGlobalOverride("go.missing")
+	g.SetGlobalOverrideFunc("go.a", func(tags map[string]string) bool { return false })
+	g.RestoreOverrides(map[string]bool{"go.a": true})
+	assert.Equal(t, []change{
+		{"go.a", false, false, false},
+		{"go.b", false, false, false},
+		{"go.a", false, true, true},
+		{"go.a", true, false, true},
+		{"go.b", false, true, true},
+	}, changes)
+
+	// Rollbacks are changes too
+	changes = nil
+	g.SetAutoRollback("go.b", 0.5, time.Minute, 1)
+	g.ReportOutcome("go.b", false)
+	assert.Equal(t, []change{{"go.b", false, false, false}}, changes)
+}
+
+func TestSetGlobalOverrideFunc(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{{Name: "go.on", Active: true}}}, enabledTickerInterval)
+	defer g.Close()
+	var checks []bool
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks = append(checks, enabled)
+	})
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+
+	g.SetGlobalOverrideFunc("go.on", func(tags map[string]string) bool {
+		return strings.HasPrefix(tags["user"], "acct_") && tags["cluster"] == "east"
+	})
+	assert.True(t, g.Enabled(nil, "go.on", map[string]string{"user": "acct_123"}))
+	assert.False(t, g.Enabled(nil, "go.on", map[string]string{"user": "cus_123"}))
+	assert.Equal(t, []bool{true, false}, checks)
+	assert.Equal(t, []string{"go.on"}, g.Flags(nil))
+
+	// Unknown flags can be overridden, and the context takes precedence
+	g.SetGlobalOverrideFunc("go.new", func(tags map[string]string) bool { return true })
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+	assert.False(t, g.Enabled(Override(context.Background(), "go.new", false), "go.new", nil))
+
+	// A value replaces the function, and clearing removes both
+	g.SetGlobalOverride("go.on", false)
+	assert.False(t, g.Enabled(nil, "go.on", map[string]string{"user": "acct_123"}))
+	g.SetGlobalOverrideFunc("go.on", func(tags map[string]string) bool { return false })
+	assert.Empty(t, g.GlobalOverrides())
+	g.ClearGlobalOverride("go.on")
+	g.ClearGlobalOverride("go.new")
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	assert.False(t, g.Enabled(nil, "go.new", nil))
+
+	// Functions can't change the tags, and panics are reported
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	g.SetGlobalOverrideFunc("go.on", func(tags map[string]string) bool {
+		tags["cluster"] = "west"
+		panic("oops")
+	})
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "override for flag go.on panicked: oops")
+	g.SetGlobalOverrideFunc("go.on", func(tags map[string]string) bool {
+		return tags["cluster"] == "east"
+	})
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+}
+
+func TestEnabledByPrefix(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "checkout.on", Active: true},
+		{Name: "checkout.off", Active: false},
+		{Name: "search.on", Active: true},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var checked []string
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checked = append(checked, name)
+	})
+
+	ctx := Override(context.Background(), "checkout.new", true)
+	assert.Equal(t, map[string]bool{"checkout.on": true, "checkout.off": false, "checkout.new": true},
+		g.EnabledByPrefix(ctx, "checkout.", nil))
+	assert.Equal(t, []string{"checkout.new", "checkout.off", "checkout.on"}, checked)
+	assert.Empty(t, g.EnabledByPrefix(ctx, "billing.", nil))
+}
+
+func TestSetCacheFile(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "goforit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "flags.json")
+
+	// Nothing to load yet, but the flags are written
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetCacheFile(path)
+	g.init(0, &dummyAgeBackend{t: time.Unix(1519247256, 0)})
+	g.Close()
+	assert.Zero(t, buf.String())
+
+	// If the backend fails, the cached flags are used
+	g, buf = testGoforit(0, nil, enabledTickerInterval)
+	g.SetCacheFile(path)
+	g.init(0, dummyErrorBackend{})
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	ex, _ := g.Explain(nil, "go.sun.money", nil)
+	assert.True(t, ex.Age > time.Hour)
+	healthy, _ := g.Healthy()
+	assert.False(t, healthy)
+	assert.Contains(t, buf.String(), "backend is down")
+	g.Close()
+
+	// A corrupt file is reported
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+	g, buf = testGoforit(0, nil, enabledTickerInterval)
+	g.SetCacheFile(path)
+	g.init(0, dummyErrorBackend{})
+	assert.False(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.Contains(t, buf.String(), "Error loading flag cache: ")
+	g.Close()
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.off", Active: false},
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	g.RefreshFlags(g.backend)
+	var checks int
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks++
+	})
+
+	results, err := g.Export([]map[string]string{
+		{"user": "alice", "cluster": "east"},
+		{"user": "bob"},
+		{},
+	})
+	assert.Equal(t, map[string]map[string]bool{
+		"go.on":    {"cluster=east,user=alice": true, "user=bob": true, "": true},
+		"go.off":   {"cluster=east,user=alice": false, "user=bob": false, "": false},
+		"go.users": {"cluster=east,user=alice": true, "user=bob": false},
+	}, results)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "go.users []: ")
+	assert.Equal(t, 0, checks)
+	assert.Empty(t, buf.String())
+	_, ok := g.LastTags("go.users")
+	assert.False(t, ok)
+}
+
+func TestExplain(t *testing.T) {
+	t.Parallel()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.init(0, &dummyAgeBackend{t: start.Add(-time.Hour)})
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+	g.flags.Store("go.users", Flag{Name: "go.users", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	var checks int
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checks++
+	})
+	clock.Advance(time.Minute)
+
+	ex, err := g.Explain(nil, "go.users", map[string]string{"user": "alice"})
+	assert.NoError(t, err)
+	assert.Equal(t, Explanation{
+		Enabled: true,
+		Source:  SourceBackend,
+		Age:     time.Hour + time.Minute,
+		Tags:    map[string]string{"user": "alice", "cluster": "east"},
+	}, ex)
+
+	ctx := Override(context.Background(), "go.users", false)
+	ex, err = g.Explain(ctx, "go.users", map[string]string{"user": "alice"})
+	assert.NoError(t, err)
+	assert.False(t, ex.Enabled)
+	assert.Equal(t, SourceOverride, ex.Source)
+	assert.Equal(t, ReasonOverride, ex.Reason)
+
+	ex, err = g.Explain(nil, "go.missing", nil)
+	assert.NoError(t, err)
+	assert.False(t, ex.Enabled)
+	assert.Equal(t, "default", ex.Source.String())
+
+	ex, err = g.Explain(nil, "go.users", nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "No property user")
+	assert.False(t, ex.Enabled)
+
+	assert.Equal(t, 0, checks)
+	assert.Empty(t, buf.String())
+}
+
+func TestSimulateOverride(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.users", Flag{Name: "go.users", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	check := func(users ...string) {
+		for _, user := range users {
+			g.Enabled(nil, "go.users", map[string]string{"user": user})
+		}
+	}
+
+	_, err := g.SimulateOverride("go.users", true)
+	assert.Error(t, err)
+
+	g.SetCheckHistory(4)
+	affected, err := g.SimulateOverride("go.users", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, affected)
+	_, err = g.SimulateOverride("go.missing", true)
+	assert.Equal(t, ErrUnknownFlag{"go.missing"}, err)
+
+	check("alice", "bob", "carol")
+	affected, _ = g.SimulateOverride("go.users", true)
+	assert.Equal(t, 2, affected)
+	affected, _ = g.SimulateOverride("go.users", false)
+	assert.Equal(t, 1, affected)
+
+	// Only the most recent checks are kept
+	check("alice", "alice", "alice")
+	affected, _ = g.SimulateOverride("go.users", true)
+	assert.Equal(t, 1, affected)
+
+	// Simulating doesn't change anything
+	assert.False(t, g.Enabled(nil, "go.users", map[string]string{"user": "bob"}))
+}
+
+func TestSetAliases(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.new", Flag{Name: "go.new", Active: true, Metadata: map[string]string{"owner": "payments"}, enabledTicker: time.NewTicker(time.Second)})
+	g.SetAliases(map[string]string{"go.old": "go.new", "go.gone": "go.missing"})
+	var checked []string
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checked = append(checked, name)
+	})
+	var unknown []string
+	g.SetUnknownFlagHandler(func(name string) {
+		unknown = append(unknown, name)
+	})
+
+	assert.True(t, g.Enabled(nil, "go.old", nil))
+	assert.True(t, g.Enabled(nil, "go.new", nil))
+	assert.False(t, g.Enabled(nil, "go.gone", nil))
+	assert.Equal(t, []string{"go.old", "go.new", "go.gone"}, checked)
+	assert.Equal(t, []string{"go.missing"}, unknown)
+
+	metadata, err := g.Metadata("go.old")
+	assert.NoError(t, err)
+	assert.Equal(t, "payments", metadata["owner"])
+
+	// Overrides use the real name
+	ctx := Override(context.Background(), "go.new", false)
+	assert.False(t, g.Enabled(ctx, "go.old", nil))
+
+	// So do errors
+	var errored []string
+	g.SetErrorHandler(func(name string, err error) {
+		errored = append(errored, name)
+	})
+	g.Close()
+	assert.False(t, g.Enabled(nil, "go.old", nil))
+	assert.Equal(t, []string{"go.new"}, errored)
+}
+
+func TestWatch(t *testing.T) {
+	t.Parallel()
+
+	backend := &dummyFlagsBackend{[]Flag{
+		{Name: "go.sun.money", Active: true},
+		{Name: "go.moon.mercury", Active: true},
+	}}
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	ch := g.Watch()
+
+	// Nothing changed
+	g.RefreshFlags(backend)
+	select {
+	case change := <-ch:
+		t.Fatalf("Unexpected change %v", change)
+	default:
+	}
+
+	backend.flags = []Flag{
+		{Name: "go.sun.money", Active: false},
+		{Name: "go.stars.money", Active: true},
+	}
+	g.RefreshFlags(backend)
+	changes := map[string]FlagChange{}
+	for i := 0; i < 3; i++ {
+		change := <-ch
+		changes[change.Name] = change
+	}
+	assert.Equal(t, map[string]FlagChange{
+		"go.sun.money":    {"go.sun.money", Flag{Name: "go.sun.money", Active: true}, Flag{Name: "go.sun.money", Active: false}},
+		"go.stars.money":  {"go.stars.money", Flag{}, Flag{Name: "go.stars.money", Active: true}},
+		"go.moon.mercury": {"go.moon.mercury", Flag{Name: "go.moon.mercury", Active: true}, Flag{}},
+	}, changes)
+
+	// A slow watcher loses the oldest changes, rather than blocking refreshes
+	slow := g.Watch()
+	for i := 0; i <= watchBufferSize; i++ {
+		backend.flags = []Flag{{Name: "go.sun.money", Rules: []RuleInfo{{&RateRule{Rate: float64(i)}, RuleOn, RuleOff}}}}
+		g.RefreshFlags(backend)
+	}
+	assert.Len(t, slow, watchBufferSize)
+	change := <-slow
+	assert.Equal(t, 1.0, change.New.Rules[0].Rule.(*RateRule).Rate)
+
+	// Closing closes the channels
+	g.Close()
+	_, ok := <-g.Watch()
+	assert.False(t, ok)
+	for range slow {
+	}
+}
+
+// flakyBackend fails a number of times before working
+type flakyBackend struct {
+	failures int
+	calls    int
+}
+
+func (b *flakyBackend) Refresh() ([]Flag, time.Time, error) {
+	b.calls++
+	if b.calls <= b.failures {
+		return nil, time.Time{}, errors.New("Service unavailable")
+	}
+	return []Flag{{Name: "go.sun.money", Active: true}}, time.Time{}, nil
+}
+
+func TestRefreshRetry(t *testing.T) {
+	t.Parallel()
+
+	// Without retries, one failure means waiting until the next refresh
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	backend := &flakyBackend{failures: 2}
+	g.refreshWithRetry(backend, time.Second)
+	assert.Equal(t, 1, backend.calls)
+
+	// Retry until it works
+	buf.Reset()
+	g.SetRefreshRetry(3, time.Millisecond)
+	backend = &flakyBackend{failures: 2}
+	g.refreshWithRetry(backend, time.Second)
+	assert.Equal(t, 3, backend.calls)
+	assert.True(t, g.Enabled(nil, "go.sun.money", nil))
+	assert.Equal(t, 2, strings.Count(buf.String(), "Service unavailable"))
+
+	// Only up to the limit
+	backend = &flakyBackend{failures: 10}
+	g.refreshWithRetry(backend, time.Second)
+	assert.Equal(t, 4, backend.calls)
+
+	// And not past the next refresh
+	g.SetRefreshRetry(10, 10*time.Millisecond)
+	backend = &flakyBackend{failures: 10}
+	g.refreshWithRetry(backend, 50*time.Millisecond)
+	assert.Equal(t, 3, backend.calls)
+
+	// Nor after closing
+	g.SetRefreshRetry(10, time.Hour)
+	g.done = make(chan struct{})
+	close(g.done)
+	backend = &flakyBackend{failures: 10}
+	start := time.Now()
+	g.refreshWithRetry(backend, 10*time.Hour)
+	assert.Equal(t, 1, backend.calls)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestCloseTwice(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, buf := testGoforit(time.Millisecond, backend, enabledTickerInterval)
+	watch := g.Watch()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, g.Close())
+		}()
+		go func() {
+			defer wg.Done()
+			g.Enabled(context.Background(), "go.moon.mercury", nil)
+		}()
+	}
+	wg.Wait()
+	assert.NoError(t, g.Close())
+
+	_, ok := <-watch
+	assert.False(t, ok)
+
+	// Checks after closing use the default, with an error
+	buf.Reset()
+	assert.False(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+	assert.Contains(t, buf.String(), "Checked flag go.moon.mercury after goforit was closed, using the default")
+	explanation, err := g.Explain(context.Background(), "go.moon.mercury", nil)
+	assert.Equal(t, ReasonClosed, explanation.Reason)
+	assert.Contains(t, err.Error(), "after goforit was closed")
+
+	// Refreshes that finish after closing are discarded
+	g.RefreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.new", Active: true}}})
+	_, ok = g.flags.Load("go.new")
+	assert.False(t, ok)
 }
 
 func TestRefreshTicker(t *testing.T) {
@@ -450,7 +2698,7 @@ func TestRefreshTicker(t *testing.T) {
 	defer g.Close()
 
 	earthTicker := time.NewTicker(time.Nanosecond)
-	g.flags.Store("go.earth.money", Flag{"go.earth.money", true, nil, earthTicker})
+	g.flags.Store("go.earth.money", Flag{Name: "go.earth.money", Active: true, enabledTicker: earthTicker})
 	f, ok := g.flags.Load("go.moon.mercury")
 	assert.True(t, ok)
 	moonTicker := f.(Flag).enabledTicker
@@ -475,14 +2723,17 @@ func TestRefreshTicker(t *testing.T) {
 	assert.Equal(t, moonTicker, f.(Flag).enabledTicker)
 
 	// Make sure that the deleted flag's ticker was stopped.
-	_, ok = <-earthTicker.C
-	assert.True(t, ok)
+	// Depending on the Go version, a stopped ticker may still have a tick buffered.
+	select {
+	case <-earthTicker.C:
+	default:
+	}
 	// If the ticker wasn't deleted, make sure it can run again.
 	time.Sleep(time.Millisecond)
 	select {
-	case _, ok = <-earthTicker.C:
+	case <-earthTicker.C:
 		// If the ticker was stopped, there's no way we'd get a 2nd tick.
-		assert.False(t, ok)
+		assert.Fail(t, "ticker for deleted flag was not stopped")
 	default:
 	}
 }
@@ -527,14 +2778,14 @@ type dummyDefaultFlagsBackend struct{}
 
 func (b *dummyDefaultFlagsBackend) Refresh() ([]Flag, time.Time, error) {
 	var testFlag = Flag{
-		"test",
-		true,
-		[]RuleInfo{
+		Name:   "test",
+		Active: true,
+		Rules: []RuleInfo{
 			{&MatchListRule{"host_name", []string{"apibox_789"}}, RuleOff, RuleContinue},
 			{&MatchListRule{"host_name", []string{"apibox_123", "apibox_456"}}, RuleOn, RuleContinue},
 			{&RateRule{1, []string{"cluster", "db"}}, RuleOn, RuleOff},
 		},
-		time.NewTicker(time.Second),
+		enabledTicker: time.NewTicker(time.Second),
 	}
 	return []Flag{testFlag}, time.Time{}, nil
 }
@@ -576,6 +2827,262 @@ func TestDefaultTags(t *testing.T) {
 	}
 }
 
+func TestRequireTags(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(DefaultInterval, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	g.RequireTags("user_id")
+
+	// Flags are still evaluated, but the missing tag is logged
+	assert.True(t, g.Enabled(context.Background(), "test", map[string]string{"host_name": "apibox_123"}))
+	assert.Contains(t, buf.String(), ErrMissingTag{Flag: "test", Tag: "user_id"}.Error())
+
+	// Default tags count
+	buf.Reset()
+	g.AddDefaultTags(map[string]string{"user_id": "alice"})
+	assert.True(t, g.Enabled(context.Background(), "test", map[string]string{"host_name": "apibox_123"}))
+	assert.Zero(t, buf.String())
+}
+
+func TestSetCaseInsensitiveNames(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetCaseInsensitiveNames(true)
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	var checked []string
+	g.SetCheckCallback(func(name string, enabled bool, tags map[string]string) {
+		checked = append(checked, name)
+	})
+	backend := &dummyFlagsBackend{[]Flag{
+		{Name: "Go.On", Active: true},
+		{Name: "go.off", Active: false},
+		{Name: "GO.OFF", Active: true},
+	}}
+	g.init(0, backend)
+	defer g.Close()
+
+	assert.Equal(t, []string{"go.off", "go.on"}, g.Flags(nil))
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+	assert.True(t, g.Enabled(nil, "GO.ON", nil))
+	assert.Equal(t, []string{"go.on", "go.on"}, checked)
+
+	// The last of the colliding flags wins, and the collision is reported once
+	assert.True(t, g.Enabled(nil, "Go.Off", nil))
+	g.RefreshFlags(backend)
+	assert.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "Flags go.off and GO.OFF have the same name ignoring case, using GO.OFF")
+
+	// Overrides are case insensitive too
+	assert.False(t, g.Enabled(Override(context.Background(), "GO.on", false), "go.ON", nil))
+	g.SetGlobalOverride("GO.ON", false)
+	assert.False(t, g.Enabled(nil, "go.on", nil))
+	assert.Equal(t, map[string]bool{"go.on": false}, g.GlobalOverrides())
+	g.ClearGlobalOverride("Go.On")
+	assert.True(t, g.Enabled(nil, "go.on", nil))
+
+	// Without the option, case matters
+	g2, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g2.Close()
+	assert.True(t, g2.Enabled(nil, "Go.On", nil))
+	assert.False(t, g2.Enabled(nil, "go.on", nil))
+}
+
+func TestAddLockedTags(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(DefaultInterval, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+	g.AddLockedTags(map[string]string{"host_name": "apibox_123"})
+
+	// Locked tags can't be replaced, and trying is logged
+	props := map[string]string{"host_name": "apibox_999", "cluster": "west"}
+	assert.True(t, g.Enabled(context.Background(), "test", props))
+	assert.Contains(t, buf.String(), ErrLockedTag{Flag: "test", Tag: "host_name"}.Error())
+	assert.Equal(t, map[string]string{"host_name": "apibox_123", "cluster": "west"}, g.mergeProperties(props))
+
+	buf.Reset()
+	assert.True(t, g.Enabled(context.Background(), "test", map[string]string{"cluster": "west"}))
+	assert.Zero(t, buf.String())
+}
+
+func TestTagNormalizer(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(DefaultInterval, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	props := map[string]string{"host_name": "APIBOX_123", "junk": "x"}
+	assert.False(t, g.Enabled(context.Background(), "test", props))
+	assert.False(t, g.EnabledAll(context.Background(), []string{"test"}, props)["test"])
+
+	g.SetTagNormalizer(func(key, value string) (string, string) {
+		if key == "junk" {
+			return "", ""
+		}
+		return key, strings.ToLower(value)
+	})
+	assert.True(t, g.Enabled(context.Background(), "test", props))
+	assert.True(t, g.EnabledAll(context.Background(), []string{"test"}, props)["test"])
+	assert.Equal(t, map[string]string{"host_name": "apibox_123"}, g.mergeProperties(props))
+
+	// Default tags are normalized too
+	g.AddDefaultTags(map[string]string{"host_name": "APIBOX_456"})
+	assert.True(t, g.Enabled(context.Background(), "test", nil))
+}
+
+type userContextKey struct{}
+
+func TestSetContextTagger(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"user": "bob", "cluster": "east"})
+	g.SetContextTagger(func(ctx context.Context) map[string]string {
+		if user, ok := ctx.Value(userContextKey{}).(string); ok {
+			return map[string]string{"user": user}
+		}
+		return nil
+	})
+	ctx := context.WithValue(context.Background(), userContextKey{}, "alice")
+
+	// Context tags win over default tags, and properties win over both
+	assert.False(t, g.Enabled(context.Background(), "go.users", nil))
+	assert.True(t, g.Enabled(ctx, "go.users", nil))
+	assert.False(t, g.Enabled(ctx, "go.users", map[string]string{"user": "carol"}))
+	assert.True(t, g.EnabledAll(ctx, []string{"go.users"}, nil)["go.users"])
+	ex, err := g.Explain(ctx, "go.users", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"user": "alice", "cluster": "east"}, ex.Tags)
+	tags, _ := g.LastTags("go.users")
+	assert.Equal(t, map[string]string{"user": "alice", "cluster": "east"}, tags)
+
+	// Tag overrides see them too
+	assert.False(t, g.Enabled(OverrideForTags(ctx, "go.users", false, map[string]string{"user": "alice"}), "go.users", nil))
+}
+
+func TestSetTagCardinalityGuard(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.users", Active: true, Rules: []RuleInfo{
+			{&MatchListRule{"user", []string{"alice"}}, RuleOn, RuleOff},
+		}},
+	}}, enabledTickerInterval)
+	defer g.Close()
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+	props := map[string]string{"user": "alice", "request": "123"}
+
+	g.SetTagCardinalityGuard(3, false)
+	assert.True(t, g.Enabled(nil, "go.users", props))
+	assert.Empty(t, errs)
+
+	g.SetTagCardinalityGuard(2, false)
+	assert.True(t, g.Enabled(nil, "go.users", props))
+	assert.Equal(t, []error{ErrTagCardinality{Flag: "go.users", Count: 3, Max: 2}}, errs)
+
+	// Dropping keeps the first tags in sorted order, so "user" is lost
+	g.SetTagCardinalityGuard(2, true)
+	assert.False(t, g.Enabled(nil, "go.users", props))
+	tags, _ := g.LastTags("go.users")
+	assert.Equal(t, map[string]string{"cluster": "east", "request": "123"}, tags)
+}
+
+func TestLastTags(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, &dummyDefaultFlagsBackend{}, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+
+	_, ok := g.LastTags("test")
+	assert.False(t, ok)
+
+	g.Enabled(context.Background(), "test", map[string]string{"host_name": "apibox_123"})
+	tags, ok := g.LastTags("test")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"host_name": "apibox_123", "cluster": "east"}, tags)
+
+	// Only the latest tags are kept, and changing them doesn't affect goforit
+	g.Enabled(context.Background(), "test", map[string]string{"host_name": "apibox_456"})
+	tags, _ = g.LastTags("test")
+	assert.Equal(t, map[string]string{"host_name": "apibox_456", "cluster": "east"}, tags)
+	tags["host_name"] = "changed"
+	tags, _ = g.LastTags("test")
+	assert.Equal(t, "apibox_456", tags["host_name"])
+}
+
+func TestString(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	g.SetStalenessThreshold(5 * time.Minute)
+	g.AddDefaultTags(map[string]string{"cluster": "east", "token": "hunter2"})
+	g.RequireTags("user")
+	g.RedactTags("token")
+	g.SetGlobalOverride("go.sun.moon", false)
+	g.SetGlobalOverrideFunc("go.moon.mercury", func(tags map[string]string) bool { return true })
+
+	str := g.String()
+	assert.Contains(t, str, "backend: goforit.csvFileBackend")
+	assert.Contains(t, str, "flags: 3")
+	assert.Contains(t, str, "staleness thresholds: source 5m0s, refresh 5m0s")
+	assert.Contains(t, str, "default tags: cluster=east, token=<redacted>")
+	assert.Contains(t, str, "required tags: user")
+	assert.Contains(t, str, "global overrides: go.moon.mercury=<func>, go.sun.moon=false")
+	assert.NotContains(t, str, "hunter2")
+	assert.NotContains(t, str, "last refresh: never")
+
+	g, _ = testGoforit(0, nil, enabledTickerInterval)
+	assert.Contains(t, g.String(), "last refresh: never")
+}
+
+func TestMetadata(t *testing.T) {
+	t.Parallel()
+
+	backend := &dummyFlagsBackend{[]Flag{
+		{Name: "go.sun.money", Active: true, Metadata: map[string]string{"owner": "payments"}},
+		{Name: "go.moon.mercury", Active: true},
+	}}
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+
+	metadata, err := g.Metadata("go.sun.money")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "payments"}, metadata)
+	metadata["owner"] = "changed"
+	metadata, _ = g.Metadata("go.sun.money")
+	assert.Equal(t, "payments", metadata["owner"])
+
+	metadata, err = g.Metadata("go.moon.mercury")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, metadata)
+
+	_, err = g.Metadata("go.extra")
+	assert.Equal(t, ErrUnknownFlag{"go.extra"}, err)
+
+	// Changing metadata updates the flag
+	backend.flags[1].Metadata = map[string]string{"owner": "space"}
+	g.RefreshFlags(backend)
+	metadata, _ = g.Metadata("go.moon.mercury")
+	assert.Equal(t, map[string]string{"owner": "space"}, metadata)
+}
+
 func TestOverride(t *testing.T) {
 	t.Parallel()
 
@@ -645,6 +3152,509 @@ func TestOverride(t *testing.T) {
 	assert.False(t, g.Enabled(ctx, "go.extra", nil))
 }
 
+func TestFlags(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	assert.Empty(t, g.Flags(nil))
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g.RefreshFlags(backend)
+	defer g.Close()
+	assert.Equal(t, []string{"go.moon.mercury", "go.stars.money", "go.sun.money"}, g.Flags(nil))
+
+	// Overrides are included
+	ctx := Override(context.Background(), "go.extra", true)
+	ctx = Override(ctx, "go.sun.money", true)
+	assert.Equal(t, []string{"go.extra", "go.moon.mercury", "go.stars.money", "go.sun.money"}, g.Flags(ctx))
+}
+
+func TestRate(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.off", Flag{Name: "go.off", Active: false, enabledTicker: time.NewTicker(time.Second)})
+	g.flags.Store("go.sun.moon", Flag{Name: "go.sun.moon", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"host_name", []string{"apibox_789"}}, RuleOn, RuleContinue},
+		{&RateRule{Rate: 0.5}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+
+	rate, ok, err := g.Rate("go.stars.money")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, rate)
+
+	rate, ok, err = g.Rate("go.moon.mercury")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 1.0, rate)
+
+	rate, ok, err = g.Rate("go.off")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 0.0, rate)
+
+	// Other rules can't be described by a rate
+	_, ok, err = g.Rate("go.sun.moon")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	_, ok, err = g.Rate("go.extra")
+	assert.Equal(t, ErrUnknownFlag{"go.extra"}, err)
+	assert.False(t, ok)
+}
+
+func TestClearOverride(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+
+	ctx := Override(context.Background(), "go.sun.money", true)
+	ctx = Override(ctx, "go.moon.mercury", false)
+	assert.True(t, g.Enabled(ctx, "go.sun.money", nil))
+	assert.False(t, g.Enabled(ctx, "go.moon.mercury", nil))
+
+	// Clearing one override goes back to the backend for just that flag
+	cleared := ClearOverride(ctx, "go.sun.money")
+	assert.False(t, g.Enabled(cleared, "go.sun.money", nil))
+	assert.False(t, g.Enabled(cleared, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(ctx, "go.sun.money", nil))
+
+	// Clearing something not overridden is harmless
+	assert.Equal(t, cleared, ClearOverride(cleared, "go.extra"))
+	assert.Equal(t, context.Background(), ClearOverride(context.Background(), "go.extra"))
+
+	// Clearing all overrides
+	cleared = ClearOverrides(ctx)
+	assert.False(t, g.Enabled(cleared, "go.sun.money", nil))
+	assert.True(t, g.Enabled(cleared, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(ctx, "go.sun.money", nil))
+	assert.False(t, g.Enabled(ctx, "go.moon.mercury", nil))
+	assert.Equal(t, []string{"go.moon.mercury", "go.stars.money", "go.sun.money"}, g.Flags(cleared))
+
+	// Overrides can be added again afterwards
+	cleared = Override(cleared, "go.moon.mercury", false)
+	assert.False(t, g.Enabled(cleared, "go.moon.mercury", nil))
+	assert.False(t, g.Enabled(cleared, "go.sun.money", nil))
+}
+
+func TestEnabledOrDefault(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, buf := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+
+	// Known flags ignore the default
+	assert.False(t, g.EnabledOrDefault(context.Background(), "go.sun.money", nil, true))
+	assert.True(t, g.EnabledOrDefault(context.Background(), "go.moon.mercury", nil, false))
+	assert.Empty(t, buf.String())
+
+	// Unknown flags use the default, but are still logged
+	assert.True(t, g.EnabledOrDefault(context.Background(), "go.extra", nil, true))
+	assert.Contains(t, buf.String(), ErrUnknownFlag{"go.extra"}.Error())
+	assert.False(t, g.EnabledOrDefault(context.Background(), "go.extra", nil, false))
+
+	// Overrides still win
+	ctx := Override(context.Background(), "go.extra", false)
+	assert.False(t, g.EnabledOrDefault(ctx, "go.extra", nil, true))
+
+	// Known flags are counted like any other check. Unknown flags aren't,
+	// so the callbacks only see what the caller got.
+	var reasons []EvalReason
+	g.SetCheckReasonCallback(func(name string, enabled bool, reason EvalReason) {
+		reasons = append(reasons, reason)
+	})
+	checked := map[string]bool{}
+	g.SetCheckCallback(func(name string, enabled bool, properties map[string]string) {
+		checked[name] = enabled
+	})
+	unknown := 0
+	g.SetUnknownFlagHandler(func(name string) {
+		unknown++
+	})
+	buf.Reset()
+	assert.True(t, g.EnabledOrDefault(context.Background(), "go.moon.mercury", nil, false))
+	assert.True(t, g.EnabledOrDefault(context.Background(), "go.extra", nil, true))
+	assert.Equal(t, []EvalReason{ReasonEvaluated}, reasons)
+	assert.Equal(t, map[string]bool{"go.moon.mercury": true}, checked)
+	assert.Equal(t, uint64(1), g.Stats()["go.extra"].Checks)
+	assert.Equal(t, 1, unknown)
+	assert.Equal(t, 1, strings.Count(buf.String(), ErrUnknownFlag{"go.extra"}.Error()))
+
+	// An override of an unknown flag is what the caller gets, so it's counted
+	assert.True(t, g.EnabledOrDefault(Override(context.Background(), "go.extra", true), "go.extra", nil, false))
+	assert.Equal(t, map[string]bool{"go.moon.mercury": true, "go.extra": true}, checked)
+
+	// The kill switch turns off unknown flags too
+	g.SetKillSwitch(true)
+	assert.False(t, g.EnabledOrDefault(context.Background(), "go.extra", nil, true))
+}
+
+func TestErrorThrottle(t *testing.T) {
+	t.Parallel()
+
+	clock := goforittest.NewManualClock(time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC))
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.SetErrorThrottle(time.Minute)
+	defer g.Close()
+
+	countLines := func() int {
+		return strings.Count(buf.String(), "\n")
+	}
+
+	// Identical errors are only logged once
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	assert.Equal(t, 1, countLines())
+
+	// Different errors aren't suppressed
+	g.EnabledOrDefault(context.Background(), "go.other", nil, false)
+	assert.Equal(t, 2, countLines())
+
+	// Once the window passes, the error is logged again
+	clock.Advance(30 * time.Second)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	assert.Equal(t, 2, countLines())
+	clock.Advance(30 * time.Second)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	assert.Equal(t, 3, countLines())
+
+	// Turning off throttling logs everything
+	g.SetErrorThrottle(0)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, false)
+	assert.Equal(t, 5, countLines())
+}
+
+func TestVariant(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	variants := []VariantInfo{{"control", 2}, {"red", 1}, {"blue", 1}}
+	g.flags.Store("go.colors", Flag{
+		Name:              "go.colors",
+		Active:            true,
+		Rules:             []RuleInfo{{&MatchListRule{"country", []string{"us"}}, RuleOff, RuleOn}},
+		Variants:          variants,
+		VariantProperties: []string{"user"},
+		enabledTicker:     time.NewTicker(time.Second),
+	})
+	g.flags.Store("go.plain", Flag{Name: "go.plain", Active: true, enabledTicker: time.NewTicker(time.Second)})
+
+	// Variants are picked by weight, and stick to each user
+	counts := map[string]int{}
+	for user := 0; user < 10000; user++ {
+		props := map[string]string{"user": strconv.Itoa(user), "country": "ca"}
+		variant, ok := g.Variant(context.Background(), "go.colors", props)
+		assert.True(t, ok)
+		counts[variant]++
+		again, _ := g.Variant(context.Background(), "go.colors", props)
+		assert.Equal(t, variant, again)
+		assert.Equal(t, variant != "control", g.Enabled(context.Background(), "go.colors", props))
+	}
+	assert.InDelta(t, 5000, counts["control"], 200)
+	assert.InDelta(t, 2500, counts["red"], 200)
+	assert.InDelta(t, 2500, counts["blue"], 200)
+	assert.Empty(t, buf.String())
+
+	// Variants don't depend on whether a sample rule on the same properties
+	// matched
+	g.flags.Store("go.sampled", Flag{
+		Name:              "go.sampled",
+		Active:            true,
+		Rules:             []RuleInfo{{&RateRule{Rate: 0.1, Properties: []string{"user"}}, RuleOn, RuleOff}},
+		Variants:          []VariantInfo{{"control", 1}, {"treatment", 1}},
+		VariantProperties: []string{"user"},
+		enabledTicker:     time.NewTicker(time.Second),
+	})
+	counts = map[string]int{}
+	for user := 0; user < 10000; user++ {
+		props := map[string]string{"user": strconv.Itoa(user)}
+		if variant, _ := g.Variant(context.Background(), "go.sampled", props); variant != "" {
+			counts[variant]++
+		}
+	}
+	assert.InDelta(t, 9500, counts["control"], 200)
+	assert.InDelta(t, 500, counts["treatment"], 200)
+
+	// If the rules don't enable the flag, it's the control
+	for user := 0; user < 100; user++ {
+		props := map[string]string{"user": strconv.Itoa(user), "country": "us"}
+		variant, ok := g.Variant(context.Background(), "go.colors", props)
+		assert.True(t, ok)
+		assert.Equal(t, "control", variant)
+	}
+
+	// Overrides pick the control or the first other variant
+	ctx := Override(context.Background(), "go.colors", true)
+	variant, _ := g.Variant(ctx, "go.colors", map[string]string{"country": "us"})
+	assert.Equal(t, "red", variant)
+	ctx = Override(context.Background(), "go.colors", false)
+	variant, _ = g.Variant(ctx, "go.colors", map[string]string{"user": "1", "country": "ca"})
+	assert.Equal(t, "control", variant)
+
+	// Missing properties are an error, and use the control
+	variant, ok := g.Variant(context.Background(), "go.colors", map[string]string{"country": "ca"})
+	assert.True(t, ok)
+	assert.Equal(t, "control", variant)
+	assert.Contains(t, buf.String(), "No property user in properties map")
+
+	// Flags without variants
+	buf.Reset()
+	variant, ok = g.Variant(context.Background(), "go.plain", nil)
+	assert.False(t, ok)
+	assert.Equal(t, "", variant)
+	_, ok = g.Variant(context.Background(), "go.extra", nil)
+	assert.False(t, ok)
+	assert.Contains(t, buf.String(), ErrUnknownFlag{"go.extra"}.Error())
+}
+
+func TestOverrideMany(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+
+	ctx := Override(context.Background(), "go.stars.money", true)
+	manyCtx := OverrideMany(ctx, map[string]bool{"go.sun.money": true, "go.moon.mercury": false})
+	assert.True(t, g.Enabled(manyCtx, "go.sun.money", nil))
+	assert.False(t, g.Enabled(manyCtx, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(manyCtx, "go.stars.money", nil))
+
+	// The original context is untouched
+	assert.False(t, g.Enabled(ctx, "go.sun.money", nil))
+	assert.True(t, g.Enabled(ctx, "go.moon.mercury", nil))
+
+	// Concurrent readers see all the overrides or none of them
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := OverrideMany(ctx, map[string]bool{"go.sun.money": true, "go.moon.mercury": false})
+				assert.Equal(t, g.Enabled(c, "go.sun.money", nil), !g.Enabled(c, "go.moon.mercury", nil))
+				assert.Equal(t, g.Enabled(ctx, "go.sun.money", nil), !g.Enabled(ctx, "go.moon.mercury", nil))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestNewRequestContext(t *testing.T) {
+	t.Parallel()
+
+	g, buf := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	g.flags.Store("go.sampled", Flag{Name: "go.sampled", Active: true, Rules: []RuleInfo{
+		{&RateRule{Rate: 0.5}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	g.flags.Store("go.host", Flag{Name: "go.host", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"host_name", []string{"apibox_123"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+
+	// Each request gets a consistent answer for a sampled flag
+	seen := map[bool]bool{}
+	for i := 0; i < 100; i++ {
+		ctx := NewRequestContext(context.Background())
+		first := g.Enabled(ctx, "go.sampled", nil)
+		seen[first] = true
+		for j := 0; j < 10; j++ {
+			assert.Equal(t, first, g.Enabled(ctx, "go.sampled", nil))
+		}
+	}
+	assert.Len(t, seen, 2)
+
+	// Results are kept by name, regardless of properties
+	ctx := NewRequestContext(context.Background())
+	assert.True(t, g.Enabled(ctx, "go.host", map[string]string{"host_name": "apibox_123"}))
+	assert.True(t, g.Enabled(ctx, "go.host", map[string]string{"host_name": "apibox_456"}))
+
+	// Errors aren't remembered
+	ctx = NewRequestContext(context.Background())
+	assert.False(t, g.Enabled(ctx, "go.host", nil))
+	assert.Contains(t, buf.String(), "No property host_name")
+	assert.True(t, g.Enabled(ctx, "go.host", map[string]string{"host_name": "apibox_123"}))
+
+	// Overrides still win
+	assert.False(t, g.Enabled(Override(ctx, "go.host", false), "go.host", nil))
+}
+
+func TestErrorHandler(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	defer g.Close()
+	type flagError struct {
+		name string
+		err  error
+	}
+	var errs []flagError
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, flagError{name, err})
+	})
+	g.flags.Store("go.host", Flag{Name: "go.host", Active: true, Rules: []RuleInfo{
+		{&MatchListRule{"host_name", []string{"apibox_123"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+
+	// Errors checking flags have the flag's name
+	g.Enabled(context.Background(), "go.host", nil)
+	g.EnabledOrDefault(context.Background(), "go.extra", nil, true)
+	g.EnabledAll(context.Background(), []string{"go.host"}, map[string]string{"cluster": "east"})
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "go.host", errs[0].name)
+	assert.Contains(t, errs[0].err.Error(), "No property host_name")
+	assert.Equal(t, flagError{"go.extra", ErrUnknownFlag{"go.extra"}}, errs[1])
+	assert.Equal(t, "go.host", errs[2].name)
+
+	// Errors from the backend don't
+	errs = nil
+	g.RefreshFlags(dummyErrorBackend{})
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "", errs[0].name)
+	assert.EqualError(t, errs[0].err, "backend is down")
+
+	// The handler is throttled along with logging
+	errs = nil
+	g.SetErrorThrottle(time.Minute)
+	g.Enabled(context.Background(), "go.host", nil)
+	g.Enabled(context.Background(), "go.host", nil)
+	assert.Len(t, errs, 1)
+
+	// Errors from one check are in a fixed order
+	for i := 0; i < 10; i++ {
+		errs = nil
+		g.SetErrorThrottle(0)
+		g.RequireTags("user", "cluster", "account")
+		g.Enabled(context.Background(), "go.host", nil)
+		assert.Len(t, errs, 4)
+		assert.Equal(t, []flagError{
+			{"go.host", ErrMissingTag{Flag: "go.host", Tag: "account"}},
+			{"go.host", ErrMissingTag{Flag: "go.host", Tag: "cluster"}},
+			{"go.host", ErrMissingTag{Flag: "go.host", Tag: "user"}},
+		}, errs[:3])
+		assert.Contains(t, errs[3].err.Error(), "No property host_name")
+	}
+}
+
+func TestSetLogger(t *testing.T) {
+	t.Parallel()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	var buf bytes.Buffer
+	g.SetLogger(log.New(&buf, "", 0))
+	g.Variant(nil, "go.missing", nil)
+	assert.Equal(t, "[goforit] Unknown flag go.missing\n", buf.String())
+
+	// A nil logger logs nothing, but the handler still gets errors
+	var fields []map[string]interface{}
+	g.SetErrorHandler(func(name string, err error) {
+		fields = append(fields, ErrorFields(name, err))
+	})
+	g.SetLogger(nil)
+	g.Variant(nil, "go.other", nil)
+	assert.Equal(t, []map[string]interface{}{
+		{"error": "Unknown flag go.other", "type": "goforit.ErrUnknownFlag", "flag": "go.other"},
+	}, fields)
+	assert.Equal(t, "[goforit] Unknown flag go.missing\n", buf.String())
+}
+
+func TestErrorFields(t *testing.T) {
+	t.Parallel()
+
+	assert.Equal(t, map[string]interface{}{
+		"error": "backend is down",
+		"type":  "*errors.errorString",
+	}, ErrorFields("", errors.New("backend is down")))
+	assert.Equal(t, map[string]interface{}{
+		"error":       ErrDataStale{"go.on", time.Minute, 30 * time.Second}.Error(),
+		"type":        "goforit.ErrDataStale",
+		"flag":        "go.on",
+		"age_s":       60.0,
+		"threshold_s": 30.0,
+	}, ErrorFields("go.on", ErrDataStale{"go.on", time.Minute, 30 * time.Second}))
+	assert.Equal(t, map[string]interface{}{
+		"error": ErrMissingTag{"go.on", "user"}.Error(),
+		"type":  "goforit.ErrMissingTag",
+		"flag":  "go.on",
+		"tag":   "user",
+	}, ErrorFields("go.on", ErrMissingTag{"go.on", "user"}))
+	fields := ErrorFields("", ErrParseFlag{Flag: "go.bad", Line: 3, Value: "x", Err: errors.New("bad rate")})
+	assert.Equal(t, "go.bad", fields["flag"])
+	assert.Equal(t, 3, fields["line"])
+	assert.Equal(t, "x", fields["value"])
+}
+
+func TestUnknownFlagHandler(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	var unknown []string
+	g.SetUnknownFlagHandler(func(name string) {
+		unknown = append(unknown, name)
+	})
+
+	assert.True(t, g.Enabled(context.Background(), "go.moon.mercury", nil))
+	assert.False(t, g.Enabled(context.Background(), "go.moon.mercruy", nil))
+	assert.True(t, g.EnabledOrDefault(context.Background(), "go.extra", nil, true))
+	g.EnabledAll(context.Background(), []string{"go.sun.money", "go.sun.mony"}, nil)
+	assert.Equal(t, []string{"go.moon.mercruy", "go.extra", "go.sun.mony"}, unknown)
+
+	// Overridden flags don't need to exist
+	unknown = nil
+	assert.True(t, g.Enabled(Override(context.Background(), "go.new", true), "go.new", nil))
+	assert.Empty(t, unknown)
+}
+
+func TestOverrideForTags(t *testing.T) {
+	t.Parallel()
+
+	backend := BackendFromFile(filepath.Join("fixtures", "flags_example.csv"))
+	g, _ := testGoforit(0, backend, enabledTickerInterval)
+	defer g.Close()
+	g.AddDefaultTags(map[string]string{"cluster": "east"})
+
+	ctx := OverrideForTags(context.Background(), "go.moon.mercury", false, map[string]string{"cluster": "east"})
+	ctx = OverrideForTags(ctx, "go.moon.mercury", true, map[string]string{"cluster": "east", "host_type": "canary"})
+
+	// Only matching tags are overridden, including default tags
+	assert.False(t, g.Enabled(ctx, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(ctx, "go.moon.mercury", map[string]string{"cluster": "west"}))
+
+	// The most specific override wins
+	assert.True(t, g.Enabled(ctx, "go.moon.mercury", map[string]string{"host_type": "canary"}))
+	assert.False(t, g.EnabledAll(ctx, []string{"go.moon.mercury"}, map[string]string{"host_type": "web"})["go.moon.mercury"])
+
+	// Scoped overrides beat unscoped ones
+	unscoped := Override(ctx, "go.moon.mercury", true)
+	assert.False(t, g.Enabled(unscoped, "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(unscoped, "go.moon.mercury", map[string]string{"cluster": "west"}))
+
+	// They also work for prerequisites and flags that don't exist
+	g.flags.Store("go.child", Flag{Name: "go.child", Active: true, Rules: []RuleInfo{
+		{&PrerequisiteRule{[]string{"go.moon.mercury"}}, RuleOn, RuleOff},
+	}, enabledTicker: time.NewTicker(time.Second)})
+	assert.False(t, g.Enabled(ctx, "go.child", nil))
+	assert.True(t, g.Enabled(ctx, "go.child", map[string]string{"cluster": "west"}))
+	newCtx := OverrideForTags(context.Background(), "go.new", true, map[string]string{"cluster": "east"})
+	assert.True(t, g.EnabledOrDefault(newCtx, "go.new", nil, false))
+
+	// Clearing
+	assert.True(t, g.Enabled(ClearOverride(ctx, "go.moon.mercury"), "go.moon.mercury", nil))
+	assert.True(t, g.Enabled(ClearOverrides(ctx), "go.moon.mercury", nil))
+	assert.False(t, g.Enabled(ctx, "go.moon.mercury", nil))
+}
+
 func TestOverrideWithoutInit(t *testing.T) {
 	t.Parallel()
 
@@ -667,10 +3677,10 @@ type dummyAgeBackend struct {
 
 func (b *dummyAgeBackend) Refresh() ([]Flag, time.Time, error) {
 	var testFlag = Flag{
-		"go.sun.money",
-		true,
-		[]RuleInfo{},
-		time.NewTicker(time.Nanosecond),
+		Name:          "go.sun.money",
+		Active:        true,
+		Rules:         []RuleInfo{},
+		enabledTicker: time.NewTicker(time.Nanosecond),
 	}
 	b.mtx.RLock()
 	defer b.mtx.RUnlock()
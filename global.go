@@ -2,6 +2,9 @@ package goforit
 
 import (
 	"context"
+	"log"
+	"math/rand"
+	"net/http"
 	"time"
 )
 
@@ -15,22 +18,318 @@ func Enabled(ctx context.Context, name string, props map[string]string) (enabled
 	return globalGoforit.Enabled(ctx, name, props)
 }
 
+func EnabledOrDefault(ctx context.Context, name string, props map[string]string, def bool) bool {
+	return globalGoforit.EnabledOrDefault(ctx, name, props, def)
+}
+
+func Variant(ctx context.Context, name string, props map[string]string) (string, bool) {
+	return globalGoforit.Variant(ctx, name, props)
+}
+
+func LastTags(name string) (map[string]string, bool) {
+	return globalGoforit.LastTags(name)
+}
+
+func EnabledSeeded(ctx context.Context, name string, properties map[string]string, seed int64) bool {
+	return globalGoforit.EnabledSeeded(ctx, name, properties, seed)
+}
+
+func EnabledWith(ctx context.Context, name string, props map[string]interface{}) bool {
+	return globalGoforit.EnabledWith(ctx, name, props)
+}
+
+func SetAliases(aliases map[string]string) {
+	globalGoforit.SetAliases(aliases)
+}
+
+func Value(ctx context.Context, name string, props map[string]string) (string, bool, error) {
+	return globalGoforit.Value(ctx, name, props)
+}
+
+func SetCaseInsensitiveNames(enabled bool) {
+	globalGoforit.SetCaseInsensitiveNames(enabled)
+}
+
+func Metadata(name string) (map[string]string, error) {
+	return globalGoforit.Metadata(name)
+}
+
+func EnabledAll(ctx context.Context, names []string, props map[string]string) map[string]bool {
+	return globalGoforit.EnabledAll(ctx, names, props)
+}
+
+func Export(tagSets []map[string]string) (map[string]map[string]bool, error) {
+	return globalGoforit.Export(tagSets)
+}
+
+func Explain(ctx context.Context, name string, properties map[string]string) (Explanation, error) {
+	return globalGoforit.Explain(ctx, name, properties)
+}
+
+func SetCheckHistory(n int) {
+	globalGoforit.SetCheckHistory(n)
+}
+
+func SimulateOverride(name string, value bool) (int, error) {
+	return globalGoforit.SimulateOverride(name, value)
+}
+
+func EnabledByPrefix(ctx context.Context, prefix string, properties map[string]string) map[string]bool {
+	return globalGoforit.EnabledByPrefix(ctx, prefix, properties)
+}
+
+func SetGlobalOverride(name string, value bool) {
+	globalGoforit.SetGlobalOverride(name, value)
+}
+
+func SetKillSwitch(enabled bool) {
+	globalGoforit.SetKillSwitch(enabled)
+}
+
+func SetKillSwitchFlag(name string) {
+	globalGoforit.SetKillSwitchFlag(name)
+}
+
+func SetGlobalOverrideFunc(name string, fn OverrideFunc) {
+	globalGoforit.SetGlobalOverrideFunc(name, fn)
+}
+
+func SetAutoRollback(name string, threshold float64, window time.Duration, minOutcomes int) {
+	globalGoforit.SetAutoRollback(name, threshold, window, minOutcomes)
+}
+
+func SetRollbackCallback(callback RollbackCallback) {
+	globalGoforit.SetRollbackCallback(callback)
+}
+
+func ReportOutcome(name string, success bool) {
+	globalGoforit.ReportOutcome(name, success)
+}
+
+func ClearGlobalOverride(name string) {
+	globalGoforit.ClearGlobalOverride(name)
+}
+
+func GlobalOverrides() map[string]bool {
+	return globalGoforit.GlobalOverrides()
+}
+
+func SnapshotOverrides() map[string]bool {
+	return globalGoforit.SnapshotOverrides()
+}
+
+func RestoreOverrides(values map[string]bool) {
+	globalGoforit.RestoreOverrides(values)
+}
+
+func AdminHandler() http.Handler {
+	return globalGoforit.AdminHandler()
+}
+
+func Flags(ctx context.Context) []string {
+	return globalGoforit.Flags(ctx)
+}
+
+func Rate(name string) (float64, bool, error) {
+	return globalGoforit.Rate(name)
+}
+
 func RefreshFlags(backend Backend) {
 	globalGoforit.RefreshFlags(backend)
 }
 
+func Refresh() error {
+	return globalGoforit.Refresh()
+}
+
+func Healthy() (bool, error) {
+	return globalGoforit.Healthy()
+}
+
 func SetStalenessThreshold(threshold time.Duration) {
 	globalGoforit.SetStalenessThreshold(threshold)
 }
 
+func SetSourceStalenessThreshold(threshold time.Duration) {
+	globalGoforit.SetSourceStalenessThreshold(threshold)
+}
+
+func SetRefreshStalenessThreshold(threshold time.Duration) {
+	globalGoforit.SetRefreshStalenessThreshold(threshold)
+}
+
+func SetFlagStalenessThresholds(thresholds map[string]time.Duration) {
+	globalGoforit.SetFlagStalenessThresholds(thresholds)
+}
+
+func SetRefreshJitter(fraction float64) {
+	globalGoforit.SetRefreshJitter(fraction)
+}
+
+func SetMinRefreshInterval(d time.Duration) {
+	globalGoforit.SetMinRefreshInterval(d)
+}
+
+func SetRefreshTimeout(d time.Duration) {
+	globalGoforit.SetRefreshTimeout(d)
+}
+
+func SetRefreshRetry(maxRetries int, base time.Duration) {
+	globalGoforit.SetRefreshRetry(maxRetries, base)
+}
+
+func SetStatsdClient(client StatsdClient) {
+	globalGoforit.SetStatsdClient(client)
+}
+
+func SetCheckMetricRate(rate float64) {
+	globalGoforit.SetCheckMetricRate(rate)
+}
+
+func SetTagNormalizer(normalize TagNormalizer) {
+	globalGoforit.SetTagNormalizer(normalize)
+}
+
+func SetContextTagger(tagger ContextTagger) {
+	globalGoforit.SetContextTagger(tagger)
+}
+
+func SetTagCardinalityGuard(maxKeys int, drop bool) {
+	globalGoforit.SetTagCardinalityGuard(maxKeys, drop)
+}
+
+func SetLogger(logger *log.Logger) {
+	globalGoforit.SetLogger(logger)
+}
+
+func SetErrorHandler(handler ErrorHandler) {
+	globalGoforit.SetErrorHandler(handler)
+}
+
+func SetUnknownFlagHandler(handler func(name string)) {
+	globalGoforit.SetUnknownFlagHandler(handler)
+}
+
+func SetErrorThrottle(window time.Duration) {
+	globalGoforit.SetErrorThrottle(window)
+}
+
+func SetRandSource(src rand.Source) {
+	globalGoforit.SetRandSource(src)
+}
+
+func SetCheckCallback(callback CheckCallback) {
+	globalGoforit.SetCheckCallback(callback)
+}
+
+func SetCheckCallbackSampleRate(rate float64) {
+	globalGoforit.SetCheckCallbackSampleRate(rate)
+}
+
+func SetStartupGrace(grace time.Duration, defaults map[string]bool) {
+	globalGoforit.SetStartupGrace(grace, defaults)
+}
+
+func SetCheckBuffer(size int) {
+	globalGoforit.SetCheckBuffer(size)
+}
+
+func DroppedChecks() uint64 {
+	return globalGoforit.DroppedChecks()
+}
+
+func SetCheckReasonCallback(callback CheckReasonCallback) {
+	globalGoforit.SetCheckReasonCallback(callback)
+}
+
+func SetLatencyCallback(callback LatencyCallback) {
+	globalGoforit.SetLatencyCallback(callback)
+}
+
+func SetOverrideCallback(callback OverrideCallback) {
+	globalGoforit.SetOverrideCallback(callback)
+}
+
+func SetOverrideChangeCallback(callback OverrideChangeCallback) {
+	globalGoforit.SetOverrideChangeCallback(callback)
+}
+
+func SetStaleBehavior(behavior StaleBehavior) {
+	globalGoforit.SetStaleBehavior(behavior)
+}
+
+func SetFlagStaleBehaviors(behaviors map[string]StaleBehavior) {
+	globalGoforit.SetFlagStaleBehaviors(behaviors)
+}
+
+func SetErrorValuePolicy(policy ErrorValuePolicy) {
+	globalGoforit.SetErrorValuePolicy(policy)
+}
+
+func SetFlagErrorValuePolicies(policies map[string]ErrorValuePolicy) {
+	globalGoforit.SetFlagErrorValuePolicies(policies)
+}
+
+func SetSalt(salt string) {
+	globalGoforit.SetSalt(salt)
+}
+
+func SetHashFunc(hash HashFunc) {
+	globalGoforit.SetHashFunc(hash)
+}
+
+func SetClock(clock Clock) {
+	globalGoforit.SetClock(clock)
+}
+
 func AddDefaultTags(tags map[string]string) {
 	globalGoforit.AddDefaultTags(tags)
 }
 
+func AddLockedTags(tags map[string]string) {
+	globalGoforit.AddLockedTags(tags)
+}
+
+func RequireTags(tags ...string) {
+	globalGoforit.RequireTags(tags...)
+}
+
+func RedactTags(tags ...string) {
+	globalGoforit.RedactTags(tags...)
+}
+
+func Watch() <-chan FlagChange {
+	return globalGoforit.Watch()
+}
+
 func Init(interval time.Duration, backend Backend) {
 	globalGoforit.init(interval, backend)
 }
 
+func Stats() map[string]FlagStat {
+	return globalGoforit.Stats()
+}
+
+func ResetStats() {
+	globalGoforit.ResetStats()
+}
+
+func Snapshot() (*goforit, error) {
+	return globalGoforit.Snapshot()
+}
+
+func NotifyWebhook(url string) {
+	globalGoforit.NotifyWebhook(url)
+}
+
+func PauseRefresh() {
+	globalGoforit.PauseRefresh()
+}
+
+func ResumeRefresh() error {
+	return globalGoforit.ResumeRefresh()
+}
+
 func Close() error {
 	return globalGoforit.Close()
 }
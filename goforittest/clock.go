@@ -0,0 +1,75 @@
+// Package goforittest has helpers for testing code that uses goforit.
+package goforittest
+
+import (
+	"sync"
+	"time"
+)
+
+// ManualClock is a goforit.Clock that only changes when told to, so tests
+// don't need to sleep.
+type ManualClock struct {
+	mtx     sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+// A manualWaiter is a call to After that hasn't fired yet
+type manualWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewManualClock creates a ManualClock, starting at the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// After is like time.After, but fires when the clock is moved past the
+// duration, or at once if it isn't positive.
+func (c *ManualClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, manualWaiter{c.now.Add(d), ch})
+	return ch
+}
+
+// Advance moves the clock forward.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// Set moves the clock to a specific time.
+func (c *ManualClock) Set(now time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = now
+	c.fire()
+}
+
+// fire fires the waiters whose time has come. The lock must be held.
+func (c *ManualClock) fire() {
+	var waiting []manualWaiter
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			waiting = append(waiting, w)
+		} else {
+			w.ch <- c.now
+		}
+	}
+	c.waiters = waiting
+}
@@ -0,0 +1,495 @@
+package goforit
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An OverrideCallback is called when the result of a flag check comes from an
+// override, rather than from the backend.
+type OverrideCallback func(name string, enabled bool)
+
+// SetOverrideCallback sets a function to call whenever a flag check uses an
+// override, eg: to find overrides that were left in place. The CheckCallback
+// is still called with the result.
+func (g *goforit) SetOverrideCallback(callback OverrideCallback) {
+	g.overrideCallback.Store(callback)
+}
+
+func (g *goforit) overrideHit(name string, enabled bool) {
+	if callback, _ := g.overrideCallback.Load().(OverrideCallback); callback != nil {
+		callback(name, enabled)
+	}
+}
+
+// A unique context key for overrides
+type overrideContextKeyType struct{}
+
+var overrideContextKey = overrideContextKeyType{}
+
+type overrides map[string]bool
+
+// getOverride looks for an override for a flag in the context
+func getOverride(ctx context.Context, name string) (enabled bool, ok bool) {
+	if ctx == nil {
+		return false, false
+	}
+	ov, ok := ctx.Value(overrideContextKey).(overrides)
+	if !ok {
+		return false, false
+	}
+	enabled, ok = ov[name]
+	return enabled, ok
+}
+
+// A unique context key for overrides scoped to tags
+type tagOverrideContextKeyType struct{}
+
+var tagOverrideContextKey = tagOverrideContextKeyType{}
+
+type tagOverride struct {
+	value bool
+	match map[string]string
+}
+
+// Overrides for each flag, most specific first
+type tagOverrides map[string][]tagOverride
+
+// SetGlobalOverride overrides the value of a flag for every check, eg: from an
+// admin page. Overrides in the context take precedence.
+func (g *goforit) SetGlobalOverride(name string, value bool) {
+	name = g.normalizeName(name)
+	g.changeGlobalOverrides(func() {
+		g.storeGlobalOverride(name, &value)
+		g.storeGlobalOverrideFunc(name, nil)
+	})
+}
+
+// An OverrideFunc decides whether a flag is enabled, given the tags it's
+// checked with
+type OverrideFunc func(tags map[string]string) bool
+
+type overrideFuncs map[string]OverrideFunc
+
+// SetGlobalOverrideFunc overrides a flag for every check with a function of
+// the tags, after merging with the default tags. It's meant for temporary
+// logic, eg: during a migration. Overrides in the context take precedence.
+// The function gets its own copy of the tags. If it panics, the panic is
+// reported and the flag is evaluated as if it weren't overridden.
+func (g *goforit) SetGlobalOverrideFunc(name string, fn OverrideFunc) {
+	name = g.normalizeName(name)
+	g.changeGlobalOverrides(func() {
+		g.storeGlobalOverride(name, nil)
+		g.storeGlobalOverrideFunc(name, fn)
+	})
+}
+
+// storeGlobalOverride replaces or removes one global override. It must be
+// called with globalOverridesMtx held.
+func (g *goforit) storeGlobalOverride(name string, value *bool) {
+	ov := overrides{}
+	for k, v := range g.loadGlobalOverrides() {
+		if k != name {
+			ov[k] = v
+		}
+	}
+	if value != nil {
+		ov[name] = *value
+	}
+	g.globalOverrides.Store(ov)
+}
+
+// storeGlobalOverrideFunc replaces or removes one global override function. It
+// must be called with globalOverridesMtx held.
+func (g *goforit) storeGlobalOverrideFunc(name string, fn OverrideFunc) {
+	old, _ := g.globalOverrideFuncs.Load().(overrideFuncs)
+	funcs := overrideFuncs{}
+	for k, v := range old {
+		if k != name {
+			funcs[k] = v
+		}
+	}
+	if fn != nil {
+		funcs[name] = fn
+	}
+	g.globalOverrideFuncs.Store(funcs)
+}
+
+// ClearGlobalOverride removes a global override for a flag, including an
+// override function
+func (g *goforit) ClearGlobalOverride(name string) {
+	name = g.normalizeName(name)
+	g.changeGlobalOverrides(func() {
+		g.storeGlobalOverride(name, nil)
+		g.storeGlobalOverrideFunc(name, nil)
+	})
+}
+
+// An OverrideChangeCallback is called after a global override is set or
+// cleared, eg: to keep an audit log. When an override is cleared, cleared is
+// true and value is false. Override functions aren't reported.
+type OverrideChangeCallback func(name string, value bool, cleared bool)
+
+// SetOverrideChangeCallback sets a function to call after each change to the
+// global overrides, including rollbacks. RestoreOverrides calls it once for
+// each override it sets or clears.
+func (g *goforit) SetOverrideChangeCallback(callback OverrideChangeCallback) {
+	g.overrideChangeCallback.Store(callback)
+}
+
+// changeGlobalOverrides makes a change to the global overrides while holding
+// the lock, then reports what changed to the OverrideChangeCallback
+func (g *goforit) changeGlobalOverrides(change func()) {
+	g.globalOverridesMtx.Lock()
+	before := g.loadGlobalOverrides()
+	change()
+	after := g.loadGlobalOverrides()
+	g.globalOverridesMtx.Unlock()
+
+	callback, _ := g.overrideChangeCallback.Load().(OverrideChangeCallback)
+	if callback == nil {
+		return
+	}
+	names := make([]string, 0, len(before)+len(after))
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		old, hadOld := before[name]
+		value, ok := after[name]
+		if !ok && hadOld {
+			callback(name, false, true)
+		} else if ok && (!hadOld || old != value) {
+			callback(name, value, false)
+		}
+	}
+}
+
+// SnapshotOverrides returns the global overrides, so they can be put back
+// with RestoreOverrides, eg: between test cases. Override functions aren't
+// included.
+func (g *goforit) SnapshotOverrides() map[string]bool {
+	return g.GlobalOverrides()
+}
+
+// RestoreOverrides replaces all the global overrides at once, eg: with ones
+// from SnapshotOverrides. Override functions are removed.
+func (g *goforit) RestoreOverrides(values map[string]bool) {
+	ov := overrides{}
+	for k, v := range values {
+		ov[g.normalizeName(k)] = v
+	}
+	g.changeGlobalOverrides(func() {
+		g.globalOverrides.Store(ov)
+		g.globalOverrideFuncs.Store(overrideFuncs{})
+	})
+}
+
+// How many parts a rollback window is split into. Outcomes age out one part
+// at a time.
+const rollbackBuckets = 10
+
+type rollbackBucket struct {
+	start             time.Time
+	success, failures int
+}
+
+type rollbackWindow struct {
+	mtx         sync.Mutex
+	threshold   float64
+	window      time.Duration
+	minOutcomes int
+	buckets     [rollbackBuckets]rollbackBucket
+}
+
+// A RollbackCallback is called when a flag is rolled back automatically,
+// with the fraction of outcomes that failed
+type RollbackCallback func(name string, failureRate float64)
+
+// SetAutoRollback turns a flag off with a global override if too many of the
+// outcomes reported with ReportOutcome fail. Once there are at least
+// minOutcomes in the last window, the flag is rolled back when more than
+// threshold of them are failures. Clear the override to enable the flag again.
+// A threshold of zero stops rolling the flag back.
+func (g *goforit) SetAutoRollback(name string, threshold float64, window time.Duration, minOutcomes int) {
+	name = g.resolveAlias(name)
+	if threshold <= 0 {
+		g.rollbacks.Delete(name)
+		return
+	}
+	g.rollbacks.Store(name, &rollbackWindow{threshold: threshold, window: window, minOutcomes: minOutcomes})
+}
+
+// SetRollbackCallback sets a function to call when a flag is rolled back
+func (g *goforit) SetRollbackCallback(callback RollbackCallback) {
+	g.rollbackCallback.Store(callback)
+}
+
+// ReportOutcome records whether a request that had a flag enabled succeeded,
+// for SetAutoRollback. Outcomes for flags without auto rollback are ignored.
+func (g *goforit) ReportOutcome(name string, success bool) {
+	name = g.resolveAlias(name)
+	v, ok := g.rollbacks.Load(name)
+	if !ok {
+		return
+	}
+	if value, ok := g.loadGlobalOverrides()[name]; ok && !value {
+		// Already off
+		return
+	}
+	w := v.(*rollbackWindow)
+	now := g.clock.Now()
+	failureRate, rollback := w.add(now, success)
+	if !rollback {
+		return
+	}
+	g.SetGlobalOverride(name, false)
+	err := fmt.Errorf("Rolled back flag %s, %.0f%% of outcomes failed", name, failureRate*100)
+	g.reportError(name, err, "[goforit] ")
+	if callback, _ := g.rollbackCallback.Load().(RollbackCallback); callback != nil {
+		callback(name, failureRate)
+	}
+}
+
+// add records an outcome, and checks whether the flag should be rolled back.
+// If so, the window is cleared.
+func (w *rollbackWindow) add(now time.Time, success bool) (float64, bool) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	size := w.window / rollbackBuckets
+	if size <= 0 {
+		size = 1
+	}
+	start := now.Truncate(size)
+	// Times before 1970, eg: the zero time, have negative indexes
+	idx := (start.UnixNano() / int64(size)) % rollbackBuckets
+	if idx < 0 {
+		idx += rollbackBuckets
+	}
+	b := &w.buckets[idx]
+	if !b.start.Equal(start) {
+		*b = rollbackBucket{start: start}
+	}
+	if success {
+		b.success++
+	} else {
+		b.failures++
+	}
+
+	var total, failures int
+	for _, b := range w.buckets {
+		if now.Sub(b.start) < w.window {
+			total += b.success + b.failures
+			failures += b.failures
+		}
+	}
+	if total == 0 || total < w.minOutcomes {
+		return 0, false
+	}
+	failureRate := float64(failures) / float64(total)
+	if failureRate <= w.threshold {
+		return failureRate, false
+	}
+	w.buckets = [rollbackBuckets]rollbackBucket{}
+	return failureRate, true
+}
+
+// GlobalOverrides returns a copy of the global overrides
+func (g *goforit) GlobalOverrides() map[string]bool {
+	ov := g.loadGlobalOverrides()
+	cp := make(map[string]bool, len(ov))
+	for k, v := range ov {
+		cp[k] = v
+	}
+	return cp
+}
+
+// loadGlobalOverrides gets the global overrides without copying them. They
+// shouldn't be modified.
+func (g *goforit) loadGlobalOverrides() overrides {
+	ov, _ := g.globalOverrides.Load().(overrides)
+	return ov
+}
+
+// getOverride looks for an override for a flag in the context, then in the
+// global overrides
+func (g *goforit) getOverride(ctx context.Context, name string, getTags func() map[string]string) (enabled bool, ok bool) {
+	if enabled, ok = getTagOverride(ctx, name, getTags); ok {
+		return
+	}
+	if atomic.LoadInt32(&g.caseInsensitive) != 0 && ctx != nil {
+		// The context may have been overridden with another case
+		var names []string
+		ov, _ := ctx.Value(overrideContextKey).(overrides)
+		for k := range ov {
+			names = append(names, k)
+		}
+		tov, _ := ctx.Value(tagOverrideContextKey).(tagOverrides)
+		for k := range tov {
+			names = append(names, k)
+		}
+		for _, k := range names {
+			if k != name && strings.ToLower(k) == name {
+				if enabled, ok = getTagOverride(ctx, k, getTags); ok {
+					return
+				}
+			}
+		}
+	}
+	if ov := g.loadGlobalOverrides(); len(ov) > 0 {
+		if enabled, ok = ov[name]; ok {
+			return
+		}
+	}
+	if funcs, _ := g.globalOverrideFuncs.Load().(overrideFuncs); funcs[name] != nil {
+		return g.callOverrideFunc(name, funcs[name], getTags())
+	}
+	return
+}
+
+// callOverrideFunc calls a global override function with a copy of the tags.
+// If it panics, that's reported, and there's no override.
+func (g *goforit) callOverrideFunc(name string, fn OverrideFunc, tags map[string]string) (enabled bool, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if len(stack) > maxPanicStack {
+				stack = stack[:maxPanicStack]
+			}
+			err := fmt.Errorf("override for flag %s panicked: %v\n%s", name, r, stack)
+			g.reportError(name, err, "[goforit] ")
+			enabled, ok = false, false
+		}
+	}()
+	cp := make(map[string]string, len(tags))
+	for k, v := range tags {
+		cp[k] = v
+	}
+	return fn(cp), true
+}
+
+// getTagOverride looks for an override for a flag in the context, including
+// overrides that only apply to certain tags. The tags are only fetched if
+// they're needed.
+func getTagOverride(ctx context.Context, name string, getTags func() map[string]string) (enabled bool, ok bool) {
+	if ctx == nil {
+		return false, false
+	}
+	if tov, _ := ctx.Value(tagOverrideContextKey).(tagOverrides); len(tov[name]) > 0 {
+		tags := getTags()
+	overrides:
+		for _, o := range tov[name] {
+			for k, v := range o.match {
+				if tag, ok := tags[k]; !ok || tag != v {
+					continue overrides
+				}
+			}
+			return o.value, true
+		}
+	}
+	return getOverride(ctx, name)
+}
+
+// OverrideForTags overrides the value of a goforit flag within a context, but
+// only when it's checked with tags that include all of the tags in match. If
+// several of these overrides apply, the one that matches the most tags wins.
+// They also take precedence over overrides from Override.
+func OverrideForTags(ctx context.Context, name string, value bool, match map[string]string) context.Context {
+	tov := tagOverrides{}
+	if old, ok := ctx.Value(tagOverrideContextKey).(tagOverrides); ok {
+		for k, v := range old {
+			tov[k] = v
+		}
+	}
+	m := make(map[string]string, len(match))
+	for k, v := range match {
+		m[k] = v
+	}
+	// Don't modify the old slice, it's shared with the parent context
+	flagOverrides := append([]tagOverride{{value, m}}, tov[name]...)
+	sort.SliceStable(flagOverrides, func(i, j int) bool {
+		return len(flagOverrides[i].match) > len(flagOverrides[j].match)
+	})
+	tov[name] = flagOverrides
+	return context.WithValue(ctx, tagOverrideContextKey, tov)
+}
+
+// Override allows overriding the value of a goforit flag within a context.
+// This is mainly useful for tests.
+func Override(ctx context.Context, name string, value bool) context.Context {
+	ov := overrides{}
+	if old, ok := ctx.Value(overrideContextKey).(overrides); ok {
+		for k, v := range old {
+			ov[k] = v
+		}
+	}
+	ov[name] = value
+	return context.WithValue(ctx, overrideContextKey, ov)
+}
+
+// OverrideMany overrides several goforit flags at once within a context. Since
+// the returned context has all the overrides, code using it never sees only
+// some of them applied.
+func OverrideMany(ctx context.Context, values map[string]bool) context.Context {
+	ov := overrides{}
+	if old, ok := ctx.Value(overrideContextKey).(overrides); ok {
+		for k, v := range old {
+			ov[k] = v
+		}
+	}
+	for k, v := range values {
+		ov[k] = v
+	}
+	return context.WithValue(ctx, overrideContextKey, ov)
+}
+
+// ClearOverride removes any override of a goforit flag within a context, so
+// the flag's value comes from the backend again.
+func ClearOverride(ctx context.Context, name string) context.Context {
+	if old, ok := ctx.Value(overrideContextKey).(overrides); ok {
+		if _, ok := old[name]; ok {
+			ov := overrides{}
+			for k, v := range old {
+				if k != name {
+					ov[k] = v
+				}
+			}
+			ctx = context.WithValue(ctx, overrideContextKey, ov)
+		}
+	}
+	if old, ok := ctx.Value(tagOverrideContextKey).(tagOverrides); ok {
+		if _, ok := old[name]; ok {
+			tov := tagOverrides{}
+			for k, v := range old {
+				if k != name {
+					tov[k] = v
+				}
+			}
+			ctx = context.WithValue(ctx, tagOverrideContextKey, tov)
+		}
+	}
+	return ctx
+}
+
+// ClearOverrides removes all overrides of goforit flags within a context.
+func ClearOverrides(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(overrideContextKey).(overrides); ok {
+		ctx = context.WithValue(ctx, overrideContextKey, overrides{})
+	}
+	if _, ok := ctx.Value(tagOverrideContextKey).(tagOverrides); ok {
+		ctx = context.WithValue(ctx, tagOverrideContextKey, tagOverrides{})
+	}
+	return ctx
+}
@@ -0,0 +1,389 @@
+package goforit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// setHealth records the result of a refresh. If it failed, the flags' age is
+// unchanged.
+func (g *goforit) setHealth(err error, updated time.Time) {
+	g.healthMtx.Lock()
+	defer g.healthMtx.Unlock()
+	g.lastRefreshErr = err
+	if err == nil {
+		g.lastUpdated = updated
+	}
+}
+
+// Healthy checks whether the last refresh succeeded, and whether the flags are
+// within the staleness thresholds. If not, it returns an error explaining why.
+// It doesn't refresh the flags.
+func (g *goforit) Healthy() (bool, error) {
+	g.healthMtx.Lock()
+	err, updated := g.lastRefreshErr, g.lastUpdated
+	g.healthMtx.Unlock()
+
+	if err != nil {
+		return false, fmt.Errorf("Last refresh failed: %s", err)
+	}
+	last := atomic.LoadInt64(&g.lastFlagRefreshTime)
+	if last == 0 {
+		return false, errors.New("Flags have never been refreshed")
+	}
+
+	now := g.clock.Now()
+	sourceThresh, refreshThresh := g.getStalenessThresholds()
+	if staleness := now.Sub(time.Unix(0, last)); refreshThresh > 0 && staleness > refreshThresh {
+		return false, fmt.Errorf("Refresh cycle has not run in %s, past our threshold (%s)", staleness, refreshThresh)
+	}
+	if staleness := now.Sub(updated); !updated.IsZero() && sourceThresh > 0 && staleness > sourceThresh {
+		return false, fmt.Errorf("Backend is stale (%s) past our threshold (%s)", staleness, sourceThresh)
+	}
+	return true, nil
+}
+
+// RefreshFlags will use the provided thunk function to
+// fetch all feature flags and update the internal cache.
+// The thunk provided can use a variety of mechanisms for
+// querying the flag values, such as a local file or
+// Consul key/value storage.
+func (g *goforit) RefreshFlags(backend Backend) {
+	g.refreshFlags(backend)
+}
+
+// Refresh immediately reloads the flags from the backend passed to Init,
+// rather than waiting for the next refresh. It returns any error from the
+// backend. If only some flags couldn't be loaded, the rest are still used.
+func (g *goforit) Refresh() error {
+	if g.backend == nil && !g.snapshot {
+		return errors.New("No backend to refresh from, has Init been called?")
+	}
+	return g.refreshFlags(g.backend)
+}
+
+// PauseRefresh stops refreshing the flags periodically, eg: while staging
+// changes in the backend during a migration. The flags that were last loaded
+// are used, and aren't considered stale. Refresh still works.
+func (g *goforit) PauseRefresh() {
+	atomic.StoreInt32(&g.refreshPaused, 1)
+}
+
+// ResumeRefresh starts refreshing the flags periodically again, after
+// PauseRefresh. The flags are refreshed right away, and any error from the
+// backend is returned.
+func (g *goforit) ResumeRefresh() error {
+	atomic.StoreInt32(&g.refreshPaused, 0)
+	return g.Refresh()
+}
+
+func (g *goforit) refreshIsPaused() bool {
+	return atomic.LoadInt32(&g.refreshPaused) != 0
+}
+
+// refreshFlags does the work of RefreshFlags, and returns the backend's error
+func (g *goforit) refreshFlags(backend Backend) (backendErr error) {
+	if g.snapshot {
+		err := errors.New("Can't refresh a snapshot")
+		g.reportError("", err, "[goforit] ")
+		return err
+	}
+	g.refreshMtx.Lock()
+	defer g.refreshMtx.Unlock()
+
+	// Ask the backend for the flags
+	var checkStatus statsd.ServiceCheckStatus
+	defer func() {
+		g.stats.SimpleServiceCheck("goforit.refreshFlags.present", checkStatus)
+	}()
+	refreshedFlags, updated, err := g.refreshBackend(backend)
+	backendErr = err
+	if errs, ok := err.(RefreshErrors); ok {
+		// Some flags couldn't be loaded, but we can still use the rest
+		checkStatus = statsd.Warn
+		g.stats.Count("goforit.refreshFlags.errors", int64(len(errs)), nil, 1)
+		for _, e := range errs {
+			g.reportError("", e, "Error refreshing flags: ")
+		}
+		err = nil
+	}
+	if err != nil {
+		checkStatus = statsd.Warn
+		g.stats.Count("goforit.refreshFlags.errors", 1, nil, 1)
+		g.reportError("", err, "Error refreshing flags: ")
+		g.setHealth(err, time.Time{})
+		return
+	}
+	atomic.StoreInt64(&g.lastFlagRefreshTime, g.clock.Now().UnixNano())
+	g.setHealth(nil, updated)
+	g.storeFlags(refreshedFlags)
+
+	g.staleCheck("", updated, "goforit.flags.cache_file_age_s", 0.1, g.getSourceStalenessThreshold(),
+		"Backend is stale (%s) past our threshold (%s)", false)
+
+	if g.cacheFile != "" {
+		if err := writeCacheFile(g.cacheFile, refreshedFlags, updated); err != nil {
+			g.reportError("", err, "Error writing flag cache: ")
+		}
+	}
+	return
+}
+
+// refreshBackend asks the backend for flags, giving up after the refresh timeout
+func (g *goforit) refreshBackend(backend Backend) ([]Flag, time.Time, error) {
+	if g.refreshTimeout <= 0 {
+		return backend.Refresh()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), g.refreshTimeout)
+	defer cancel()
+
+	type result struct {
+		flags   []Flag
+		updated time.Time
+		err     error
+	}
+	// Buffered, so a backend that ignores the context can still finish later
+	results := make(chan result, 1)
+	go func() {
+		var r result
+		r.flags, r.updated, r.err = refreshContext(ctx, backend)
+		results <- r
+	}()
+
+	select {
+	case r := <-results:
+		if r.err != nil && ctx.Err() == context.DeadlineExceeded {
+			return nil, time.Time{}, ErrRefreshTimeout{g.refreshTimeout}
+		}
+		return r.flags, r.updated, r.err
+	case <-ctx.Done():
+		return nil, time.Time{}, ErrRefreshTimeout{g.refreshTimeout}
+	}
+}
+
+// storeFlags replaces our flags, notifying watchers of changes
+func (g *goforit) storeFlags(refreshedFlags []Flag) {
+	// A refresh that finishes after Close shouldn't start any tickers
+	g.closeMtx.Lock()
+	defer g.closeMtx.Unlock()
+	if atomic.LoadInt32(&g.closed) != 0 {
+		return
+	}
+	refreshedFlags = g.normalizeFlags(refreshedFlags)
+	deleted := make(map[string]bool)
+	g.flags.Range(func(name, flag interface{}) bool {
+		deleted[name.(string)] = true
+		return true
+	})
+
+	for _, flag := range refreshedFlags {
+		delete(deleted, flag.Name)
+		oldFlag, ok := g.flags.Load(flag.Name)
+		if ok {
+			// Avoid churning the map if the flag hasn't changed.
+			if !oldFlag.(Flag).Equal(flag) {
+				flag.enabledTicker = oldFlag.(Flag).enabledTicker
+				g.flags.Store(flag.Name, flag)
+				g.notifyWatchers(oldFlag.(Flag), flag)
+			}
+		} else {
+			flag.enabledTicker = time.NewTicker(g.enabledTickerInterval)
+			g.flags.Store(flag.Name, flag)
+			g.notifyWatchers(Flag{}, flag)
+		}
+	}
+
+	for name, _ := range deleted {
+		f, ok := g.flags.Load(name)
+		if ok {
+			f.(Flag).enabledTicker.Stop()
+			g.flags.Delete(name)
+			g.notifyWatchers(f.(Flag), Flag{})
+		}
+	}
+}
+
+// SetCacheFile keeps a copy of the flags in a file, so that if the backend
+// fails when we start, the last flags we saw can be used. The file is written
+// after each successful refresh, in the same format as BackendFromJSONFile.
+// Flags with custom rules can't be written. This should be called before Init.
+func (g *goforit) SetCacheFile(path string) {
+	g.cacheFile = path
+}
+
+// loadCacheFile loads flags from the cache file, if there is one
+func (g *goforit) loadCacheFile() {
+	flags, updated, err := BackendFromJSONFile(g.cacheFile).Refresh()
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		g.reportError("", err, "Error loading flag cache: ")
+		return
+	}
+
+	g.refreshMtx.Lock()
+	defer g.refreshMtx.Unlock()
+	if atomic.LoadInt64(&g.lastFlagRefreshTime) != 0 {
+		// Already refreshed
+		return
+	}
+	g.healthMtx.Lock()
+	g.lastUpdated = updated
+	g.healthMtx.Unlock()
+	g.storeFlags(flags)
+	g.staleCheck("", updated, "goforit.flags.cache_file_age_s", 0.1, g.getSourceStalenessThreshold(),
+		"Flag cache is stale (%s) past our threshold (%s)", false)
+}
+
+// writeCacheFile writes flags to a cache file, replacing it atomically
+func writeCacheFile(path string, flags []Flag, updated time.Time) error {
+	var v JSONFormat
+	v.Flags = flags
+	if !updated.IsZero() {
+		v.UpdatedTime = float64(updated.UnixNano()) / float64(time.Second)
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetRefreshJitter randomly changes the refresh interval by up to this fraction
+// in either direction, so many processes don't all refresh at the same time.
+// The interval is never made longer than the staleness threshold. This should
+// be called before Init.
+func (g *goforit) SetRefreshJitter(fraction float64) {
+	g.refreshJitter = fraction
+}
+
+// jitterInterval applies any refresh jitter to an interval
+func (g *goforit) jitterInterval(interval time.Duration) time.Duration {
+	if g.refreshJitter <= 0 {
+		return interval
+	}
+	jittered := time.Duration(float64(interval) * (1 + g.refreshJitter*(2*g.rand()-1)))
+	if thresh := g.getRefreshStalenessThreshold(); thresh > 0 && jittered > thresh {
+		jittered = thresh
+	}
+	if jittered <= 0 {
+		// Tickers need a positive interval
+		return interval
+	}
+	if jittered < g.minRefreshInterval {
+		jittered = g.minRefreshInterval
+	}
+	return jittered
+}
+
+// SetMinRefreshInterval stops flags from being refreshed more often than this,
+// to protect shared backends from a misconfigured interval. A shorter interval
+// is replaced with this one, with a warning. This should be called before Init.
+func (g *goforit) SetMinRefreshInterval(d time.Duration) {
+	g.minRefreshInterval = d
+}
+
+// SetRefreshTimeout gives up on each refresh that takes longer than this,
+// reporting an ErrRefreshTimeout and keeping the flags we have. A ContextBackend,
+// like the HTTP backend, has its refresh cancelled. This should be called
+// before Init.
+func (g *goforit) SetRefreshTimeout(d time.Duration) {
+	g.refreshTimeout = d
+}
+
+// clampInterval applies the minimum refresh interval
+func (g *goforit) clampInterval(interval time.Duration) time.Duration {
+	if interval == 0 || interval >= g.minRefreshInterval {
+		return interval
+	}
+	err := fmt.Errorf("Refresh interval %s is shorter than the minimum %s, using the minimum", interval, g.minRefreshInterval)
+	g.reportError("", err, "[goforit] ")
+	return g.minRefreshInterval
+}
+
+// SetRefreshRetry makes periodic refreshes retry when the backend fails, up to
+// maxRetries times. The first retry waits for base, and each one after that
+// waits twice as long as the last. Retries stop before the next refresh is due.
+// This should be called before Init.
+func (g *goforit) SetRefreshRetry(maxRetries int, base time.Duration) {
+	g.refreshRetries = maxRetries
+	g.refreshRetryBase = base
+}
+
+// refreshWithRetry refreshes flags, retrying failures if configured to
+func (g *goforit) refreshWithRetry(backend Backend, interval time.Duration) {
+	err := g.refreshFlags(backend)
+	var waited time.Duration
+	delay := g.refreshRetryBase
+	for retry := 0; retry < g.refreshRetries && err != nil; retry++ {
+		if _, ok := err.(RefreshErrors); ok {
+			// Only some flags failed, that's probably not transient
+			return
+		}
+		if waited+delay >= interval {
+			return
+		}
+		select {
+		case <-g.done:
+			return
+		case <-time.After(delay):
+		}
+		waited += delay
+		delay *= 2
+		err = g.refreshFlags(backend)
+	}
+}
+
+// init initializes the flag backend, using the provided refresh function
+// to update the internal cache of flags periodically, at the specified interval.
+func (g *goforit) init(interval time.Duration, backend Backend) {
+	g.backend = backend
+	if g.cacheFile != "" {
+		g.loadCacheFile()
+	}
+	g.RefreshFlags(backend)
+	interval = g.clampInterval(interval)
+	if interval != 0 {
+		ticker := time.NewTicker(g.jitterInterval(interval))
+		g.ticker = ticker
+
+		done := make(chan struct{})
+		g.done = done
+
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					if !g.refreshIsPaused() {
+						g.refreshWithRetry(backend, interval)
+					}
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+}
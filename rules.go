@@ -0,0 +1,598 @@
+package goforit
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RuleAction string
+
+const (
+	RuleOn       RuleAction = "on"
+	RuleOff      RuleAction = "off"
+	RuleContinue RuleAction = "continue"
+)
+
+var validRuleActions = map[RuleAction]bool{
+	RuleOn:       true,
+	RuleOff:      true,
+	RuleContinue: true,
+}
+
+// A MissingTagPolicy is what a rule that samples by hashing properties, or a
+// match list, does when a property it needs is missing. The missing property
+// is reported either way.
+type MissingTagPolicy string
+
+const (
+	// MissError fails the rule, so the flag is off. This is the default.
+	MissError MissingTagPolicy = ""
+	// MissRandom samples randomly at the rule's rate
+	MissRandom MissingTagPolicy = "random"
+	// MissFalse doesn't match the rule
+	MissFalse MissingTagPolicy = "false"
+	// MissTrue matches the rule
+	MissTrue MissingTagPolicy = "true"
+)
+
+var validMissingTagPolicies = map[MissingTagPolicy]bool{
+	MissError:  true,
+	MissRandom: true,
+	MissFalse:  true,
+	MissTrue:   true,
+}
+
+type RuleInfo struct {
+	Rule    Rule
+	OnMatch RuleAction
+	OnMiss  RuleAction
+}
+
+type Rule interface {
+	Handle(flag string, props map[string]string) (bool, error)
+}
+
+// A timeRule is a Rule that depends on the current time, so it can use our clock
+type timeRule interface {
+	handleAt(now time.Time, flag string, props map[string]string) (bool, error)
+}
+
+// A sampleRule is a Rule that samples randomly or by hashing, so it can use
+// our random source and hash function, or that follows the flag's
+// MissingTagPolicy
+type sampleRule interface {
+	handleSample(s sampler, flag string, props map[string]string) (bool, error)
+}
+
+// A sampler has what a sampleRule needs
+type sampler struct {
+	now  time.Time
+	rand func() float64
+	hash HashFunc
+	// What to do about missing properties, and where to report them if the
+	// rule doesn't fail
+	onMissingTag MissingTagPolicy
+	warnings     *[]error
+}
+
+// The sampler used when a rule is handled outside of goforit
+func defaultSampler() sampler {
+	return sampler{now: time.Now(), rand: rand.Float64, hash: sha1Hash}
+}
+
+// missingTag decides a rule when a property it hashes is missing, according
+// to the policy. With MissRandom, it samples at the given rate.
+func (s sampler) missingTag(err error, rate float64) (bool, error) {
+	if s.onMissingTag == MissError {
+		return false, err
+	}
+	if s.warnings != nil {
+		*s.warnings = append(*s.warnings, err)
+	}
+	switch s.onMissingTag {
+	case MissRandom:
+		return s.rand() < rate, nil
+	case MissTrue:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// A HashFunc hashes a string, for sampling by properties
+type HashFunc func(s string) uint64
+
+// sha1Hash is the default HashFunc, the first 8 bytes of the SHA-1 hash
+func sha1Hash(s string) uint64 {
+	bs := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint64(bs[:])
+}
+
+// A ContextRule is a Rule that wants the context passed to Enabled, eg: so
+// that a slow rule can respect cancellation.
+type ContextRule interface {
+	Rule
+	HandleContext(ctx context.Context, flag string, props map[string]string) (bool, error)
+}
+
+// A TypedRule is a Rule that can use properties that aren't strings, when
+// they're passed to EnabledWith. When checked with Enabled, HandleTyped still
+// gets called, but all the values are strings.
+type TypedRule interface {
+	Rule
+	HandleTyped(flag string, props map[string]interface{}) (bool, error)
+}
+
+type MatchListRule struct {
+	Property string
+	Values   []string
+}
+
+// RateRule matches a fraction of checks, or of values of its properties. A
+// draw in [0, 1) matches if it's less than the rate, so a rate of zero never
+// matches, and a rate of one always does.
+type RateRule struct {
+	Rate       float64
+	Properties []string
+}
+
+// PrerequisiteRule matches if all of the given flags are enabled, with the same
+// properties. It can't be evaluated on its own, only as part of a flag.
+type PrerequisiteRule struct {
+	Flags []string
+}
+
+// How deeply prerequisites can depend on each other, to prevent cycles
+const maxPrerequisiteDepth = 10
+
+// TimeWindowRule matches between the Start and End times. A zero Start or End
+// leaves that side of the window open.
+type TimeWindowRule struct {
+	Start time.Time
+	End   time.Time
+}
+
+// ScheduleRule matches during each occurrence of a cron schedule, for Duration
+// after it starts, eg: "0 9 * * 1-5" for 8h matches during business hours. The
+// schedule has five fields: minute, hour, day of month, month and day of week.
+// Times are in Location, or UTC if it's nil.
+type ScheduleRule struct {
+	Cron     string
+	Duration time.Duration
+	Location *time.Location
+	// The parsed Cron, if it's been parsed
+	schedule *cronSchedule
+}
+
+// RampRule is like a RateRule, but the rate increases steadily from zero at
+// Start to one at End.
+type RampRule struct {
+	Start      time.Time
+	End        time.Time
+	Properties []string
+}
+
+// BucketRule puts each combination of property values into one of a number
+// of buckets, and matches the first Rate fraction of them. The bucket is the
+// same hash as a RateRule's, modulo Buckets, so it's easy to reproduce
+// elsewhere.
+type BucketRule struct {
+	Rate       float64
+	Buckets    int
+	Properties []string
+}
+
+// How many buckets a BucketRule has, if not specified
+const defaultBuckets = 10000
+
+// evaluate runs a flag's rules, to determine whether it's enabled.
+// The depth is how many levels of prerequisites deep we are.
+func (g *goforit) evaluate(ctx context.Context, flag Flag, props map[string]string, depth int, warnings *[]error) (bool, error) {
+	for _, r := range flag.Rules {
+		res, err := g.handleRule(ctx, r.Rule, flag, props, depth, warnings)
+		if err != nil {
+			return false, fmt.Errorf("error evaluating rule:\n %s", err)
+		}
+		var matchBehavior RuleAction
+		if res {
+			matchBehavior = r.OnMatch
+		} else {
+			matchBehavior = r.OnMiss
+		}
+		switch matchBehavior {
+		case RuleOn:
+			return true, nil
+		case RuleOff:
+			return false, nil
+		case RuleContinue:
+			continue
+		default:
+			return false, fmt.Errorf("unknown match behavior: %s", matchBehavior)
+		}
+	}
+	return false, nil
+}
+
+// How much of the stack to include when a rule panics
+const maxPanicStack = 2048
+
+// handleRule evaluates a rule, passing along the context or time if the rule wants it.
+// If the rule panics, that's returned as an error.
+func (g *goforit) handleRule(ctx context.Context, rule Rule, f Flag, props map[string]string, depth int, warnings *[]error) (match bool, err error) {
+	flag := f.Name
+	defer func() {
+		if r := recover(); r != nil {
+			stack := debug.Stack()
+			if len(stack) > maxPanicStack {
+				stack = stack[:maxPanicStack]
+			}
+			match, err = false, fmt.Errorf("rule for flag %s panicked: %v\n%s", flag, r, stack)
+		}
+	}()
+	if pr, ok := rule.(*PrerequisiteRule); ok {
+		return g.prerequisitesEnabled(ctx, pr, props, depth, warnings)
+	}
+	if tr, ok := rule.(timeRule); ok {
+		return tr.handleAt(g.clock.Now(), flag, props)
+	}
+	if sr, ok := rule.(sampleRule); ok {
+		return sr.handleSample(sampler{g.clock.Now(), g.randFor(ctx), g.getHashFunc(), f.OnMissingTag, warnings}, flag, props)
+	}
+	if tr, ok := rule.(TypedRule); ok {
+		return tr.HandleTyped(flag, typedProperties(ctx, props))
+	}
+	if cr, ok := rule.(ContextRule); ok {
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		return cr.HandleContext(ctx, flag, props)
+	}
+	return rule.Handle(flag, props)
+}
+
+// prerequisitesEnabled checks that all of a PrerequisiteRule's flags are enabled
+func (g *goforit) prerequisitesEnabled(ctx context.Context, r *PrerequisiteRule, props map[string]string, depth int, warnings *[]error) (bool, error) {
+	if depth >= maxPrerequisiteDepth {
+		return false, errors.New("Prerequisites are nested too deeply, there may be a cycle")
+	}
+	getProps := func() map[string]string {
+		return props
+	}
+	for _, name := range r.Flags {
+		name = g.resolveAlias(name)
+		if enabled, ok := g.getOverride(ctx, name, getProps); ok {
+			if !enabled {
+				return false, nil
+			}
+			continue
+		}
+
+		f, ok := g.flags.Load(name)
+		if !ok {
+			return false, ErrUnknownFlag{name}
+		}
+		flag := f.(Flag)
+		if !flag.Active {
+			return false, nil
+		}
+		if len(flag.Rules) == 0 {
+			continue
+		}
+		enabled, err := g.evaluate(ctx, flag, props, depth+1, warnings)
+		if err != nil || !enabled {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// hashProperties hashes the flag name and the values of the properties, in
+// order of the property names, all separated by NUL bytes. Sampling uses the
+// most significant 32 bits of the hash, and buckets use all 64.
+func hashProperties(hash HashFunc, flag string, properties []string, props map[string]string) (uint64, error) {
+	// sort the properties for consistent behavior
+	sorted := make([]string, len(properties))
+	copy(sorted, properties)
+	sort.Strings(sorted)
+
+	var buffer bytes.Buffer
+	buffer.WriteString(flag)
+	for _, name := range sorted {
+		buffer.WriteString("\000")
+		prop, err := getProperty(props, name)
+		if err != nil {
+			return 0, err
+		}
+		buffer.WriteString(prop)
+	}
+	return hash(buffer.String()), nil
+}
+
+func getProperty(props map[string]string, prop string) (string, error) {
+	if v, ok := props[prop]; ok {
+		return v, nil
+	} else {
+		return "", errors.New("No property " + prop + " in properties map or default tags.")
+	}
+}
+
+func (r *RateRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleSample(defaultSampler(), flag, props)
+}
+
+func (r *RateRule) handleSample(s sampler, flag string, props map[string]string) (bool, error) {
+	if r.Properties != nil {
+		x, err := hashProperties(s.hash, flag, r.Properties, props)
+		if err != nil {
+			return s.missingTag(err, r.Rate)
+		}
+		// check to see if the 32 most significant bits of the hex
+		// is less than (rate * 2^32)
+		return float64(x>>32) < (r.Rate * float64(1<<32)), nil
+	} else {
+		f := s.rand()
+		return f < r.Rate, nil
+	}
+}
+
+func (r *MatchListRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleSample(defaultSampler(), flag, props)
+}
+
+// handleSample lets a match list follow the flag's MissingTagPolicy, eg: so a
+// blocklist can be on when the property is missing. MissRandom doesn't match.
+func (r *MatchListRule) handleSample(s sampler, flag string, props map[string]string) (bool, error) {
+	prop, ok := props[r.Property]
+	if !ok {
+		if s.onMissingTag == MissError {
+			return false, errors.New("No property " + r.Property + " in properties map or default tags.")
+		}
+		return s.missingTag(ErrMissingTag{Flag: flag, Tag: r.Property}, 0)
+	}
+	for _, val := range r.Values {
+		if val == prop {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *PrerequisiteRule) Handle(flag string, props map[string]string) (bool, error) {
+	return false, errors.New("Prerequisites can only be checked as part of a flag")
+}
+
+func (r *TimeWindowRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleAt(time.Now(), flag, props)
+}
+
+func (r *TimeWindowRule) handleAt(now time.Time, flag string, props map[string]string) (bool, error) {
+	if !r.Start.IsZero() && now.Before(r.Start) {
+		return false, nil
+	}
+	if !r.End.IsZero() && !now.Before(r.End) {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (r *RampRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleSample(defaultSampler(), flag, props)
+}
+
+func (r *RampRule) handleSample(s sampler, flag string, props map[string]string) (bool, error) {
+	rate := r.rate(s.now)
+	if rate <= 0 {
+		return false, nil
+	}
+	rateRule := RateRule{Rate: rate, Properties: r.Properties}
+	return rateRule.handleSample(s, flag, props)
+}
+
+func (r *BucketRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleSample(defaultSampler(), flag, props)
+}
+
+func (r *BucketRule) handleSample(s sampler, flag string, props map[string]string) (bool, error) {
+	bucket, err := r.bucket(s.hash, flag, props)
+	if err != nil {
+		return s.missingTag(err, r.Rate)
+	}
+	return float64(bucket) < r.Rate*float64(r.buckets()), nil
+}
+
+func (r *BucketRule) buckets() int {
+	if r.Buckets <= 0 {
+		return defaultBuckets
+	}
+	return r.Buckets
+}
+
+// bucket figures out which bucket the properties are in
+func (r *BucketRule) bucket(hash HashFunc, flag string, props map[string]string) (int, error) {
+	x, err := hashProperties(hash, flag, r.Properties, props)
+	if err != nil {
+		return 0, err
+	}
+	return int(x % uint64(r.buckets())), nil
+}
+
+func (r *ScheduleRule) Handle(flag string, props map[string]string) (bool, error) {
+	return r.handleAt(time.Now(), flag, props)
+}
+
+func (r *ScheduleRule) handleAt(now time.Time, flag string, props map[string]string) (bool, error) {
+	schedule := r.schedule
+	if schedule == nil {
+		parsed, err := parseCron(r.Cron)
+		if err != nil {
+			return false, err
+		}
+		schedule = &parsed
+	}
+	loc := r.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return schedule.activeAt(now.In(loc), r.Duration), nil
+}
+
+// A cronSchedule has a bit set for each value each field matches
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+	// Whether the day fields are "*". If neither is, a day matches if either
+	// matches, like cron.
+	anyDayOfMonth, anyDayOfWeek bool
+}
+
+// parseCron parses a five field cron expression. Each field may be "*", a
+// number, a range like "1-5", any of those with a step like "*/15", or a comma
+// separated list of them. A number with a step, like "5/15", starts at the
+// number and steps to the end of the field's range.
+func parseCron(expr string) (cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("Cron expression %q should have 5 fields", expr)
+	}
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&s.minute, 0, 59},
+		{&s.hour, 0, 23},
+		{&s.dayOfMonth, 1, 31},
+		{&s.month, 1, 12},
+		{&s.dayOfWeek, 0, 7},
+	}
+	for i, b := range bounds {
+		if *b.bits, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return cronSchedule{}, fmt.Errorf("Cron expression %q: %s", expr, err)
+		}
+	}
+	// Sunday can be 0 or 7
+	if s.dayOfWeek&(1<<7) != 0 {
+		s.dayOfWeek |= 1
+	}
+	s.anyDayOfMonth = fields[2] == "*"
+	s.anyDayOfWeek = fields[4] == "*"
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("bad value in %q", part)
+				}
+			} else if rng == part {
+				// Without a step, it's just the number
+				hi = lo
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dow := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.anyDayOfMonth || s.anyDayOfWeek {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// activeAt checks whether an occurrence started in the duration before now,
+// by finding the last occurrence that started by now. It looks back a day at
+// a time, or a month at a time for months that don't match, and picks the
+// latest matching hour and minute in the first day that has one.
+func (s *cronSchedule) activeAt(now time.Time, duration time.Duration) bool {
+	start := now.Add(-duration)
+	loc := now.Location()
+	y, mo, d := now.Date()
+	hour, minute := now.Hour(), now.Minute()
+	for time.Date(y, mo, d, hour, minute, 0, 0, loc).After(start) {
+		day := time.Date(y, mo, d, 0, 0, 0, 0, loc)
+		if s.month&(1<<uint(mo)) == 0 {
+			// Day 0 is the last day of the previous month
+			y, mo, d = time.Date(y, mo, 0, 0, 0, 0, 0, loc).Date()
+			hour, minute = 23, 59
+			continue
+		}
+		if s.matchesDay(day) {
+			if h, ok := lastBit(s.hour, hour); ok {
+				if h < hour {
+					hour, minute = h, 59
+				}
+				if m, ok := lastBit(s.minute, minute); ok {
+					return time.Date(y, mo, d, hour, m, 0, 0, loc).After(start)
+				}
+				if hour > 0 {
+					// Try the hours before this one
+					hour, minute = hour-1, 59
+					continue
+				}
+			}
+		}
+		y, mo, d = day.AddDate(0, 0, -1).Date()
+		hour, minute = 23, 59
+	}
+	return false
+}
+
+// lastBit finds the highest bit in set, no higher than max
+func lastBit(set uint64, max int) (int, bool) {
+	set &= 1<<uint(max+1) - 1
+	if set == 0 {
+		return 0, false
+	}
+	return 63 - bits.LeadingZeros64(set), true
+}
+
+// rate figures out how far through the ramp we are
+func (r *RampRule) rate(now time.Time) float64 {
+	if now.Before(r.Start) {
+		return 0
+	}
+	if !now.Before(r.End) {
+		return 1
+	}
+	return float64(now.Sub(r.Start)) / float64(r.End.Sub(r.Start))
+}
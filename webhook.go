@@ -0,0 +1,209 @@
+package goforit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Changes to a flag within this long of each other are sent as one
+const webhookFlapWindow = 10 * time.Second
+
+// How many times to retry sending a change, and how long to wait before the
+// first retry
+const webhookRetries = 3
+const webhookRetryDelay = time.Second
+
+// webhookValue is the part of a flag that decides its value. Its name and
+// metadata are left out, so editing just those isn't a change.
+type webhookValue struct {
+	Active            bool             `json:"active"`
+	Rules             []RuleInfo       `json:"rules"`
+	Variants          []VariantInfo    `json:"variants,omitempty"`
+	VariantProperties []string         `json:"variant_properties,omitempty"`
+	Value             string           `json:"value,omitempty"`
+	OnMissingTag      MissingTagPolicy `json:"on_missing_tag,omitempty"`
+}
+
+// webhookChange is the body of a request to a webhook. A flag that was added
+// has a null old value, and one that was removed has a null new value.
+type webhookChange struct {
+	Name string        `json:"name"`
+	Old  *webhookValue `json:"old"`
+	New  *webhookValue `json:"new"`
+	At   time.Time     `json:"at"`
+}
+
+type webhook struct {
+	g          *goforit
+	url        string
+	client     *http.Client
+	window     time.Duration
+	retryDelay time.Duration
+	// Closed when the watch channel is, so retries stop waiting
+	stop chan struct{}
+}
+
+func newWebhook(g *goforit, url string, client *http.Client, window, retryDelay time.Duration) *webhook {
+	return &webhook{g, url, client, window, retryDelay, make(chan struct{})}
+}
+
+// NotifyWebhook POSTs each change to a flag's value to a URL as JSON, like
+// {"name": "go.sun.money", "old": {"active": false, ...}, "new": {"active": true, ...}, "at": "2018-03-01T00:00:00Z"},
+// eg: to announce rollouts. Changes to a flag within a few seconds of each
+// other are combined, and dropped if they cancel out. Changes to just a flag's
+// metadata aren't sent. Failed requests are retried a few times, then reported
+// as errors. Refreshes never wait for the webhook. It stops when Close is
+// called, after trying once to send the changes it hasn't sent yet.
+func (g *goforit) NotifyWebhook(url string) {
+	w := newWebhook(g, url, &http.Client{Timeout: 10 * time.Second}, webhookFlapWindow, webhookRetryDelay)
+	go w.run(g.Watch())
+}
+
+// run combines changes until they've settled, then hands them to another
+// goroutine to send, so it keeps receiving changes while a send is retried
+func (w *webhook) run(changes <-chan FlagChange) {
+	sends := make(chan *webhookChange)
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for change := range sends {
+			w.send(change)
+		}
+	}()
+
+	pending := make(map[string]*webhookChange)
+	deadlines := make(map[string]time.Time)
+	var queue []*webhookChange
+	for {
+		var timer <-chan time.Time
+		var next time.Time
+		for _, d := range deadlines {
+			if next.IsZero() || d.Before(next) {
+				next = d
+			}
+		}
+		if !next.IsZero() {
+			timer = w.g.after(next.Sub(w.g.clock.Now()))
+		}
+		var out chan<- *webhookChange
+		var first *webhookChange
+		if len(queue) > 0 {
+			out = sends
+			first = queue[0]
+		}
+
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				close(w.stop)
+				queue = append(queue, settled(pending, deadlines, time.Time{})...)
+				for _, c := range queue {
+					sends <- c
+				}
+				close(sends)
+				<-sent
+				return
+			}
+			if p, ok := pending[change.Name]; ok {
+				p.New = valueOf(change.New)
+				continue
+			}
+			now := w.g.clock.Now()
+			pending[change.Name] = &webhookChange{
+				Name: change.Name,
+				Old:  valueOf(change.Old),
+				New:  valueOf(change.New),
+				At:   now,
+			}
+			deadlines[change.Name] = now.Add(w.window)
+		case out <- first:
+			queue = queue[1:]
+		case <-timer:
+			queue = append(queue, settled(pending, deadlines, w.g.clock.Now())...)
+		}
+	}
+}
+
+// settled removes the pending changes whose deadlines have passed, or all of
+// them if now is zero, and returns them in the order they were first seen
+func settled(pending map[string]*webhookChange, deadlines map[string]time.Time, now time.Time) []*webhookChange {
+	var ready []*webhookChange
+	for name, d := range deadlines {
+		if now.IsZero() || !d.After(now) {
+			ready = append(ready, pending[name])
+			delete(pending, name)
+			delete(deadlines, name)
+		}
+	}
+	sort.Slice(ready, func(i, j int) bool {
+		if !ready[i].At.Equal(ready[j].At) {
+			return ready[i].At.Before(ready[j].At)
+		}
+		return ready[i].Name < ready[j].Name
+	})
+	return ready
+}
+
+func valueOf(f Flag) *webhookValue {
+	if f.Name == "" {
+		return nil
+	}
+	return &webhookValue{f.Active, f.Rules, f.Variants, f.VariantProperties, f.Value, f.OnMissingTag}
+}
+
+func (v *webhookValue) flag() Flag {
+	return Flag{Active: v.Active, Rules: v.Rules, Variants: v.Variants, VariantProperties: v.VariantProperties, Value: v.Value, OnMissingTag: v.OnMissingTag}
+}
+
+// send posts a change, unless it cancelled itself out
+func (w *webhook) send(change *webhookChange) {
+	if change.Old != nil && change.New != nil && change.Old.flag().Equal(change.New.flag()) {
+		return
+	}
+	if change.Old == nil && change.New == nil {
+		return
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		w.g.reportError(change.Name, err, "[goforit] Error sending flag change to webhook: ")
+		return
+	}
+
+	delay := w.retryDelay
+	for retry := 0; ; retry++ {
+		if err = w.post(body); err == nil {
+			return
+		}
+		if retry >= webhookRetries || !w.wait(delay) {
+			break
+		}
+		delay *= 2
+	}
+	w.g.reportError(change.Name, err, "[goforit] Error sending flag change to webhook: ")
+}
+
+// wait sleeps before a retry, returning false if the webhook stops first
+func (w *webhook) wait(d time.Duration) bool {
+	select {
+	case <-w.stop:
+		return false
+	case <-w.g.after(d):
+		return true
+	}
+}
+
+func (w *webhook) post(body []byte) error {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected response from %s: %s", w.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package goforit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/goforit/goforittest"
+)
+
+func TestNotifyWebhook(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	bodies := make(chan webhookChange, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first request fails, and is retried
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		buf, _ := ioutil.ReadAll(r.Body)
+		var change webhookChange
+		assert.NoError(t, json.Unmarshal(buf, &change))
+		bodies <- change
+	}))
+	defer srv.Close()
+
+	start := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	clock := goforittest.NewManualClock(start)
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	g.SetClock(clock)
+	g.init(0, &dummyFlagsBackend{[]Flag{
+		{Name: "go.on", Active: true},
+		{Name: "go.flapping", Active: true},
+	}})
+	defer g.Close()
+	var errs []error
+	g.SetErrorHandler(func(name string, err error) {
+		errs = append(errs, err)
+	})
+	w := newWebhook(g, srv.URL, srv.Client(), webhookFlapWindow, webhookRetryDelay)
+	changes := g.Watch()
+	go w.run(changes)
+	// received waits for the webhook to see the changes
+	received := func() {
+		deadline := time.Now().Add(time.Second)
+		for len(changes) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Changes aren't being received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A flag that changes and changes back isn't sent, and nor is a change to
+	// just a flag's metadata
+	g.RefreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.on", Active: false}, {Name: "go.flapping", Active: false}}})
+	g.RefreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.on", Active: false}, {Name: "go.flapping", Active: true, Metadata: map[string]string{"owner": "sun"}}}})
+	received()
+	clock.Advance(webhookFlapWindow)
+
+	// The failed request is retried once the clock passes the delay
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&requests) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("Change not retried")
+		}
+		clock.Advance(webhookRetryDelay)
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case change := <-bodies:
+		assert.Equal(t, "go.on", change.Name)
+		assert.Equal(t, &webhookValue{Active: true}, change.Old)
+		assert.Equal(t, &webhookValue{Active: false}, change.New)
+		assert.True(t, start.Equal(change.At))
+	case <-time.After(time.Second):
+		t.Fatal("No change sent")
+	}
+	clock.Advance(webhookFlapWindow)
+	select {
+	case change := <-bodies:
+		t.Fatalf("Unexpected change %v", change)
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+	assert.Empty(t, errs)
+
+	// Changes still pending are sent when closing
+	g.RefreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.on", Active: false}, {Name: "go.flapping", Active: true, Metadata: map[string]string{"owner": "sun"}}, {Name: "go.new", Active: true}}})
+	g.Close()
+	select {
+	case change := <-bodies:
+		assert.Equal(t, "go.new", change.Name)
+		assert.Nil(t, change.Old)
+		assert.Equal(t, &webhookValue{Active: true}, change.New)
+	case <-time.After(time.Second):
+		t.Fatal("No change sent")
+	}
+}
+
+func TestNotifyWebhookErrors(t *testing.T) {
+	t.Parallel()
+
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	g, _ := testGoforit(0, nil, enabledTickerInterval)
+	errs := make(chan error, 10)
+	g.SetErrorHandler(func(name string, err error) {
+		errs <- err
+	})
+	w := newWebhook(g, srv.URL, srv.Client(), time.Millisecond, time.Millisecond)
+	w.send(&webhookChange{Name: "go.on", New: &webhookValue{Active: true}})
+	assert.Equal(t, int32(webhookRetries+1), atomic.LoadInt32(&requests))
+	assert.Contains(t, (<-errs).Error(), "500 Internal Server Error")
+}
+
+func TestNotifyWebhookRetrying(t *testing.T) {
+	t.Parallel()
+
+	var mtx sync.Mutex
+	received := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change webhookChange
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&change))
+		mtx.Lock()
+		defer mtx.Unlock()
+		received[change.Name]++
+		// The first flag keeps failing
+		if change.Name == "go.stuck" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	g, _ := testGoforit(0, &dummyFlagsBackend{}, enabledTickerInterval)
+	errs := make(chan error, 10)
+	g.SetErrorHandler(func(name string, err error) {
+		errs <- err
+	})
+	w := newWebhook(g, srv.URL, srv.Client(), time.Millisecond, time.Hour)
+	changes := g.Watch()
+	done := make(chan struct{})
+	go func() {
+		w.run(changes)
+		close(done)
+	}()
+
+	g.RefreshFlags(&dummyFlagsBackend{[]Flag{{Name: "go.stuck", Active: true}}})
+	for {
+		mtx.Lock()
+		n := received["go.stuck"]
+		mtx.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Changes are still received while a send waits to retry, so more than a
+	// watcher can buffer aren't lost
+	flags := []Flag{{Name: "go.stuck", Active: true}}
+	for i := 0; i < 2*watchBufferSize; i++ {
+		flags = append(flags, Flag{Name: fmt.Sprintf("go.flag%d", i), Active: true})
+		g.RefreshFlags(&dummyFlagsBackend{flags})
+		deadline := time.Now().Add(time.Second)
+		for len(changes) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("Changes aren't being received")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Closing stops waiting to retry, and sends the rest
+	g.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook didn't stop")
+	}
+	assert.Contains(t, (<-errs).Error(), "503 Service Unavailable")
+	mtx.Lock()
+	defer mtx.Unlock()
+	assert.Equal(t, 1, received["go.stuck"])
+	assert.Len(t, received, 2*watchBufferSize+1)
+}